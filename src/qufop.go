@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/qiniu/api.v6/conf"
 	"github.com/qiniu/log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"ufop"
 	"ufop/amerge"
 	"ufop/html2image"
@@ -13,7 +17,9 @@ import (
 	"ufop/mkzip"
 	"ufop/ossimg"
 	//"ufop/roundpic"
+	"ufop/unrar"
 	"ufop/unzip"
+	"ufop/utils"
 )
 
 const (
@@ -21,73 +27,189 @@ const (
 )
 
 func help() {
-	fmt.Printf("Usage: qufop <UfopConfig>\r\n\r\nVERSION: %s\r\n", VERSION)
+	fmt.Printf("Usage: qufop <UfopConfig>\r\n       qufop -check <UfopConfig>\r\n       qufop reqid <RequestId>\r\n\r\nVERSION: %s\r\n", VERSION)
 }
 
 func setQiniuHosts() {
 	conf.RS_HOST = "http://rs.qiniu.com"
+	conf.UP_HOST = "http://up.qiniu.com"
 }
 
-func main() {
-	log.SetOutput(os.Stdout)
-	setQiniuHosts()
-
-	args := os.Args
-	argc := len(args)
+//the handlers built into the binary, registered when enabled by the config
+func jobHandlers() []ufop.UfopJobHandler {
+	return []ufop.UfopJobHandler{
+		&amerge.AudioMerger{},
+		&html2image.Html2Imager{},
+		&html2pdf.Html2Pdfer{},
+		&mkzip.Mkzipper{},
+		&unzip.Unzipper{},
+		&unrar.Unrarer{},
+		&imagecomp.ImageComposer{},
+		//&roundpic.RoundPicer{},
+		&ossimg.OSSImager{},
+	}
+}
 
-	var configFilePath string
+//print the fields of the request id, for tracing the request in the logs
+func printRequestId(reqId string) (err error) {
+	info, ok := utils.ParseRequestId(reqId)
+	if !ok {
+		err = errors.New(fmt.Sprintf("invalid request id '%s'", reqId))
+		return
+	}
+	fmt.Printf("version:  %d\n", info.Version)
+	if info.Version > 0 {
+		instance := fmt.Sprintf("%08x", info.Instance)
+		if info.Instance == utils.InstanceId() {
+			instance += " (this host)"
+		}
+		fmt.Printf("instance: %s\n", instance)
+	}
+	fmt.Printf("pid:      %d\n", info.Pid)
+	fmt.Printf("time:     %s\n", time.Unix(0, info.UnixNano).Format(time.RFC3339Nano))
+	if info.Version > 0 {
+		fmt.Printf("counter:  %d\n", info.Counter)
+	}
+	return
+}
 
-	switch argc {
-	case 2:
-		configFilePath = args[1]
-	default:
-		help()
+//load and validate the ufop config
+func loadConfig(configFilePath string) (ufopConf *ufop.UfopConfig, err error) {
+	ufopConf = &ufop.UfopConfig{}
+	if confErr := ufopConf.LoadFromFile(configFilePath); confErr != nil {
+		err = errors.New(fmt.Sprintf("load config file error, %s", confErr))
 		return
 	}
 
-	//load config
-	ufopConf := &ufop.UfopConfig{}
-	confErr := ufopConf.LoadFromFile(configFilePath)
+	handlers := jobHandlers()
+	names := make([]string, 0, len(handlers))
+	for _, jobHandler := range handlers {
+		names = append(names, jobHandler.Name())
+	}
+	if vErr := ufopConf.Validate(names); vErr != nil {
+		err = errors.New(fmt.Sprintf("invalid config file, %s", vErr))
+	}
+	return
+}
+
+//load the ufop config and register the enabled handlers, all the errors are returned
+func setup(configFilePath string) (ufopServ *ufop.UfopServer, errs []error) {
+	ufopConf, confErr := loadConfig(configFilePath)
 	if confErr != nil {
-		log.Error("load config file error,", confErr)
+		errs = append(errs, confErr)
 		return
 	}
 
-	ufopServ := ufop.NewServer(ufopConf)
+	ufopServ = ufop.NewServer(ufopConf)
+	ufopServ.SetVersion(VERSION)
 
 	//register job handlers
-	if err := ufopServ.RegisterJobHandler("amerge.conf", &amerge.AudioMerger{}); err != nil {
-		log.Error(err)
+	for _, jobHandler := range jobHandlers() {
+		if !ufopConf.IsEnabled(jobHandler.Name()) {
+			continue
+		}
+		if err := ufopServ.RegisterJobHandler(jobHandler); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return
+}
 
-	if err := ufopServ.RegisterJobHandler("html2image.conf", &html2image.Html2Imager{}); err != nil {
-		log.Error(err)
-	}
+//reload the config and the handlers on SIGHUP, the old ones are kept on error
+func reloadOnSignal(ufopServ *ufop.UfopServer, configFilePath string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			log.Info("reload config file", configFilePath)
+			var errs []error
+			ufopConf, confErr := loadConfig(configFilePath)
+			if confErr != nil {
+				errs = append(errs, confErr)
+			} else {
+				errs = ufopServ.Reload(ufopConf, jobHandlers())
+			}
+			if len(errs) > 0 {
+				for _, err := range errs {
+					log.Error("reload config failed, the old config is kept,", err)
+				}
+				continue
+			}
+			log.Info("config reloaded")
+		}
+	}()
+}
 
-	if err := ufopServ.RegisterJobHandler("html2pdf.conf", &html2pdf.Html2Pdfer{}); err != nil {
-		log.Error(err)
-	}
+//shut down the server on SIGTERM or SIGINT, the channel is closed when done
+func shutdownOnSignal(ufopServ *ufop.UfopServer) (stopped chan struct{}) {
+	stopped = make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigs
+		log.Infof("%s received, shutting down", sig)
+		ufopServ.Shutdown()
+		close(stopped)
+	}()
+	return
+}
 
-	if err := ufopServ.RegisterJobHandler("mkzip.conf", &mkzip.Mkzipper{}); err != nil {
-		log.Error(err)
-	}
+func main() {
+	log.SetOutput(os.Stdout)
+	ufop.SetLogOutput(os.Stdout)
+	setQiniuHosts()
 
-	if err := ufopServ.RegisterJobHandler("unzip.conf", &unzip.Unzipper{}); err != nil {
-		log.Error(err)
-	}
+	args := os.Args
+	argc := len(args)
 
-	if err := ufopServ.RegisterJobHandler("imagecomp.conf", &imagecomp.ImageComposer{}); err != nil {
-		log.Error(err)
-	}
+	var configFilePath string
 
-	//if err := ufopServ.RegisterJobHandler("roundpic.conf", &roundpic.RoundPicer{}); err != nil {
-	//	log.Error(err)
-	//}
+	switch {
+	case argc == 2:
+		configFilePath = args[1]
+	case argc == 3 && args[1] == "-check":
+		//validate the configs only, the server is not created
+		var errs []error
+		ufopConf, confErr := loadConfig(args[2])
+		if confErr != nil {
+			errs = append(errs, confErr)
+		} else {
+			errs = ufop.CheckConfig(ufopConf, jobHandlers())
+		}
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+		return
+	case argc == 3 && args[1] == "reqid":
+		if err := printRequestId(args[2]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	default:
+		help()
+		return
+	}
 
-	if err := ufopServ.RegisterJobHandler("ossimg.conf", &ossimg.OSSImager{}); err != nil {
+	ufopServ, errs := setup(configFilePath)
+	for _, err := range errs {
 		log.Error(err)
 	}
+	if ufopServ == nil {
+		return
+	}
+	reloadOnSignal(ufopServ, configFilePath)
+	stopped := shutdownOnSignal(ufopServ)
 
 	//listen
-	ufopServ.Listen()
+	if listenErr := ufopServ.Listen(); listenErr != nil {
+		log.Error(listenErr)
+		return
+	}
+	<-stopped
+	log.Info("server stopped")
 }
@@ -1,19 +1,12 @@
 package amerge
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/rs"
-	"github.com/qiniu/log"
-	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
-	"regexp"
 	"strings"
 	"ufop"
 	"ufop/utils"
@@ -25,15 +18,14 @@ const (
 )
 
 type AudioMerger struct {
-	mac                 *digest.Mac
+	storage             ufop.UfopStorage
 	maxFirstFileLength  uint64
 	maxSecondFileLength uint64
 }
 
 type AudioMergerConfig struct {
 	//ak & sk
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
+	ufop.UfopCredentials
 
 	AmergeMaxFirstFileLength  uint64 `json:"amerge_max_first_file_length,omitempty"`
 	AmergeMaxSecondFileLength uint64 `json:"amerge_max_second_file_length,omitempty"`
@@ -43,16 +35,20 @@ func (this *AudioMerger) Name() string {
 	return "amerge"
 }
 
-func (this *AudioMerger) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open amerge config failed, %s", openErr.Error()))
-		return
+func (this *AudioMerger) RequiredBinaries() []string {
+	return []string{"ffmpeg"}
+}
+
+func (this *AudioMerger) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"amerge_max_first_file_length":  this.maxFirstFileLength,
+		"amerge_max_second_file_length": this.maxSecondFileLength,
 	}
+}
 
+func (this *AudioMerger) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := AudioMergerConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse amerge config failed, %s", decodeErr.Error()))
 		return
@@ -70,7 +66,11 @@ func (this *AudioMerger) InitConfig(jobConf string) (err error) {
 		this.maxSecondFileLength = config.AmergeMaxSecondFileLength
 	}
 
-	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	if credErr := config.LoadCredentials(); credErr != nil {
+		err = errors.New(fmt.Sprintf("Load amerge credentials failed, %s", credErr.Error()))
+		return
+	}
+	this.storage = storage.WithCredentials(config.AccessKey, config.SecretKey)
 
 	return
 }
@@ -86,39 +86,44 @@ amerge
 
 */
 
-func (this *AudioMerger) parse(cmd string) (format string, mime string, bucket string, url string, duration string, err error) {
-	pattern := "^amerge/format/[a-zA-Z0-9]+/mime/[0-9a-zA-Z-_=]+/bucket/[0-9a-zA-Z-_=]+/url/[0-9a-zA-Z-_=]+(/duration/(first|shortest|longest)){0,1}$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid amerge command format")
-		return
-	}
+var amergeParser = utils.NewCommandParser("amerge",
+	utils.ParamSpec{Name: "format", Type: utils.PARAM_TYPE_STRING, Required: true, Pattern: "^[a-zA-Z0-9]+$"},
+	utils.ParamSpec{Name: "mime", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "duration", Type: utils.PARAM_TYPE_ENUM, Default: "longest",
+		Values: []string{"first", "shortest", "longest"}},
+)
 
-	var decodeErr error
-	format = utils.GetParam(cmd, "format/[a-zA-Z0-9]+", "format")
-	mime, decodeErr = utils.GetParamDecoded(cmd, "mime/[0-9a-zA-Z-_=]+", "mime")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'mime'")
-		return
-	}
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'bucket'")
-		return
+//the second file is read from the bucket
+func (this *AudioMerger) Buckets(cmd string) (read []string, write []string, err error) {
+	_, _, bucket, _, _, err := this.parse(cmd)
+	if err == nil {
+		read = []string{bucket}
 	}
-	url, decodeErr = utils.GetParamDecoded(cmd, "url/[0-9a-zA-Z-_=]+", "url")
-	if decodeErr != nil {
-		err = errors.New("invalid amerge parameter 'url'")
+	return
+}
+
+func (this *AudioMerger) parse(cmd string) (format string, mime string, bucket string, url string, duration string, err error) {
+	params, pErr := amergeParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
-	duration = utils.GetParam(cmd, "duration/(first|shortest|longest)", "duration")
-	if duration == "" {
-		duration = "longest"
-	}
+
+	format = params.String("format")
+	mime = params.String("mime")
+	bucket = params.String("bucket")
+	url = params.String("url")
+	duration = params.String("duration")
 	return
 }
 
-func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *AudioMerger) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *AudioMerger) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
 	//parse command
 	dstFormat, dstMime, secondFileBucket, secondFileUrl, dstDuration, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -128,102 +133,82 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	//check first file
 	if req.Src.Fsize > this.maxFirstFileLength {
-		err = errors.New("first file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "first file length exceeds the limit")
 		return
 	}
 	if !strings.HasPrefix(req.Src.MimeType, "audio/") {
-		err = errors.New("first file mimetype not supported")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "first file mimetype not supported")
 		return
 	}
 
 	secondFileUri, pErr := url.Parse(secondFileUrl)
 	if pErr != nil {
-		err = errors.New("second file resource url not valid")
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "second file resource url not valid")
 		return
 	}
 	secondFileKey := strings.TrimPrefix(secondFileUri.Path, "/")
-	client := rs.New(this.mac)
-	sEntry, sErr := client.Stat(nil, secondFileBucket, secondFileKey)
+	sEntry, sErr := this.storage.Stat(ctx, secondFileBucket, secondFileKey)
 	if sErr != nil || sEntry.Hash == "" {
-		err = errors.New("second file not in the specified bucket")
+		err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, "second file not in the specified bucket")
 		return
 	}
 	//check second file
 	if uint64(sEntry.Fsize) > this.maxSecondFileLength {
-		err = errors.New("second file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "second file length exceeds the limit")
 		return
 	}
 	if !strings.HasPrefix(sEntry.MimeType, "audio/") {
-		err = errors.New("second file mimetype not supported")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "second file mimetype not supported")
 		return
 	}
-	//download first and second file
-	fResp, fRespErr := http.Get(req.Src.Url)
-	if fRespErr != nil || fResp.StatusCode != 200 {
-		if fRespErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve first file resource data failed, %s", fRespErr.Error()))
-		} else {
-			err = errors.New(fmt.Sprintf("retrieve first file resource data failed, %s", fResp.Status))
-			if fResp.Body != nil {
-				fResp.Body.Close()
-			}
-		}
-		return
-	}
-
-	fTmpFp, fErr := ioutil.TempFile("", "first")
+	//download first and second file into the scratch dir, removed with it
+	scratch := req.Scratch()
+	fTmpFp, fErr := scratch.CreateTemp("first")
 	if fErr != nil {
-		err = errors.New(fmt.Sprintf("open first file temp file failed, %s", fErr.Error()))
-		return
-	}
-	_, fCpErr := io.Copy(fTmpFp, fResp.Body)
-	if fCpErr != nil {
-		err = errors.New(fmt.Sprintf("save first temp file failed, %s", fCpErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open first file temp file failed, %s", fErr.Error()))
 		return
 	}
-	//close first one
+	//the fsize of the request is not trusted, the limit is checked while downloading
+	fCtx := utils.WithFetchOptions(ctx, utils.FetchOptions{MaxBytes: int64(this.maxFirstFileLength)})
+	_, fGetErr := ufop.StorageDownloadTo(fCtx, this.storage, req.Src.Url, fTmpFp)
 	fTmpFname := fTmpFp.Name()
 	fTmpFp.Close()
-	fResp.Body.Close()
-
-	sResp, sRespErr := http.Get(secondFileUrl)
-	if sRespErr != nil || sResp.StatusCode != 200 {
-		if sRespErr != nil {
-			err = errors.New(fmt.Sprintf("retrieve second file resource data failed, %s", sRespErr.Error()))
-		} else {
-			err = errors.New(fmt.Sprintf("retrieve second file resource data failed, %s", sResp.Status))
-			if sResp.Body != nil {
-				sResp.Body.Close()
-			}
-		}
+	if fGetErr == utils.ErrFetchTooLarge {
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "first file length exceeds the limit")
 		return
 	}
-	sTmpFp, sErr := ioutil.TempFile("", "second")
-	if sErr != nil {
-		err = errors.New(fmt.Sprintf("open second file temp file failed, %s", sErr.Error()))
+	if fGetErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("retrieve first file resource data failed, %s", fGetErr.Error()))
 		return
 	}
-	_, sCpErr := io.Copy(sTmpFp, sResp.Body)
-	if sCpErr != nil {
-		err = errors.New(fmt.Sprintf("save second first tmp file failed, %s", sCpErr.Error()))
+
+	sTmpFp, sErr := scratch.CreateTemp("second")
+	if sErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open second file temp file failed, %s", sErr.Error()))
 		return
 	}
-	//close second one
+	sCtx := utils.WithFetchOptions(ctx, utils.FetchOptions{
+		MaxBytes: int64(this.maxSecondFileLength),
+		Hash:     utils.StatHash(secondFileUrl, sEntry.Hash),
+	})
+	_, sGetErr := ufop.StorageDownloadTo(sCtx, this.storage, secondFileUrl, sTmpFp)
 	sTmpFname := sTmpFp.Name()
 	sTmpFp.Close()
-	sResp.Body.Close()
+	if sGetErr == utils.ErrFetchTooLarge {
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "second file length exceeds the limit")
+		return
+	}
+	if sGetErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("retrieve second file resource data failed, %s", sGetErr.Error()))
+		return
+	}
 
 	//do conversion
-	oTmpFp, oErr := ioutil.TempFile("", "output")
+	oTmpFname, oErr := scratch.TempPath("output")
 	if oErr != nil {
-		err = errors.New(fmt.Sprintf("open output file temp file failed, %s", oErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open output file temp file failed, %s", oErr.Error()))
 		return
 	}
-	oTmpFname := oTmpFp.Name()
-	oTmpFp.Close()
-	//be sure to delete temp files
-	defer os.Remove(fTmpFname)
-	defer os.Remove(sTmpFname)
 
 	//prepare command
 	mergeCmdParams := []string{
@@ -237,46 +222,48 @@ func (this *AudioMerger) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	}
 
 	//exec command
-	mergeCmd := exec.Command("ffmpeg", mergeCmdParams...)
+	mergeCmd := scratch.CommandContext(ctx, "ffmpeg", mergeCmdParams...)
 
 	stdErrPipe, pipeErr := mergeCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
 	if startErr := mergeCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start ffmpeg command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("start ffmpeg command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read ffmpeg command stderr error, %s", readErr.Error()))
-		defer os.Remove(oTmpFname)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("read ffmpeg command stderr error, %s", readErr.Error()))
 		return
 	}
 
 	//check stderr output & output file
 	if string(stdErrData) != "" {
-		log.Error(string(stdErrData))
+		req.Logger().Warnf("ffmpeg stderr, %s", stdErrData)
 	}
 
 	if waitErr := mergeCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait ffmpeg to exit error, %s", waitErr))
-		defer os.Remove(oTmpFname)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("wait ffmpeg to exit error, %s", waitErr))
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(oTmpFname); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("audio merge with no valid output result")
-		defer os.Remove(oTmpFname)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, "audio merge with no valid output result")
+		return
+	}
+	if uErr := scratch.UpdateUsage(); uErr != nil {
+		err = uErr
 		return
 	}
 
 	//write result
-	result = oTmpFname
-	resultType = ufop.RESULT_TYPE_OCTECT_FILE
-	contentType = dstMime
+	result.Type = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Body = oTmpFname
+	result.MimeType = dstMime
+	result.Filename = fmt.Sprintf("amerge.%s", dstFormat)
 
 	return
 }
@@ -0,0 +1,166 @@
+package ufop
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"github.com/qiniu/api.v6/auth/digest"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//the authentication of the requests to /uop and /jobs
+const (
+	AUTH_TYPE_HMAC = "hmac"
+	AUTH_TYPE_QBOX = "qbox"
+
+	//the hmac signed requests carry the unix seconds of the signing time,
+	//rejected if too far from the local time
+	AUTH_TIMESTAMP_HEADER = "X-Ufop-Timestamp"
+	AUTH_MAX_CLOCK_SKEW   = 300 * time.Second
+)
+
+//check the Authorization header of the requests by the keys of the callers
+//
+//hmac: "UFOP <access key>:<sign>", the sign is the url safe base64 of the
+//hmac-sha1 of "<method> <path>[?<query>]\n<timestamp>\n<body>" by the secret
+//key, and the timestamp is given by X-Ufop-Timestamp
+//
+//qbox: "QBox <access key>:<sign>", the qiniu access token, the sign is the
+//url safe base64 of the hmac-sha1 of "<path>[?<query>]\n", followed by the body
+//for the application/x-www-form-urlencoded requests only
+type UfopAuthenticator struct {
+	authType string
+	//secret keys by the access keys
+	secretKeys map[string][]byte
+}
+
+//nil if the authentication is off, only the allowed keys are accepted if any,
+//the keys of the ufop config are for the storage, not accepted unless they are
+//in the auth keys too, for qbox does not sign the json bodies
+func NewAuthenticator(cfg *UfopConfig) (auth *UfopAuthenticator, err error) {
+	switch cfg.AuthType {
+	case "":
+		return
+	case AUTH_TYPE_HMAC, AUTH_TYPE_QBOX:
+	default:
+		err = errors.New(fmt.Sprintf("unknown auth type '%s'", cfg.AuthType))
+		return
+	}
+
+	secretKeys := make(map[string][]byte, len(cfg.AuthKeys))
+	for _, key := range cfg.AuthKeys {
+		if key.AccessKey == "" || key.SecretKey == "" {
+			err = errors.New("empty access key or secret key in the auth keys")
+			return
+		}
+		secretKeys[key.AccessKey] = []byte(key.SecretKey)
+	}
+
+	if len(cfg.AuthAllowedKeys) > 0 {
+		allowedKeys := make(map[string][]byte, len(cfg.AuthAllowedKeys))
+		for _, accessKey := range cfg.AuthAllowedKeys {
+			secretKey, ok := secretKeys[accessKey]
+			if !ok {
+				err = errors.New(fmt.Sprintf("no secret key for the allowed key '%s'", accessKey))
+				return
+			}
+			allowedKeys[accessKey] = secretKey
+		}
+		secretKeys = allowedKeys
+	}
+	if len(secretKeys) == 0 {
+		err = errors.New(fmt.Sprintf("no keys for the auth type '%s'", cfg.AuthType))
+		return
+	}
+
+	auth = &UfopAuthenticator{
+		authType:   cfg.AuthType,
+		secretKeys: secretKeys,
+	}
+	return
+}
+
+//the authenticator rejecting all the requests, used when the auth config is
+//broken so the requests are not let through
+func newDenyAllAuthenticator() *UfopAuthenticator {
+	return &UfopAuthenticator{secretKeys: map[string][]byte{}}
+}
+
+//check the request with the body already read, the access key of the caller
+//is returned, the error is an UNAUTHORIZED ufop error
+func (this *UfopAuthenticator) Verify(req *http.Request, body []byte) (accessKey string, err error) {
+	scheme := "UFOP "
+	if this.authType == AUTH_TYPE_QBOX {
+		scheme = "QBox "
+	}
+	authorization := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, scheme) {
+		err = NewUfopError(ERROR_UNAUTHORIZED, "missing authorization")
+		return
+	}
+	token := strings.TrimPrefix(authorization, scheme)
+	sepIndex := strings.Index(token, ":")
+	if sepIndex <= 0 {
+		err = NewUfopError(ERROR_UNAUTHORIZED, "invalid authorization")
+		return
+	}
+	secretKey, ok := this.secretKeys[token[:sepIndex]]
+	if !ok {
+		err = NewUfopError(ERROR_UNAUTHORIZED, "unknown access key")
+		return
+	}
+
+	mac := digest.Mac{AccessKey: token[:sepIndex], SecretKey: secretKey}
+	var expected string
+	if this.authType == AUTH_TYPE_QBOX {
+		incBody := req.Header.Get("Content-Type") == "application/x-www-form-urlencoded"
+		expected = mac.Sign(qboxSignData(req, body, incBody))
+	} else {
+		timestamp := req.Header.Get(AUTH_TIMESTAMP_HEADER)
+		signTime, pErr := strconv.ParseInt(timestamp, 10, 64)
+		if pErr != nil {
+			err = NewUfopError(ERROR_UNAUTHORIZED, "invalid timestamp")
+			return
+		}
+		skew := time.Since(time.Unix(signTime, 0))
+		if skew > AUTH_MAX_CLOCK_SKEW || skew < -AUTH_MAX_CLOCK_SKEW {
+			err = NewUfopError(ERROR_UNAUTHORIZED, "request expired")
+			return
+		}
+		expected = mac.Sign(hmacSignData(req, timestamp, body))
+	}
+	if !hmac.Equal([]byte(token), []byte(expected)) {
+		err = NewUfopError(ERROR_UNAUTHORIZED, "invalid signature")
+		return
+	}
+	accessKey = mac.AccessKey
+	return
+}
+
+//sign the request for the hmac authentication, for the callers in go
+func SignRequest(req *http.Request, body []byte, accessKey, secretKey string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := digest.Mac{AccessKey: accessKey, SecretKey: []byte(secretKey)}
+	req.Header.Set(AUTH_TIMESTAMP_HEADER, timestamp)
+	req.Header.Set("Authorization", "UFOP "+mac.Sign(hmacSignData(req, timestamp, body)))
+}
+
+func hmacSignData(req *http.Request, timestamp string, body []byte) []byte {
+	data := fmt.Sprintf("%s %s\n%s\n", req.Method, req.URL.RequestURI(), timestamp)
+	return append([]byte(data), body...)
+}
+
+func qboxSignData(req *http.Request, body []byte, incBody bool) []byte {
+	data := req.URL.Path
+	if req.URL.RawQuery != "" {
+		data += "?" + req.URL.RawQuery
+	}
+	signData := []byte(data + "\n")
+	if incBody {
+		signData = append(signData, body...)
+	}
+	return signData
+}
@@ -0,0 +1,112 @@
+package ufop_test
+
+import (
+	"bytes"
+	"github.com/qiniu/api.v6/auth/digest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"ufop"
+)
+
+func newAuthRequest(body string) *http.Request {
+	return httptest.NewRequest("POST", "/uop", bytes.NewReader([]byte(body)))
+}
+
+func serveAuth(env *testEnv, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	env.serv.ServeUfop(w, req)
+	return w
+}
+
+func TestAuthHmac(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.AuthType = ufop.AUTH_TYPE_HMAC
+	env.cfg.AuthKeys = []ufop.UfopCredentials{
+		{AccessKey: "caller-a", SecretKey: "secret-a"},
+		{AccessKey: "caller-b", SecretKey: "secret-b"},
+	}
+	env.serv = ufop.NewServer(env.cfg)
+	body := `{"cmd":"qn-none"}`
+
+	//authenticated, then rejected for no fop
+	req := newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	expectError(t, serveAuth(env, req), 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+
+	expectError(t, serveAuth(env, newAuthRequest(body)), 401, ufop.ERROR_UNAUTHORIZED, "missing authorization")
+
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-c", "secret-a")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "unknown access key")
+
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-b")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "invalid signature")
+
+	//the body is signed
+	req = newAuthRequest(`{"cmd":"qn-other"}`)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "invalid signature")
+
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	req.Header.Set(ufop.AUTH_TIMESTAMP_HEADER, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "request expired")
+
+	//only the allowed keys
+	env.cfg.AuthAllowedKeys = []string{"caller-b"}
+	env.serv = ufop.NewServer(env.cfg)
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "unknown access key")
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-b", "secret-b")
+	expectError(t, serveAuth(env, req), 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+
+	//the broken config rejects all
+	env.cfg.AuthAllowedKeys = []string{"caller-none"}
+	if err := env.cfg.Validate(nil); err == nil {
+		t.Fatal("expect invalid auth config")
+	}
+	env.serv = ufop.NewServer(env.cfg)
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-b", "secret-b")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "unknown access key")
+}
+
+func TestAuthQbox(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.AuthType = ufop.AUTH_TYPE_QBOX
+	body := `{"cmd":"qn-none"}`
+
+	//the storage key of the config is not accepted
+	if _, err := ufop.NewAuthenticator(env.cfg); err == nil || err.Error() != "no keys for the auth type 'qbox'" {
+		t.Fatalf("unexpected auth error %v", err)
+	}
+	env.cfg.AuthKeys = []ufop.UfopCredentials{{AccessKey: "caller-ak", SecretKey: "caller-sk"}}
+	env.serv = ufop.NewServer(env.cfg)
+	mac := digest.Mac{AccessKey: testAccessKey, SecretKey: []byte(testSecretKey)}
+	req := newAuthRequest(body)
+	token, _ := mac.SignRequest(req, false)
+	req.Header.Set("Authorization", "QBox "+token)
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "unknown access key")
+
+	//signed by the auth key
+	mac = digest.Mac{AccessKey: "caller-ak", SecretKey: []byte("caller-sk")}
+	req = newAuthRequest(body)
+	token, _ = mac.SignRequest(req, false)
+	req.Header.Set("Authorization", "QBox "+token)
+	expectError(t, serveAuth(env, req), 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+
+	req = httptest.NewRequest("POST", "/uop?async=1", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "QBox "+token)
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "invalid signature")
+
+	//the hmac header is not accepted
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-ak", "caller-sk")
+	expectError(t, serveAuth(env, req), 401, ufop.ERROR_UNAUTHORIZED, "missing authorization")
+}
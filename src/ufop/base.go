@@ -1,10 +1,16 @@
 package ufop
 
+import (
+	"context"
+	"io"
+)
+
 const (
 	RESULT_TYPE_JSON = iota
 	RESULT_TYPE_OCTECT_BYTES
 	RESULT_TYPE_OCTECT_FILE
 	RESULT_TYPE_OCTECT_URL
+	RESULT_TYPE_OCTECT_STREAM
 )
 
 const (
@@ -12,10 +18,41 @@ const (
 	CONTENT_TYPE_OCTECT = "application/octect-stream"
 )
 
+//result of RESULT_TYPE_OCTECT_STREAM, writes the body to the client directly
+//instead of buffering it, an io.Reader result is also accepted
+type UfopStreamWriter func(w io.Writer) error
+
+func toStreamWriter(result interface{}) UfopStreamWriter {
+	switch v := result.(type) {
+	case UfopStreamWriter:
+		return v
+	case func(w io.Writer) error:
+		return UfopStreamWriter(v)
+	case io.Reader:
+		return func(w io.Writer) error {
+			if closer, ok := v.(io.Closer); ok {
+				defer closer.Close()
+			}
+			_, cpErr := io.Copy(w, v)
+			return cpErr
+		}
+	}
+	return nil
+}
+
 type UfopRequest struct {
 	Cmd   string         `json:"cmd"`
 	Src   UfopRequestSrc `json:"src"`
+	Async bool           `json:"async,omitempty"`
 	ReqId string         `json:"-"`
+
+	//set for async jobs
+	progress func(int)
+	//set by the server for each request
+	scratch *UfopScratch
+	//the access key of the authenticated caller, empty if not authenticated
+	caller string
+	logger *UfopLogger
 }
 
 type UfopRequestSrc struct {
@@ -24,13 +61,76 @@ type UfopRequestSrc struct {
 	Fsize    uint64 `json:"fsize"`
 }
 
-type UfopError struct {
-	Request UfopRequest
-	Error   string
+//report the job progress in percent, only takes effect in async mode
+func (this UfopRequest) ReportProgress(progress int) {
+	if this.progress != nil {
+		this.progress(progress)
+	}
+}
+
+//the logger of the request, the lines carry the request id, the fop and the
+//other fields of the request
+func (this UfopRequest) Logger() *UfopLogger {
+	if this.logger == nil {
+		return NewLogger(this.ReqId)
+	}
+	return this.logger
+}
+
+//the scratch dir of the request, the temp files of the handler and the
+//external programs it runs should be created here, the dir is removed after
+//the response is written
+func (this UfopRequest) Scratch() *UfopScratch {
+	return this.scratch
+}
+
+//result of the handler, the body depends on the type:
+//
+//RESULT_TYPE_JSON			any value encoded as json
+//RESULT_TYPE_OCTECT_BYTES	[]byte
+//RESULT_TYPE_OCTECT_FILE	local file path, removed after the response, normally in the scratch dir
+//RESULT_TYPE_OCTECT_URL	remote url, proxied to the client
+//RESULT_TYPE_OCTECT_STREAM	UfopStreamWriter or io.Reader
+type UfopResult struct {
+	Type     int
+	Body     interface{}
+	MimeType string
+	//suggested file name, sent in Content-Disposition
+	Filename string
+	//body size in bytes, 0 if unknown
+	Size int64
+	//extra response headers
+	Headers map[string]string
 }
 
 type UfopJobHandler interface {
 	Name() string
-	InitConfig(jobConf string) error
-	Do(ufopReq UfopRequest) (interface{}, int, string, error)
+	//the job config is the json settings of the handler, see DecodeJobConfig,
+	//the storage is shared by the handlers, see UfopStorage.WithCredentials
+	InitConfig(jobConf []byte, storage UfopStorage) error
+	Do(ufopReq UfopRequest) (UfopResult, error)
+}
+
+//handlers implementing this are called with DoContext instead of Do, the context
+//is done when the client goes away or the job deadline is reached
+type UfopContextJobHandler interface {
+	UfopJobHandler
+	DoContext(ctx context.Context, ufopReq UfopRequest) (UfopResult, error)
+}
+
+//optional, the external programs the handler runs, checked by /ready
+type UfopBinaryDependent interface {
+	RequiredBinaries() []string
+}
+
+//optional, the buckets the command reads from and writes to, the command is
+//without the ufop prefix, checked by the read and write buckets of the handler
+//config and limited by the bucket limits before the handler runs
+type UfopBucketUser interface {
+	Buckets(cmd string) (read []string, write []string, err error)
+}
+
+//optional, the effective config limits of the handler, shown by /handlers
+type UfopLimitsReporter interface {
+	Limits() map[string]interface{}
 }
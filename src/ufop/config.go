@@ -1,10 +1,14 @@
 package ufop
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"ufop/utils"
 )
 
 //default ufop config
@@ -14,6 +18,17 @@ var defaultUfopConfig UfopConfig = UfopConfig{
 	ReadTimeout:    1800,
 	WriteTimeout:   1800,
 	MaxHeaderBytes: 1 << 12,
+	AsyncWorkers:   4,
+	AsyncQueueSize: 100,
+	AsyncJobTTL:    3600,
+	MaxQueueSize:   100,
+	QueueTimeout:   60,
+
+	ShutdownTimeout: 30,
+
+	FetchConnectTimeout: 10,
+	FetchReadTimeout:    60,
+	FetchRetries:        3,
 }
 
 type UfopConfig struct {
@@ -27,6 +42,99 @@ type UfopConfig struct {
 
 	//make you ufop instance name unique
 	UfopPrefix string `json:"ufop_prefix"`
+
+	//ak & sk, used to save the results by the saveas parameter, and by the
+	//handlers without their own keys, QUFOP_ACCESS_KEY and QUFOP_SECRET_KEY
+	//are used if no keys configured
+	UfopCredentials
+
+	//storage of the buckets, qiniu or local, the local storage keeps the
+	//buckets as the sub dirs of the storage dir
+	StorageType string `json:"storage_type,omitempty"`
+	StorageDir  string `json:"storage_dir,omitempty"`
+
+	//async job mode
+	AsyncWorkers   int    `json:"async_workers,omitempty"`
+	AsyncQueueSize int    `json:"async_queue_size,omitempty"`
+	AsyncJobTTL    int    `json:"async_job_ttl,omitempty"`
+	AsyncResultDir string `json:"async_result_dir,omitempty"`
+
+	//concurrency limits, <= 0 means no limit
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	MaxQueueSize   int `json:"max_queue_size,omitempty"`
+	QueueTimeout   int `json:"queue_timeout,omitempty"`
+
+	//seconds to wait for the running jobs on shutdown before they are cancelled
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
+
+	//root dir of the scratch dirs of the requests, and the quota of them in
+	//bytes, <= 0 means no limit, the root dir is cleared at start
+	ScratchDir   string `json:"scratch_dir,omitempty"`
+	ScratchQuota int64  `json:"scratch_quota,omitempty"`
+
+	//seconds of the connect timeout and the read timeout of the resources
+	//fetched by url, and the retries on the network errors and 5xx, < 0 means
+	//no retry
+	FetchConnectTimeout int `json:"fetch_connect_timeout,omitempty"`
+	FetchReadTimeout    int `json:"fetch_read_timeout,omitempty"`
+	FetchRetries        int `json:"fetch_retries,omitempty"`
+
+	//dir of the cached resources fetched by url, and the size budget of them
+	//in bytes, <= 0 means no cache, the dir is cleared at start
+	FetchCacheDir  string `json:"fetch_cache_dir,omitempty"`
+	FetchCacheSize int64  `json:"fetch_cache_size,omitempty"`
+
+	//the policy of the urls fetched by the handlers and the external programs,
+	//the schemes are http and https by default, the hosts are the host names,
+	//the domain suffixes like .example.com, or the ips and cidrs, the private,
+	//loopback and link local addresses are rejected unless allowed
+	UrlSchemes      []string `json:"url_schemes,omitempty"`
+	UrlAllowHosts   []string `json:"url_allow_hosts,omitempty"`
+	UrlDenyHosts    []string `json:"url_deny_hosts,omitempty"`
+	UrlAllowPrivate bool     `json:"url_allow_private,omitempty"`
+
+	//authentication of the requests to /uop and /jobs, hmac or qbox, none if
+	//empty, the callers sign the requests by the auth keys, only the allowed
+	//access keys are accepted if set
+	AuthType        string            `json:"auth_type,omitempty"`
+	AuthKeys        []UfopCredentials `json:"auth_keys,omitempty"`
+	AuthAllowedKeys []string          `json:"auth_allowed_keys,omitempty"`
+
+	//rate limits and daily byte quotas of the buckets used by the jobs, and of
+	//the callers authenticated by their access keys, the limits of the fops are
+	//in the handler settings
+	BucketLimits map[string]UfopRateLimit `json:"bucket_limits,omitempty"`
+	CallerLimits map[string]UfopRateLimit `json:"caller_limits,omitempty"`
+
+	//names of the command parameters hidden in the request logs, like url or
+	//saveas, "src" hides the src url
+	LogRedactParams []string `json:"log_redact_params,omitempty"`
+
+	//per handler settings, keyed by the handler name without prefix
+	Handlers map[string]UfopHandlerConfig `json:"handlers,omitempty"`
+	//names of the handlers to register, empty means all
+	Enabled []string `json:"enabled,omitempty"`
+
+	//dir of the config file, the handler config paths are relative to it
+	configDir string
+}
+
+type UfopHandlerConfig struct {
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+	//job deadline in seconds, <= 0 means no deadline
+	Timeout int `json:"timeout,omitempty"`
+
+	//the buckets the handler may read from and write to, including the saveas
+	//bucket, empty means any bucket
+	ReadBuckets  []string `json:"read_buckets,omitempty"`
+	WriteBuckets []string `json:"write_buckets,omitempty"`
+	//rate limit and daily byte quota of the fop
+	UfopRateLimit
+
+	//the handler config, given inline by settings or by the path of the config
+	//file, <name>.conf beside the ufop config is used if neither is set
+	Settings json.RawMessage `json:"settings,omitempty"`
+	Config   string          `json:"config,omitempty"`
 }
 
 func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
@@ -38,10 +146,27 @@ func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
 	defer confFp.Close()
 
 	decoder := json.NewDecoder(confFp)
+	decoder.DisallowUnknownFields()
 	decodeErr := decoder.Decode(this)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse ufop config failed, %s", decodeErr))
 	}
+	this.configDir = filepath.Dir(configFilePath)
+	if err == nil {
+		this.resolveSecretFile(this.configDir)
+		if credErr := this.loadDefaultCredentials(); credErr != nil {
+			err = errors.New(fmt.Sprintf("Load ufop credentials failed, %s", credErr))
+		}
+	}
+	for index := range this.AuthKeys {
+		if err != nil {
+			break
+		}
+		this.AuthKeys[index].resolveSecretFile(this.configDir)
+		if credErr := this.AuthKeys[index].LoadCredentials(); credErr != nil {
+			err = errors.New(fmt.Sprintf("Load ufop auth keys failed, %s", credErr))
+		}
+	}
 	if this.ListenPort <= 0 {
 		this.ListenPort = defaultUfopConfig.ListenPort
 	}
@@ -51,5 +176,138 @@ func (this *UfopConfig) LoadFromFile(configFilePath string) (err error) {
 	if this.WriteTimeout <= 0 {
 		this.WriteTimeout = defaultUfopConfig.WriteTimeout
 	}
+	if this.AsyncWorkers <= 0 {
+		this.AsyncWorkers = defaultUfopConfig.AsyncWorkers
+	}
+	if this.AsyncQueueSize <= 0 {
+		this.AsyncQueueSize = defaultUfopConfig.AsyncQueueSize
+	}
+	if this.AsyncJobTTL <= 0 {
+		this.AsyncJobTTL = defaultUfopConfig.AsyncJobTTL
+	}
+	if this.MaxQueueSize <= 0 {
+		this.MaxQueueSize = defaultUfopConfig.MaxQueueSize
+	}
+	if this.QueueTimeout <= 0 {
+		this.QueueTimeout = defaultUfopConfig.QueueTimeout
+	}
+	if this.ShutdownTimeout <= 0 {
+		this.ShutdownTimeout = defaultUfopConfig.ShutdownTimeout
+	}
+	if this.FetchConnectTimeout <= 0 {
+		this.FetchConnectTimeout = defaultUfopConfig.FetchConnectTimeout
+	}
+	if this.FetchReadTimeout <= 0 {
+		this.FetchReadTimeout = defaultUfopConfig.FetchReadTimeout
+	}
+	if this.FetchRetries == 0 {
+		this.FetchRetries = defaultUfopConfig.FetchRetries
+	} else if this.FetchRetries < 0 {
+		this.FetchRetries = 0
+	}
+	if this.AsyncResultDir == "" {
+		this.AsyncResultDir = os.TempDir()
+	}
+	if this.ScratchDir == "" {
+		this.ScratchDir = os.TempDir()
+	}
+	if this.FetchCacheDir == "" {
+		this.FetchCacheDir = os.TempDir()
+	}
+	return
+}
+
+//the sub dir of the scratch dir owned by the instance, different for the
+//instances on the same host, only the owned dir is swept
+func (this *UfopConfig) ScratchRoot() string {
+	return filepath.Join(this.ScratchDir, fmt.Sprintf("qufop_scratch_%d", this.ListenPort))
+}
+
+//the sub dir of the fetch cache dir owned by the instance, like the scratch root
+func (this *UfopConfig) FetchCacheRoot() string {
+	return filepath.Join(this.FetchCacheDir, fmt.Sprintf("qufop_cache_%d", this.ListenPort))
+}
+
+//check the handler names of the handlers and enabled settings, the known
+//handlers are the ones built into the binary
+func (this *UfopConfig) Validate(knownHandlers []string) (err error) {
+	known := make(map[string]bool, len(knownHandlers))
+	for _, name := range knownHandlers {
+		known[name] = true
+	}
+
+	for _, name := range this.Enabled {
+		if !known[name] {
+			err = errors.New(fmt.Sprintf("unknown handler '%s' in enabled", name))
+			return
+		}
+	}
+	for name, handlerCfg := range this.Handlers {
+		if !known[name] {
+			err = errors.New(fmt.Sprintf("unknown handler '%s' in handlers", name))
+			return
+		}
+		if len(handlerCfg.Settings) > 0 && handlerCfg.Config != "" {
+			err = errors.New(fmt.Sprintf("both settings and config set for handler '%s'", name))
+			return
+		}
+	}
+	if _, pErr := this.URLPolicy(); pErr != nil {
+		err = errors.New(fmt.Sprintf("invalid url policy, %s", pErr))
+		return
+	}
+	if _, aErr := NewAuthenticator(this); aErr != nil {
+		err = errors.New(fmt.Sprintf("invalid auth config, %s", aErr))
+		return
+	}
+	return
+}
+
+func (this *UfopConfig) URLPolicy() (*utils.URLPolicy, error) {
+	return utils.NewURLPolicy(this.UrlSchemes, this.UrlAllowHosts, this.UrlDenyHosts, this.UrlAllowPrivate)
+}
+
+func (this *UfopConfig) IsEnabled(name string) bool {
+	if len(this.Enabled) == 0 {
+		return true
+	}
+	for _, enabled := range this.Enabled {
+		if enabled == name {
+			return true
+		}
+	}
+	return false
+}
+
+//the config passed to the InitConfig of the handler, the relative secret file
+//in it is resolved against the config dir
+func (this *UfopConfig) LoadJobConfig(name string) (jobConf []byte, err error) {
+	handlerCfg := this.Handlers[name]
+	if len(handlerCfg.Settings) > 0 {
+		jobConf = resolveJobSecretFile(handlerCfg.Settings, this.configDir)
+		return
+	}
+
+	confPath := handlerCfg.Config
+	if confPath == "" {
+		confPath = name + ".conf"
+	}
+	if !filepath.IsAbs(confPath) {
+		confPath = filepath.Join(this.configDir, confPath)
+	}
+	jobConf, readErr := ioutil.ReadFile(confPath)
+	if readErr != nil {
+		err = errors.New(fmt.Sprintf("Open %s config failed, %s", name, readErr))
+		return
+	}
+	jobConf = resolveJobSecretFile(jobConf, this.configDir)
+	return
+}
+
+//decode the handler config, the unknown fields are errors
+func DecodeJobConfig(jobConf []byte, v interface{}) (err error) {
+	decoder := json.NewDecoder(bytes.NewReader(jobConf))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(v)
 	return
 }
@@ -0,0 +1,103 @@
+package ufop_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"ufop"
+	"ufop/mkzip"
+)
+
+func loadTestConfig(t *testing.T, dir, confData string) (*ufop.UfopConfig, error) {
+	confPath := filepath.Join(dir, "qufop.conf")
+	if err := ioutil.WriteFile(confPath, []byte(confData), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ufop.UfopConfig{}
+	return cfg, cfg.LoadFromFile(confPath)
+}
+
+func TestLoadConfigUnknownField(t *testing.T) {
+	_, err := loadTestConfig(t, t.TempDir(), `{"ufop_prefix":"qn-","listen_prot":9100}`)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "listen_prot"`) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	_, err = loadTestConfig(t, t.TempDir(), `{"ufop_prefix":"qn-","handlers":{"mkzip":{"timeuot":10}}}`)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "timeuot"`) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestLoadJobConfig(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "conf"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "conf", "unzip.json"), []byte(`{"unzip_max_file_count":1}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "unrar.conf"), []byte(`{"unrar_max_file_count":2}`), 0644)
+
+	cfg, err := loadTestConfig(t, dir, `{
+		"ufop_prefix": "qn-",
+		"enabled": ["mkzip", "unzip", "unrar"],
+		"handlers": {
+			"mkzip": {"timeout": 10, "settings": {"mkzip_max_file_count": 3}},
+			"unzip": {"config": "conf/unzip.json"}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate([]string{"mkzip", "unzip", "unrar", "amerge"}); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.IsEnabled("unrar") || cfg.IsEnabled("amerge") {
+		t.Fatal("unexpected enabled handlers")
+	}
+
+	expects := map[string]string{
+		"mkzip": `{"mkzip_max_file_count": 3}`,
+		"unzip": `{"unzip_max_file_count":1}`,
+		"unrar": `{"unrar_max_file_count":2}`,
+	}
+	for name, expect := range expects {
+		jobConf, err := cfg.LoadJobConfig(name)
+		if err != nil || string(jobConf) != expect {
+			t.Fatalf("unexpected config of %s, %s %v", name, string(jobConf), err)
+		}
+	}
+	if _, err := cfg.LoadJobConfig("amerge"); err == nil || !strings.Contains(err.Error(), "Open amerge config failed") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	known := []string{"mkzip", "unzip"}
+	cases := map[string]string{
+		`{"enabled":["mkzip","unrar"]}`:                                      "unknown handler 'unrar' in enabled",
+		`{"handlers":{"amerge":{"timeout":10}}}`:                             "unknown handler 'amerge' in handlers",
+		`{"handlers":{"mkzip":{"settings":{},"config":"mkzip.conf"}}}`:       "both settings and config set for handler 'mkzip'",
+		`{"enabled":["unzip"],"handlers":{"mkzip":{"config":"mkzip.conf"}}}`: "",
+	}
+	for confData, expect := range cases {
+		cfg, err := loadTestConfig(t, t.TempDir(), confData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cfg.Validate(known)
+		if (expect == "" && err != nil) || (expect != "" && (err == nil || err.Error() != expect)) {
+			t.Fatalf("unexpected error of %s, %v", confData, err)
+		}
+	}
+}
+
+func TestDecodeJobConfig(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.Handlers = map[string]ufop.UfopHandlerConfig{
+		"mkzip": {Settings: []byte(`{"mkzip_max_file_cuont":3}`)},
+	}
+	err := env.serv.RegisterJobHandler(&mkzip.Mkzipper{})
+	if err == nil || err.Error() != `init job handler for cmd 'mkzip' error, Parse mkzip config failed, json: unknown field "mkzip_max_file_cuont"` {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
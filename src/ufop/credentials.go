@@ -0,0 +1,120 @@
+package ufop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+//default environment variables of the keys of the ufop config
+const (
+	ACCESS_KEY_ENV = "QUFOP_ACCESS_KEY"
+	SECRET_KEY_ENV = "QUFOP_SECRET_KEY"
+)
+
+//ak & sk of the ufop config and the handler configs, the keys are given in
+//the config directly, or by the environment variables, or by the secret file
+//like {"access_key":"<Access Key>","secret_key":"<Secret Key>"}, in the order
+//of precedence: secret file, environment variables, config
+type UfopCredentials struct {
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+
+	//names of the environment variables holding the keys
+	AccessKeyEnv string `json:"access_key_env,omitempty"`
+	SecretKeyEnv string `json:"secret_key_env,omitempty"`
+
+	//path of the secret file, like the one mounted by the container, the
+	//relative path is against the directory of the ufop config
+	SecretFile string `json:"secret_file,omitempty"`
+}
+
+type ufopSecretFile struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+//resolve the keys into AccessKey and SecretKey, both or neither of them are set
+func (this *UfopCredentials) LoadCredentials() (err error) {
+	if this.AccessKeyEnv != "" {
+		if this.AccessKey, err = lookupEnv(this.AccessKeyEnv); err != nil {
+			return
+		}
+	}
+	if this.SecretKeyEnv != "" {
+		if this.SecretKey, err = lookupEnv(this.SecretKeyEnv); err != nil {
+			return
+		}
+	}
+
+	if this.SecretFile != "" {
+		secretData, readErr := ioutil.ReadFile(this.SecretFile)
+		if readErr != nil {
+			err = errors.New(fmt.Sprintf("read secret file failed, %s", readErr))
+			return
+		}
+		secret := ufopSecretFile{}
+		decoder := json.NewDecoder(bytes.NewReader(secretData))
+		decoder.DisallowUnknownFields()
+		if decodeErr := decoder.Decode(&secret); decodeErr != nil {
+			err = errors.New(fmt.Sprintf("parse secret file failed, %s", decodeErr))
+			return
+		}
+		this.AccessKey = secret.AccessKey
+		this.SecretKey = secret.SecretKey
+	}
+
+	if (this.AccessKey == "") != (this.SecretKey == "") {
+		err = errors.New("access key and secret key must be set together")
+	}
+	return
+}
+
+//the keys of the ufop config default to the well known environment variables
+func (this *UfopCredentials) loadDefaultCredentials() (err error) {
+	if this.AccessKey == "" && this.SecretKey == "" && this.AccessKeyEnv == "" &&
+		this.SecretKeyEnv == "" && this.SecretFile == "" {
+		this.AccessKey = os.Getenv(ACCESS_KEY_ENV)
+		this.SecretKey = os.Getenv(SECRET_KEY_ENV)
+	}
+	return this.LoadCredentials()
+}
+
+//the relative secret file is against the config dir, like the handler configs
+func (this *UfopCredentials) resolveSecretFile(configDir string) {
+	if this.SecretFile != "" && !filepath.IsAbs(this.SecretFile) {
+		this.SecretFile = filepath.Join(configDir, this.SecretFile)
+	}
+}
+
+//resolve the relative secret file of the handler config, the config is kept as
+//it is if not a json object, the handler reports the error on parsing
+func resolveJobSecretFile(jobConf []byte, configDir string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(jobConf, &fields); err != nil {
+		return jobConf
+	}
+	cred := UfopCredentials{}
+	if err := json.Unmarshal(fields["secret_file"], &cred.SecretFile); err != nil || cred.SecretFile == "" {
+		return jobConf
+	}
+	cred.resolveSecretFile(configDir)
+	fields["secret_file"], _ = json.Marshal(cred.SecretFile)
+	resolvedConf, err := json.Marshal(fields)
+	if err != nil {
+		return jobConf
+	}
+	return resolvedConf
+}
+
+func lookupEnv(name string) (value string, err error) {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		err = errors.New(fmt.Sprintf("environment variable '%s' not set", name))
+	}
+	return
+}
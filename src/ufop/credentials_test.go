@@ -0,0 +1,111 @@
+package ufop_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"ufop"
+	"ufop/mkzip"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret.json")
+	ioutil.WriteFile(secretFile, []byte(`{"access_key":"file-ak","secret_key":"file-sk"}`), 0600)
+	t.Setenv("TEST_AK", "env-ak")
+	t.Setenv("TEST_SK", "env-sk")
+
+	cases := []struct {
+		cred      ufop.UfopCredentials
+		accessKey string
+		secretKey string
+		err       string
+	}{
+		{ufop.UfopCredentials{AccessKey: "ak", SecretKey: "sk"}, "ak", "sk", ""},
+		{ufop.UfopCredentials{AccessKey: "ak", SecretKey: "sk", AccessKeyEnv: "TEST_AK", SecretKeyEnv: "TEST_SK"}, "env-ak", "env-sk", ""},
+		{ufop.UfopCredentials{AccessKeyEnv: "TEST_AK", SecretKeyEnv: "TEST_SK", SecretFile: secretFile}, "file-ak", "file-sk", ""},
+		{ufop.UfopCredentials{AccessKeyEnv: "TEST_AK", SecretKeyEnv: "TEST_NONE"}, "", "", "environment variable 'TEST_NONE' not set"},
+		{ufop.UfopCredentials{AccessKeyEnv: "TEST_AK"}, "", "", "access key and secret key must be set together"},
+		{ufop.UfopCredentials{SecretFile: filepath.Join(dir, "none.json")}, "", "", "read secret file failed, open " +
+			filepath.Join(dir, "none.json") + ": no such file or directory"},
+		{ufop.UfopCredentials{}, "", "", ""},
+	}
+	for index, c := range cases {
+		err := c.cred.LoadCredentials()
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Fatalf("case %d, unexpected error %v", index, err)
+			}
+			continue
+		}
+		if err != nil || c.cred.AccessKey != c.accessKey || c.cred.SecretKey != c.secretKey {
+			t.Fatalf("case %d, unexpected keys %s %s %v", index, c.cred.AccessKey, c.cred.SecretKey, err)
+		}
+	}
+
+	//the relative secret files are against the config dir, not the working dir
+	cfg, err := loadTestConfig(t, dir, `{
+		"ufop_prefix": "qn-",
+		"secret_file": "secret.json",
+		"auth_keys": [{"secret_file": "secret.json"}],
+		"handlers": {"mkzip": {"settings": {"secret_file": "secret.json"}}}
+	}`)
+	if err != nil || cfg.AccessKey != "file-ak" || cfg.SecretKey != "file-sk" || cfg.SecretFile != secretFile {
+		t.Fatalf("unexpected keys %s %s %v", cfg.AccessKey, cfg.SecretKey, err)
+	}
+	if cfg.AuthKeys[0].AccessKey != "file-ak" || cfg.AuthKeys[0].SecretFile != secretFile {
+		t.Fatalf("unexpected auth keys %+v", cfg.AuthKeys[0])
+	}
+	jobConf, err := cfg.LoadJobConfig("mkzip")
+	jobCred := ufop.UfopCredentials{}
+	if err != nil || json.Unmarshal(jobConf, &jobCred) != nil || jobCred.SecretFile != secretFile {
+		t.Fatalf("unexpected job config %s %v", jobConf, err)
+	}
+}
+
+func TestDefaultCredentials(t *testing.T) {
+	t.Setenv(ufop.ACCESS_KEY_ENV, "default-ak")
+	t.Setenv(ufop.SECRET_KEY_ENV, "default-sk")
+
+	cfg, err := loadTestConfig(t, t.TempDir(), `{"ufop_prefix":"qn-"}`)
+	if err != nil || cfg.AccessKey != "default-ak" || cfg.SecretKey != "default-sk" {
+		t.Fatalf("unexpected keys %s %s %v", cfg.AccessKey, cfg.SecretKey, err)
+	}
+
+	cfg, err = loadTestConfig(t, t.TempDir(), `{"ufop_prefix":"qn-","access_key":"ak","secret_key":"sk"}`)
+	if err != nil || cfg.AccessKey != "ak" || cfg.SecretKey != "sk" {
+		t.Fatalf("unexpected keys %s %s %v", cfg.AccessKey, cfg.SecretKey, err)
+	}
+}
+
+func TestHandlerCredentials(t *testing.T) {
+	env := newTestEnv(t)
+	t.Setenv("TEST_MKZIP_SK", testSecretKey)
+	secretFile := filepath.Join(env.dir, "secret.json")
+	ioutil.WriteFile(secretFile, []byte(`{"access_key":"`+testAccessKey+`","secret_key":"bad-sk"}`), 0600)
+
+	env.cfg.Handlers = map[string]ufop.UfopHandlerConfig{
+		"mkzip": {Settings: []byte(`{"access_key_env":"TEST_MKZIP_AK","secret_key_env":"TEST_MKZIP_SK"}`)},
+	}
+	err := env.serv.RegisterJobHandler(&mkzip.Mkzipper{})
+	if err == nil || err.Error() != "init job handler for cmd 'mkzip' error, Load mkzip credentials failed, environment variable 'TEST_MKZIP_AK' not set" {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	//the handler keys are checked by the fake qiniu
+	t.Setenv("TEST_MKZIP_AK", testAccessKey)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{
+		"access_key_env": "TEST_MKZIP_AK",
+		"secret_key_env": "TEST_MKZIP_SK",
+	})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	w := env.do("mkzip/bucket/"+encode(testBucket)+"/url/"+encode(urlA), ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{
+		"secret_file": secretFile,
+	})
+	w = env.do("mkzip/bucket/"+encode(testBucket)+"/url/"+encode(urlA), ufop.UfopRequestSrc{})
+	expectError(t, w, 502, ufop.ERROR_STORAGE_FAILED, "batch stat error, bad token")
+}
@@ -0,0 +1,112 @@
+package ufop
+
+import (
+	"context"
+)
+
+//stable error codes for the clients to branch on
+const (
+	ERROR_BAD_REQUEST           = "BAD_REQUEST"
+	ERROR_BAD_COMMAND           = "BAD_COMMAND"
+	ERROR_NO_FOP                = "NO_FOP"
+	ERROR_UNSUPPORTED_MIMETYPE  = "UNSUPPORTED_MIMETYPE"
+	ERROR_SRC_TOO_LARGE         = "SRC_TOO_LARGE"
+	ERROR_LIMIT_EXCEEDED        = "LIMIT_EXCEEDED"
+	ERROR_RESOURCE_NOT_FOUND    = "RESOURCE_NOT_FOUND"
+	ERROR_UPSTREAM_FETCH_FAILED = "UPSTREAM_FETCH_FAILED"
+	ERROR_STORAGE_FAILED        = "STORAGE_FAILED"
+	ERROR_PROCESS_FAILED        = "PROCESS_FAILED"
+	ERROR_QUEUE_FULL            = "QUEUE_FULL"
+	ERROR_QUEUE_TIMEOUT         = "QUEUE_TIMEOUT"
+	ERROR_JOB_CANCELLED         = "JOB_CANCELLED"
+	ERROR_JOB_TIMEOUT           = "JOB_TIMEOUT"
+	ERROR_SHUTTING_DOWN         = "SHUTTING_DOWN"
+	ERROR_SCRATCH_FULL          = "SCRATCH_FULL"
+	ERROR_URL_FORBIDDEN         = "URL_FORBIDDEN"
+	ERROR_UNAUTHORIZED          = "UNAUTHORIZED"
+	ERROR_BUCKET_FORBIDDEN      = "BUCKET_FORBIDDEN"
+	ERROR_RATE_LIMITED          = "RATE_LIMITED"
+	ERROR_QUOTA_EXCEEDED        = "QUOTA_EXCEEDED"
+	ERROR_NOT_FOUND             = "NOT_FOUND"
+	ERROR_METHOD_NOT_ALLOWED    = "METHOD_NOT_ALLOWED"
+	ERROR_INTERNAL              = "INTERNAL_ERROR"
+	//the handler returned an error without code
+	ERROR_FOP_FAILED = "FOP_FAILED"
+)
+
+var errorStatusCodes = map[string]int{
+	ERROR_BAD_REQUEST:           400,
+	ERROR_BAD_COMMAND:           400,
+	ERROR_NO_FOP:                400,
+	ERROR_UNSUPPORTED_MIMETYPE:  415,
+	ERROR_SRC_TOO_LARGE:         413,
+	ERROR_LIMIT_EXCEEDED:        400,
+	ERROR_RESOURCE_NOT_FOUND:    404,
+	ERROR_UPSTREAM_FETCH_FAILED: 502,
+	ERROR_STORAGE_FAILED:        502,
+	ERROR_PROCESS_FAILED:        500,
+	ERROR_QUEUE_FULL:            503,
+	ERROR_QUEUE_TIMEOUT:         503,
+	ERROR_JOB_CANCELLED:         503,
+	ERROR_JOB_TIMEOUT:           504,
+	ERROR_SHUTTING_DOWN:         503,
+	ERROR_SCRATCH_FULL:          507,
+	ERROR_URL_FORBIDDEN:         403,
+	ERROR_UNAUTHORIZED:          401,
+	ERROR_BUCKET_FORBIDDEN:      403,
+	ERROR_RATE_LIMITED:          429,
+	ERROR_QUOTA_EXCEEDED:        429,
+	ERROR_NOT_FOUND:             404,
+	ERROR_METHOD_NOT_ALLOWED:    405,
+	ERROR_INTERNAL:              500,
+	ERROR_FOP_FAILED:            400,
+}
+
+type UfopError struct {
+	Code    string `json:"code"`
+	Status  int    `json:"-"`
+	Message string `json:"error"`
+	//seconds to retry, sent in Retry-After too, 0 if unknown
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+func (this *UfopError) Error() string {
+	return this.Message
+}
+
+//the http status is decided by the code
+func NewUfopError(code string, message string) *UfopError {
+	status, ok := errorStatusCodes[code]
+	if !ok {
+		status = 400
+	}
+	return &UfopError{
+		Code:    code,
+		Status:  status,
+		Message: message,
+	}
+}
+
+//keep the error if it has a code already, otherwise give it the code
+func WrapUfopError(code string, err error) *UfopError {
+	if err == nil {
+		return nil
+	}
+	if v, ok := err.(*UfopError); ok {
+		return v
+	}
+	return NewUfopError(code, err.Error())
+}
+
+//the error caused by the cancelled or timeout context
+func contextUfopError(ctx context.Context) *UfopError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return NewUfopError(ERROR_JOB_TIMEOUT, "job cancelled, deadline exceeded")
+	}
+	return NewUfopError(ERROR_JOB_CANCELLED, "job cancelled, "+ctx.Err().Error())
+}
+
+//the error of the job cancelled by the server shutdown
+func shutdownUfopError() *UfopError {
+	return NewUfopError(ERROR_SHUTTING_DOWN, "job cancelled, server is shutting down")
+}
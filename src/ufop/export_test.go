@@ -0,0 +1,22 @@
+package ufop
+
+import (
+	"net/http"
+)
+
+//the handler tests in package ufop_test drive the handlers through the server
+func (this *UfopServer) ServeUfop(w http.ResponseWriter, req *http.Request) {
+	this.serveUfop(w, req)
+}
+
+func (this *UfopServer) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	this.serveMetrics(w, req)
+}
+
+func (this *UfopServer) ServeReady(w http.ResponseWriter, req *http.Request) {
+	this.serveReady(w, req)
+}
+
+func (this *UfopServer) ServeHandlers(w http.ResponseWriter, req *http.Request) {
+	this.serveHandlers(w, req)
+}
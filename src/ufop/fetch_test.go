@@ -0,0 +1,76 @@
+package ufop_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"image/color"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"ufop"
+	"ufop/imagecomp"
+	"ufop/mkzip"
+	"ufop/unzip"
+)
+
+//the src fsize is not trusted
+func TestUnzipFsizeLie(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unzip.Unzipper{}, map[string]interface{}{
+		"unzip_max_zip_file_length": 1024,
+	})
+
+	src := env.src("large.zip", make([]byte, 2048), "application/zip")
+	src.Fsize = 100
+	w := env.do("unzip/bucket/"+encode(testBucket), src)
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
+}
+
+//the fop result never matches the stat hash of the source file
+func TestMkzipFopQuery(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA) + "/alias/" + encode("a.txt") +
+		"/url/" + encode(urlA+"?imageView2/1/w/100") + "/alias/" + encode("b.txt")
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, zipFile := range zipReader.File {
+		fr, _ := zipFile.Open()
+		data, _ := ioutil.ReadAll(fr)
+		fr.Close()
+		contents[zipFile.Name] = string(data)
+	}
+	if len(contents) != 2 || contents["a.txt"] != "hello" || contents["b.txt"] != "hello?imageView2/1/w/100" {
+		t.Fatalf("unexpected zip contents %v", contents)
+	}
+}
+
+func TestImagecompCache(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.FetchCacheSize = 1 << 20
+	env.serv = ufop.NewServer(env.cfg)
+	env.register(&imagecomp.ImageComposer{}, map[string]interface{}{})
+
+	tileUrl := env.fake.PutFile(testBucket, "tile.png", makePng(t, 10, 10, color.RGBA{0xFF, 0, 0, 0xFF}), "image/png")
+	cmd := "imagecomp/bucket/" + encode(testBucket) + "/format/png/rows/1/cols/2/url/" + encode(tileUrl) +
+		"/url/" + encode(tileUrl)
+	expectStatus(t, env.do(cmd, ufop.UfopRequestSrc{}), 200)
+	expectStatus(t, env.do(cmd, ufop.UfopRequestSrc{}), 200)
+
+	w := httptest.NewRecorder()
+	env.serv.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, line := range []string{"ufop_fetch_cache_hits_total 3", "ufop_fetch_cache_misses_total 1", "ufop_fetch_cache_entries 1"} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("metric %q not found in %s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,666 @@
+package ufop_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"ufop"
+	"ufop/amerge"
+	"ufop/html2image"
+	"ufop/html2pdf"
+	"ufop/imagecomp"
+	"ufop/mkzip"
+	"ufop/ossimg"
+	"ufop/qiniutest"
+	"ufop/unrar"
+	"ufop/unzip"
+	"ufop/utils"
+)
+
+const (
+	testAccessKey = "test-access-key"
+	testSecretKey = "test-secret-key"
+	testBucket    = "if-pbl"
+	testPrefix    = "qn-"
+)
+
+type testEnv struct {
+	t    *testing.T
+	dir  string
+	fake *qiniutest.FakeQiniu
+	cfg  *ufop.UfopConfig
+	serv *ufop.UfopServer
+}
+
+//the server with the keys of the fake qiniu, the handlers are registered by register
+func newTestEnv(t *testing.T) *testEnv {
+	fake := qiniutest.NewFakeQiniu(testAccessKey, testSecretKey)
+	restore := fake.SetHosts()
+	t.Cleanup(func() {
+		restore()
+		fake.Close()
+	})
+	fake.MakeBucket(testBucket)
+
+	dir := t.TempDir()
+	env := &testEnv{t: t, dir: dir, fake: fake}
+	confPath := env.writeConf("qufop.conf", map[string]interface{}{
+		"ufop_prefix":      testPrefix,
+		"access_key":       testAccessKey,
+		"secret_key":       testSecretKey,
+		"async_result_dir": dir,
+		"scratch_dir":      filepath.Join(dir, "scratch"),
+		//the fake qiniu listens on the loopback address
+		"url_allow_private": true,
+	})
+	cfg := &ufop.UfopConfig{}
+	if err := cfg.LoadFromFile(confPath); err != nil {
+		t.Fatal(err)
+	}
+	env.cfg = cfg
+	env.serv = ufop.NewServer(cfg)
+	return env
+}
+
+func (this *testEnv) writeConf(name string, conf map[string]interface{}) string {
+	confData, _ := json.Marshal(conf)
+	confPath := filepath.Join(this.dir, name)
+	if err := ioutil.WriteFile(confPath, confData, 0644); err != nil {
+		this.t.Fatal(err)
+	}
+	return confPath
+}
+
+//register the handler with the settings in the ufop config
+func (this *testEnv) register(handler ufop.UfopJobHandler, conf map[string]interface{}) {
+	settings, _ := json.Marshal(conf)
+	if this.cfg.Handlers == nil {
+		this.cfg.Handlers = make(map[string]ufop.UfopHandlerConfig)
+	}
+	this.cfg.Handlers[handler.Name()] = ufop.UfopHandlerConfig{Settings: settings}
+	if err := this.serv.RegisterJobHandler(handler); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+//save the file to the test bucket as the src of the request
+func (this *testEnv) src(key string, data []byte, mimeType string) ufop.UfopRequestSrc {
+	return ufop.UfopRequestSrc{
+		Url:      this.fake.PutFile(testBucket, key, data, mimeType),
+		MimeType: mimeType,
+		Fsize:    uint64(len(data)),
+	}
+}
+
+func (this *testEnv) do(cmd string, src ufop.UfopRequestSrc) *httptest.ResponseRecorder {
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"cmd": testPrefix + cmd,
+		"src": src,
+	})
+	w := httptest.NewRecorder()
+	this.serv.ServeUfop(w, httptest.NewRequest("POST", "/uop", bytes.NewReader(reqData)))
+	this.expectScratchEmpty()
+	return w
+}
+
+//nothing left in the scratch dirs after the response, the owned dir is named
+//by the listen port, which may be changed after the server is created
+func (this *testEnv) expectScratchEmpty() {
+	this.t.Helper()
+	rootInfos, err := ioutil.ReadDir(this.cfg.ScratchDir)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	for _, rootInfo := range rootInfos {
+		fileInfos, err := ioutil.ReadDir(filepath.Join(this.cfg.ScratchDir, rootInfo.Name()))
+		if err != nil {
+			this.t.Fatal(err)
+		}
+		if len(fileInfos) > 0 {
+			this.t.Fatalf("scratch dir %s not removed", fileInfos[0].Name())
+		}
+	}
+}
+
+func (this *testEnv) doAsync(cmd string) *httptest.ResponseRecorder {
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"cmd":   testPrefix + cmd,
+		"async": true,
+	})
+	w := httptest.NewRecorder()
+	this.serv.ServeUfop(w, httptest.NewRequest("POST", "/uop", bytes.NewReader(reqData)))
+	return w
+}
+
+func encode(str string) string {
+	return base64.URLEncoding.EncodeToString([]byte(str))
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("expect status %d, got %d, %s", status, w.Code, w.Body.String())
+	}
+}
+
+func expectError(t *testing.T, w *httptest.ResponseRecorder, status int, code, message string) {
+	t.Helper()
+	expectStatus(t, w, status)
+	var ufopErr ufop.UfopError
+	if err := json.Unmarshal(w.Body.Bytes(), &ufopErr); err != nil {
+		t.Fatalf("invalid error body, %s", w.Body.String())
+	}
+	if ufopErr.Code != code || ufopErr.Message != message {
+		t.Fatalf("expect error %s '%s', got %s '%s'", code, message, ufopErr.Code, ufopErr.Message)
+	}
+}
+
+func skipWithoutBinary(t *testing.T, binary string) {
+	if _, err := exec.LookPath(binary); err != nil {
+		t.Skipf("%s not found", binary)
+	}
+}
+
+func makeZip(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	zipWriter := zip.NewWriter(buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fw, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(files[name])
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func makePng(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNoFop(t *testing.T) {
+	env := newTestEnv(t)
+	w := env.do("mkzip/bucket/"+encode(testBucket), ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+}
+
+func TestMkzip(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	urlB := env.fake.PutFile(testBucket, "dir/b.txt", []byte("world"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA) + "/alias/" + encode("x.txt") +
+		"/url/" + encode(urlB)
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+	if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "mkzip.zip") {
+		t.Fatalf("unexpected content disposition %s", cd)
+	}
+	if !w.Flushed {
+		t.Fatal("zip stream not flushed")
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, zipFile := range zipReader.File {
+		fr, _ := zipFile.Open()
+		data, _ := ioutil.ReadAll(fr)
+		fr.Close()
+		contents[zipFile.Name] = string(data)
+	}
+	if len(contents) != 2 || contents["x.txt"] != "hello" || contents["dir/b.txt"] != "world" {
+		t.Fatalf("unexpected zip contents %v", contents)
+	}
+}
+
+func TestMkzipErrors(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{
+		"mkzip_max_file_count": 2,
+	})
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	missingUrl := env.fake.Url(testBucket, "missing.txt")
+
+	w := env.do("mkzip/bucket/"+encode(testBucket), ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid mkzip command format, missing parameter 'url'")
+
+	w = env.do("mkzip/bucket/"+encode(testBucket)+"/url/"+encode(urlA)+"/url/"+encode(missingUrl), ufop.UfopRequestSrc{})
+	expectError(t, w, 404, ufop.ERROR_RESOURCE_NOT_FOUND,
+		"batch stat '"+missingUrl+"' error, no such file or directory")
+
+	w = env.do("mkzip/bucket/"+encode("no-bucket")+"/url/"+encode(urlA), ufop.UfopRequestSrc{})
+	expectError(t, w, 404, ufop.ERROR_RESOURCE_NOT_FOUND, "batch stat '"+urlA+"' error, no such bucket")
+
+	cmd := "mkzip/bucket/" + encode(testBucket)
+	for _, alias := range []string{"1", "2", "3"} {
+		cmd += "/url/" + encode(urlA) + "/alias/" + encode(alias)
+	}
+	w = env.do(cmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_LIMIT_EXCEEDED, "zip file count exceeds the limit")
+
+	w = env.do("mkzip/bucket/"+encode(testBucket)+"/url/"+encode(urlA)+"/url/"+encode(urlA), ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "duplicate mkzip resource alias")
+}
+
+func TestSaveas(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA) + "/saveas/" + encode(testBucket+":out.zip")
+	for i := 0; i < 2; i++ {
+		//the second time overwrites the file
+		w := env.do(cmd, ufop.UfopRequestSrc{})
+		expectStatus(t, w, 200)
+
+		var saveasResult ufop.UfopSaveasResult
+		json.Unmarshal(w.Body.Bytes(), &saveasResult)
+		file, ok := env.fake.GetFile(testBucket, "out.zip")
+		if !ok {
+			t.Fatal("result not saved")
+		}
+		if saveasResult.Key != "out.zip" || saveasResult.Hash != file.Hash || saveasResult.Fsize != int64(len(file.Data)) {
+			t.Fatalf("unexpected saveas result %s", w.Body.String())
+		}
+		if file.MimeType != "application/zip" {
+			t.Fatalf("unexpected mimetype %s", file.MimeType)
+		}
+	}
+}
+
+func TestUnzip(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unzip.Unzipper{}, map[string]interface{}{})
+
+	zipData := makeZip(t, map[string][]byte{
+		"a.txt":     []byte("hello"),
+		"dir/b.txt": []byte("world"),
+	})
+	src := env.src("test.zip", zipData, "application/zip")
+	w := env.do("unzip/bucket/"+encode(testBucket)+"/prefix/"+encode("out/"), src)
+	expectStatus(t, w, 200)
+
+	var unzipResult unzip.UnzipResult
+	json.Unmarshal(w.Body.Bytes(), &unzipResult)
+	if len(unzipResult.Files) != 2 {
+		t.Fatalf("unexpected unzip result %s", w.Body.String())
+	}
+	for _, unzipFile := range unzipResult.Files {
+		file, ok := env.fake.GetFile(testBucket, unzipFile.Key)
+		if !ok || unzipFile.Error != "" || unzipFile.Hash != file.Hash {
+			t.Fatalf("unexpected unzip file %v", unzipFile)
+		}
+	}
+	if file, _ := env.fake.GetFile(testBucket, "out/dir/b.txt"); string(file.Data) != "world" {
+		t.Fatalf("unexpected file content %s", string(file.Data))
+	}
+
+	//the existing files are kept without overwrite
+	zipData = makeZip(t, map[string][]byte{
+		"a.txt": []byte("changed"),
+	})
+	src = env.src("test2.zip", zipData, "application/zip")
+	w = env.do("unzip/bucket/"+encode(testBucket)+"/prefix/"+encode("out/"), src)
+	expectStatus(t, w, 200)
+	json.Unmarshal(w.Body.Bytes(), &unzipResult)
+	if unzipResult.Files[0].Error != "save unzip file to bucket error, file exists" {
+		t.Fatalf("unexpected unzip result %s", w.Body.String())
+	}
+
+	w = env.do("unzip/bucket/"+encode(testBucket)+"/prefix/"+encode("out/")+"/overwrite/1", src)
+	expectStatus(t, w, 200)
+	if file, _ := env.fake.GetFile(testBucket, "out/a.txt"); string(file.Data) != "changed" {
+		t.Fatalf("file not overwritten, %s", w.Body.String())
+	}
+}
+
+func TestUnzipResumablePut(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unzip.Unzipper{}, map[string]interface{}{})
+
+	//larger than the resumable put threshold, uploaded in blocks
+	largeData := bytes.Repeat([]byte("0123456789abcdef"), (unzip.RESUMABLE_PUT_THRESHOLD+utils.ETAG_BLOCK_SIZE/2)/16)
+	zipData := makeZip(t, map[string][]byte{
+		"large.bin": largeData,
+	})
+	src := env.src("large.zip", zipData, "application/zip")
+	w := env.do("unzip/bucket/"+encode(testBucket), src)
+	expectStatus(t, w, 200)
+
+	file, ok := env.fake.GetFile(testBucket, "large.bin")
+	if !ok || !bytes.Equal(file.Data, largeData) {
+		t.Fatalf("large file not saved, %s", w.Body.String())
+	}
+	expectHash, _ := utils.Etag(bytes.NewReader(largeData))
+	if file.Hash != expectHash || !strings.Contains(w.Body.String(), expectHash) {
+		t.Fatalf("unexpected hash %s, %s", file.Hash, w.Body.String())
+	}
+}
+
+func TestUnzipScratchQuota(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.ScratchQuota = 50 * 1024 * 1024
+	env.serv = ufop.NewServer(env.cfg)
+	env.register(&unzip.Unzipper{}, map[string]interface{}{})
+
+	//the items are cached one by one, only one of them takes the quota at a time
+	itemData := make([]byte, unzip.UNZIP_CACHE_FILE_ITEM_THRESHOLD+1024)
+	zipData := makeZip(t, map[string][]byte{"a.bin": itemData, "b.bin": itemData, "c.bin": itemData})
+	w := env.do("unzip/bucket/"+encode(testBucket), env.src("large.zip", zipData, "application/zip"))
+	expectStatus(t, w, 200)
+	for _, key := range []string{"a.bin", "b.bin", "c.bin"} {
+		if file, ok := env.fake.GetFile(testBucket, key); !ok || len(file.Data) != len(itemData) {
+			t.Fatalf("file %s not saved, %s", key, w.Body.String())
+		}
+	}
+}
+
+func TestUnzipLimits(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unzip.Unzipper{}, map[string]interface{}{
+		"unzip_max_zip_file_length": 1024,
+		"unzip_max_file_count":      1,
+		"unzip_max_file_length":     10,
+	})
+
+	cmd := "unzip/bucket/" + encode(testBucket)
+	w := env.do(cmd, env.src("a.txt", []byte("hello"), "text/plain"))
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported mimetype to unzip")
+
+	w = env.do(cmd, env.src("large.zip", make([]byte, 2048), "application/zip"))
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
+
+	zipData := makeZip(t, map[string][]byte{"a.txt": []byte("a"), "b.txt": []byte("b")})
+	w = env.do(cmd, env.src("count.zip", zipData, "application/zip"))
+	expectError(t, w, 400, ufop.ERROR_LIMIT_EXCEEDED, "zip files count exceeds the limit")
+
+	zipData = makeZip(t, map[string][]byte{"a.txt": []byte("more than ten bytes")})
+	w = env.do(cmd, env.src("length.zip", zipData, "application/zip"))
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "zip file length exceeds the limit")
+
+	w = env.do("unzip/bucket/"+encode(testBucket)+"/overwrite/2", env.src("b.zip", zipData, "application/zip"))
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid unzip parameter 'overwrite', should be 0 or 1")
+}
+
+func TestImagecomp(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&imagecomp.ImageComposer{}, map[string]interface{}{})
+
+	red := color.RGBA{0xFF, 0, 0, 0xFF}
+	blue := color.RGBA{0, 0, 0xFF, 0xFF}
+	urlA := env.fake.PutFile(testBucket, "red.png", makePng(t, 10, 10, red), "image/png")
+	urlB := env.fake.PutFile(testBucket, "blue.png", makePng(t, 10, 10, blue), "image/png")
+
+	cmd := "imagecomp/bucket/" + encode(testBucket) + "/format/png/rows/1/cols/2/url/" + encode(urlA) +
+		"/url/" + encode(urlB)
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 20 || img.Bounds().Dy() != 10 {
+		t.Fatalf("unexpected image size %v", img.Bounds())
+	}
+	if r, _, _, _ := img.At(5, 5).RGBA(); r != 0xFFFF {
+		t.Fatal("the left image should be red")
+	}
+	if _, _, b, _ := img.At(15, 5).RGBA(); b != 0xFFFF {
+		t.Fatal("the right image should be blue")
+	}
+
+	missingUrl := env.fake.Url(testBucket, "missing.png")
+	w = env.do("imagecomp/bucket/"+encode(testBucket)+"/url/"+encode(missingUrl), ufop.UfopRequestSrc{})
+	expectError(t, w, 404, ufop.ERROR_RESOURCE_NOT_FOUND,
+		"batch stat '"+missingUrl+"' error, no such file or directory")
+
+	w = env.do("imagecomp/bucket/"+encode(testBucket)+"/cols/3/url/"+encode(urlA)+"/url/"+encode(urlB), ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "cols larger than url count error")
+
+	textUrl := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	w = env.do("imagecomp/bucket/"+encode(testBucket)+"/url/"+encode(textUrl), ufop.UfopRequestSrc{})
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE,
+		"unsupported mimetype of '"+textUrl+"', 'text/plain'")
+}
+
+func TestAmerge(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&amerge.AudioMerger{}, map[string]interface{}{
+		"amerge_max_first_file_length":  1024,
+		"amerge_max_second_file_length": 1024,
+	})
+
+	secondUrl := env.fake.PutFile(testBucket, "second.mp3", []byte("second"), "audio/mpeg")
+	cmd := "amerge/format/mp3/mime/" + encode("audio/mpeg") + "/bucket/" + encode(testBucket) + "/url/"
+	first := env.src("first.mp3", []byte("first"), "audio/mpeg")
+
+	w := env.do(cmd+encode(secondUrl), env.src("first.txt", []byte("first"), "text/plain"))
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "first file mimetype not supported")
+
+	w = env.do(cmd+encode(env.fake.Url(testBucket, "missing.mp3")), first)
+	expectError(t, w, 404, ufop.ERROR_RESOURCE_NOT_FOUND, "second file not in the specified bucket")
+
+	textUrl := env.fake.PutFile(testBucket, "second.txt", []byte("second"), "text/plain")
+	w = env.do(cmd+encode(textUrl), first)
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "second file mimetype not supported")
+
+	largeUrl := env.fake.PutFile(testBucket, "large.mp3", make([]byte, 2048), "audio/mpeg")
+	w = env.do(cmd+encode(largeUrl), first)
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "second file length exceeds the limit")
+
+	w = env.do("amerge/format/mp3", first)
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid amerge command format, missing parameter 'mime'")
+}
+
+func TestHtml2image(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&html2image.Html2Imager{}, map[string]interface{}{
+		"html2image_max_page_size": 1024,
+	})
+
+	page := env.src("page.html", []byte("<html><body>hello</body></html>"), "text/html")
+	cmd := "html2image/url/" + encode(page.Url)
+	w := env.do("html2image/format/png", page)
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid html2image command format, missing parameter 'url'")
+
+	w = env.do(cmd+"/format/gif", page)
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid html2image parameter 'format', should be one of 'png|jpg|jpeg'")
+
+	w = env.do(cmd, env.src("a.png", []byte("png"), "image/png"))
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported file mime type, only text/* allowed")
+
+	w = env.do(cmd, env.src("large.html", make([]byte, 2048), "text/html"))
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "page file length exceeds the limit")
+
+	skipWithoutBinary(t, "wkhtmltoimage")
+	w = env.do(cmd+"/format/png", page)
+	expectStatus(t, w, 200)
+	if _, err := png.Decode(bytes.NewReader(w.Body.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtml2pdf(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&html2pdf.Html2Pdfer{}, map[string]interface{}{
+		"html2pdf_max_page_size": 1024,
+		"html2pdf_max_copies":    2,
+	})
+
+	page := env.src("page.html", []byte("<html><body>hello</body></html>"), "text/html")
+	cmd := "html2pdf/url/" + encode(page.Url)
+	w := env.do(cmd, env.src("a.png", []byte("png"), "image/png"))
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported file mime type, only text/* allowed")
+
+	w = env.do(cmd, env.src("large.html", make([]byte, 2048), "text/html"))
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "page file length exceeds the limit")
+
+	w = env.do(cmd+"/copies/3", page)
+	expectError(t, w, 400, ufop.ERROR_LIMIT_EXCEEDED, "pdf copies exceeds the limit")
+
+	skipWithoutBinary(t, "wkhtmltopdf")
+	w = env.do(cmd, page)
+	expectStatus(t, w, 200)
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF")) {
+		t.Fatal("result is not a pdf file")
+	}
+}
+
+func TestUnrar(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unrar.Unrarer{}, map[string]interface{}{
+		"unrar_max_rar_file_length": 1024,
+	})
+
+	cmd := "unrar/bucket/" + encode(testBucket)
+	w := env.do(cmd, env.src("a.zip", []byte("zip"), "application/zip"))
+	expectError(t, w, 415, ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported mimetype to unrar")
+
+	rar := env.src("a.part1.rar", []byte("rar"), "application/x-rar-compressed")
+	missingUrl := env.fake.Url(testBucket, "a.part2.rar")
+	w = env.do(cmd+"/volume/"+encode(missingUrl), rar)
+	expectError(t, w, 404, ufop.ERROR_RESOURCE_NOT_FOUND,
+		"batch stat '"+missingUrl+"' error, no such file or directory")
+
+	largeUrl := env.fake.PutFile(testBucket, "large.part2.rar", make([]byte, 2048), "application/x-rar-compressed")
+	w = env.do(cmd+"/volume/"+encode(largeUrl), rar)
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "src rar file length exceeds the limit")
+}
+
+//put a fake unrar in the path, listing the entries and running the extract
+//script with $out as the output dir
+func fakeUnrar(t *testing.T, entries map[string]int, extract string) {
+	binDir := t.TempDir()
+	var listing strings.Builder
+	for name, size := range entries {
+		fmt.Fprintf(&listing, "        Name: %s\n        Type: File\n        Size: %d\n\n", name, size)
+	}
+	script := "#!/bin/sh\nif [ \"$1\" = lt ]; then\ncat <<'EOF'\n" + listing.String() + "EOF\nexit 0\nfi\n" +
+		"for out; do :; done\n" + extract + "\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "unrar"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestUnrarUnsafeEntries(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&unrar.Unrarer{}, map[string]interface{}{
+		"unrar_max_file_length": 1024,
+	})
+	cmd := "unrar/bucket/" + encode(testBucket)
+	rar := env.src("a.rar", []byte("rar"), "application/x-rar-compressed")
+
+	fakeUnrar(t, map[string]int{"../../etc/passwd": 10}, "exit 1")
+	w := env.do(cmd, rar)
+	expectError(t, w, 500, ufop.ERROR_PROCESS_FAILED, "invalid rar entry name '../../etc/passwd'")
+
+	//the files behind the symbolic links are not uploaded
+	hostDir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(hostDir, "secret"), []byte("secret"), 0644)
+	fakeUnrar(t, map[string]int{"link/secret": 6}, "ln -s "+hostDir+" \"$out/link\"")
+	w = env.do(cmd, rar)
+	expectStatus(t, w, 200)
+	var unrarResult unrar.UnrarResult
+	json.Unmarshal(w.Body.Bytes(), &unrarResult)
+	if len(unrarResult.Files) != 1 || unrarResult.Files[0].Error != "file not extracted from the rar file" {
+		t.Fatalf("unexpected unrar result %s", w.Body.String())
+	}
+	if _, ok := env.fake.GetFile(testBucket, "link/secret"); ok {
+		t.Fatal("file outside the output dir uploaded")
+	}
+
+	//the output is limited to the listed length, whatever unrar writes
+	fakeUnrar(t, map[string]int{"a.txt": 5}, "exec head -c 1048576 /dev/zero > \"$out/a.txt\"")
+	w = env.do(cmd, rar)
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE, "rar file length exceeds the limit")
+	if _, ok := env.fake.GetFile(testBucket, "a.txt"); ok {
+		t.Fatal("oversized file uploaded")
+	}
+
+	fakeUnrar(t, map[string]int{"a.txt": 5}, "printf hello > \"$out/a.txt\"")
+	w = env.do(cmd, rar)
+	expectStatus(t, w, 200)
+	if file, _ := env.fake.GetFile(testBucket, "a.txt"); string(file.Data) != "hello" {
+		t.Fatalf("unexpected unrar result %s", w.Body.String())
+	}
+}
+
+func TestOssimg(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&ossimg.OSSImager{}, map[string]interface{}{
+		"mapping": map[string]interface{}{
+			"oss-bucket": map[string]string{
+				"src_domain": env.fake.Domain(testBucket),
+				"cdn_domain": env.fake.Domain(testBucket),
+			},
+		},
+	})
+
+	imgData := makePng(t, 10, 10, color.White)
+	imgUrl := env.fake.PutFile(testBucket, "a.png", imgData, "image/png")
+	//the image url is in the request logs, hidden if redacted
+	env.cfg.LogRedactParams = []string{"src"}
+	buffer := captureLogs(t)
+	w := env.do("ossimg/oss-bucket@a.png@100w_50h_1e", ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+	if strings.Contains(buffer.String(), imgUrl) {
+		t.Fatalf("image url in the logs %s", buffer.String())
+	}
+	if lines := parseLogs(t, buffer); len(lines) != 3 || lines[1].Msg != "get image info, <redacted>" {
+		t.Fatalf("unexpected log lines %+v", lines)
+	}
+	//the fops are done by the source domain, the fake appends the fop to the source file
+	if !bytes.Equal(w.Body.Bytes(), append(imgData, "?imageMogr2/thumbnail/!100x50r"...)) {
+		t.Fatal("unexpected image data")
+	}
+	downloads := env.fake.Downloads(testBucket)
+	if len(downloads) != 2 || downloads[0] != "/a.png?imageInfo" || downloads[1] != "/a.png?imageMogr2/thumbnail/!100x50r" {
+		t.Fatalf("unexpected downloads %v", downloads)
+	}
+
+	w = env.do("ossimg/no-bucket@a.png@100w", ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND, "invalid bucket specified")
+}
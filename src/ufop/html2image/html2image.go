@@ -1,18 +1,12 @@
 package html2image
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/log"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
-	"time"
 	"ufop"
 	"ufop/utils"
 )
@@ -45,16 +39,19 @@ func (this *Html2Imager) Name() string {
 	return "html2image"
 }
 
-func (this *Html2Imager) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open html2image config failed, %s", openErr.Error()))
-		return
+func (this *Html2Imager) RequiredBinaries() []string {
+	return []string{"wkhtmltoimage"}
+}
+
+func (this *Html2Imager) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"html2image_max_page_size": this.maxPageSize,
 	}
+}
 
+func (this *Html2Imager) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := Html2ImagerConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse html2image config failed, %s", decodeErr.Error()))
 		return
@@ -69,132 +66,47 @@ func (this *Html2Imager) InitConfig(jobConf string) (err error) {
 	return
 }
 
+var html2imageParser = utils.NewCommandParser("html2image",
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "croph", Type: utils.PARAM_TYPE_INT, Min: 1},
+	utils.ParamSpec{Name: "cropw", Type: utils.PARAM_TYPE_INT, Min: 1},
+	utils.ParamSpec{Name: "cropx", Type: utils.PARAM_TYPE_INT},
+	utils.ParamSpec{Name: "cropy", Type: utils.PARAM_TYPE_INT},
+	utils.ParamSpec{Name: "format", Type: utils.PARAM_TYPE_ENUM, Default: "jpg", Values: []string{"png", "jpg", "jpeg"}},
+	utils.ParamSpec{Name: "height", Type: utils.PARAM_TYPE_INT, Min: 1},
+	utils.ParamSpec{Name: "width", Type: utils.PARAM_TYPE_INT, Min: 1},
+	utils.ParamSpec{Name: "quality", Type: utils.PARAM_TYPE_INT, Min: 1, Max: 100},
+	utils.ParamSpec{Name: "force", Type: utils.PARAM_TYPE_BOOL, Default: false},
+)
+
 func (this *Html2Imager) parse(cmd string) (url string, options *Html2ImageOptions, err error) {
-	pattern := `^html2image/url/[0-9a-zA-Z-_=]+(/croph/\d+|/cropw/\d+|/cropx/\d+|/cropy/\d+|/format/(png|jpg|jpeg)|/height/\d+|/quality/\d+|/width/\d+|/force/[0|1]){0,9}$`
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid html2image command format")
+	params, pErr := html2imageParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
 
+	url = params.String("url")
 	options = &Html2ImageOptions{
-		Format: "jpg",
-	}
-
-	//url
-	var decodeErr error
-	url, decodeErr = utils.GetParamDecoded(cmd, `url/[0-9a-zA-Z-_=]+`, "url")
-	if decodeErr != nil {
-		err = errors.New("invalid html2image parameter 'url'")
-		return
-	}
-
-	//croph
-	cropHStr := utils.GetParam(cmd, `croph/\d+`, "croph")
-	if cropHStr != "" {
-		cropH, _ := strconv.Atoi(cropHStr)
-		if cropH <= 0 {
-			err = errors.New("invalid html2image parameter 'croph'")
-			return
-		} else {
-			options.CropH = cropH
-		}
+		CropH:   params.Int("croph"),
+		CropW:   params.Int("cropw"),
+		CropX:   params.Int("cropx"),
+		CropY:   params.Int("cropy"),
+		Format:  params.String("format"),
+		Height:  params.Int("height"),
+		Width:   params.Int("width"),
+		Quality: params.Int("quality"),
+		Force:   params.Bool("force"),
 	}
-
-	//cropw
-	cropWStr := utils.GetParam(cmd, `cropw/\d+`, "cropw")
-	if cropWStr != "" {
-		cropW, _ := strconv.Atoi(cropWStr)
-		if cropW <= 0 {
-			err = errors.New("invalid html2image parameter 'cropw'")
-			return
-		} else {
-			options.CropW = cropW
-		}
-	}
-
-	//cropx
-	cropXStr := utils.GetParam(cmd, `cropx/\d+`, "cropx")
-	fmt.Println(cropXStr)
-	if cropXStr != "" {
-		cropX, _ := strconv.Atoi(cropXStr)
-		if cropX <= 0 {
-			err = errors.New("invalid html2image parameter 'cropx'")
-			return
-		} else {
-			options.CropX = cropX
-		}
-	}
-
-	//cropy
-	cropYStr := utils.GetParam(cmd, `cropy/\d+`, "cropy")
-	if cropYStr != "" {
-		cropY, _ := strconv.Atoi(cropYStr)
-		if cropY <= 0 {
-			err = errors.New("invalid html2image parameter 'cropy'")
-			return
-		} else {
-			options.CropY = cropY
-		}
-	}
-
-	//format
-	formatStr := utils.GetParam(cmd, "format/(png|jpg|jpeg)", "format")
-	if formatStr != "" {
-		options.Format = formatStr
-	}
-
-	//height
-	heightStr := utils.GetParam(cmd, `height/\d+`, "height")
-	if heightStr != "" {
-		height, _ := strconv.Atoi(heightStr)
-		if height <= 0 {
-			err = errors.New("invalid html2image parameter 'height'")
-			return
-		} else {
-			options.Height = height
-		}
-	}
-
-	//width
-	widthStr := utils.GetParam(cmd, `width/\d+`, "width")
-	if widthStr != "" {
-		width, _ := strconv.Atoi(widthStr)
-		if width <= 0 {
-			err = errors.New("invalid html2image parameter 'width'")
-			return
-		} else {
-			options.Width = width
-		}
-	}
-
-	//quality
-	qualityStr := utils.GetParam(cmd, `quality/\d+`, "quality")
-	if qualityStr != "" {
-		quality, _ := strconv.Atoi(qualityStr)
-		if quality > 100 || quality <= 0 {
-			err = errors.New("invalid html2image parameter 'quality'")
-			return
-		} else {
-			options.Quality = quality
-		}
-	}
-
-	//force
-	forceStr := utils.GetParam(cmd, "force/[0|1]", "force")
-	if forceStr != "" {
-		force, _ := strconv.Atoi(forceStr)
-		if force == 1 {
-			options.Force = true
-		}
-	}
-
 	return
+}
 
+func (this *Html2Imager) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
 }
 
-func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
-	reqId := req.ReqId
+func (this *Html2Imager) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	logger := req.Logger()
 	remoteSrcUrl, options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -203,13 +115,24 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 
 	//if not text format, error it
 	if !strings.HasPrefix(req.Src.MimeType, "text/") {
-		err = errors.New("unsupported file mime type, only text/* allowed")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported file mime type, only text/* allowed")
 		return
 	}
 
 	//if file size exceeds, error it
 	if req.Src.Fsize > this.maxPageSize {
-		err = errors.New("page file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "page file length exceeds the limit")
+		return
+	}
+
+	//the page is fetched by the converter itself, check the url and the
+	//addresses of its host before, for a clear error of the page url
+	if cErr := utils.DefaultFetcher().CheckURLAddrs(ctx, remoteSrcUrl); cErr != nil {
+		if _, ok := cErr.(*utils.URLPolicyError); ok {
+			err = ufop.NewUfopError(ufop.ERROR_URL_FORBIDDEN, cErr.Error())
+		} else {
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, cErr.Error())
+		}
 		return
 	}
 
@@ -218,6 +141,18 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 	//prepare command
 	cmdParams := make([]string, 0)
 	cmdParams = append(cmdParams, "-q")
+	//the page can not read the local files
+	cmdParams = append(cmdParams, "--disable-local-file-access")
+
+	//the page, its redirects and sub resources are fetched through the proxy,
+	//which checks them by the url policy when requested and connected
+	proxy, proxyErr := utils.DefaultFetcher().StartProxy(ctx)
+	if proxyErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, proxyErr.Error())
+		return
+	}
+	defer proxy.Close()
+	cmdParams = append(cmdParams, "--proxy", proxy.URL())
 
 	if options.CropH > 0 {
 		cmdParams = append(cmdParams, "--crop-h", fmt.Sprintf("%d", options.CropH))
@@ -255,59 +190,73 @@ func (this *Html2Imager) Do(req ufop.UfopRequest) (result interface{}, resultTyp
 		cmdParams = append(cmdParams, "--disable-smart-width")
 	}
 
-	//result tmp file
-	resultTmpFname := fmt.Sprintf("%s%d.result.%s", jobPrefix, time.Now().UnixNano(), options.Format)
-	resultTmpFpath := filepath.Join(os.TempDir(), resultTmpFname)
+	//result tmp file in the scratch dir, removed with it
+	scratch := req.Scratch()
+	resultTmpFpath, tErr := scratch.TempPath(fmt.Sprintf("%s*.result.%s", jobPrefix, options.Format))
+	if tErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create result temp file failed, %s", tErr.Error()))
+		return
+	}
 
 	cmdParams = append(cmdParams, remoteSrcUrl, resultTmpFpath)
 
 	//cmd
-	convertCmd := exec.Command("wkhtmltoimage", cmdParams...)
-	log.Info(reqId, convertCmd.Path, convertCmd.Args)
+	convertCmd := scratch.CommandContext(ctx, "wkhtmltoimage", cmdParams...)
+	//the page url is hidden if redacted
+	logArgs := append([]string{}, convertCmd.Args...)
+	logArgs[len(logArgs)-2] = logger.Redact("url", remoteSrcUrl)
+	logger.Infof("run %v", logArgs)
 
 	stdErrPipe, pipeErr := convertCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
 
 	if startErr := convertCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start html2image command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("start html2image command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read html2image command stderr error, %s", readErr.Error()))
-		defer os.Remove(resultTmpFpath)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("read html2image command stderr error, %s", readErr.Error()))
 		return
 	}
 
 	//check stderr output & output file
 	if string(stdErrData) != "" {
-		log.Info(reqId, string(stdErrData))
+		logger.Infof("wkhtmltoimage stderr, %s", stdErrData)
 	}
 
-	if waitErr := convertCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait html2image to exit error, %s", waitErr.Error()))
-		defer os.Remove(resultTmpFpath)
+	waitErr := convertCmd.Wait()
+	if rejected := proxy.Rejected(); rejected != nil {
+		err = ufop.NewUfopError(ufop.ERROR_URL_FORBIDDEN, rejected.Error())
+		return
+	}
+	if waitErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("wait html2image to exit error, %s", waitErr.Error()))
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(resultTmpFpath); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("html2image with no valid output result")
-		defer os.Remove(resultTmpFpath)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, "html2image with no valid output result")
+		return
+	}
+	if uErr := scratch.UpdateUsage(); uErr != nil {
+		err = uErr
 		return
 	}
 
 	//write result
-	result = resultTmpFpath
-	resultType = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Type = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Body = resultTmpFpath
 	if options.Format == "png" {
-		contentType = "image/png"
+		result.MimeType = "image/png"
 	} else {
-		contentType = "image/jpeg"
+		result.MimeType = "image/jpeg"
 	}
+	result.Filename = fmt.Sprintf("html2image.%s", options.Format)
 
 	return
 }
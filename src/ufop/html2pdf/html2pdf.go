@@ -1,18 +1,12 @@
 package html2pdf
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/log"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
-	"time"
 	"ufop"
 	"ufop/utils"
 )
@@ -46,16 +40,20 @@ func (this *Html2Pdfer) Name() string {
 	return "html2pdf"
 }
 
-func (this *Html2Pdfer) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open html2pdf config failed, %s", openErr.Error()))
-		return
+func (this *Html2Pdfer) RequiredBinaries() []string {
+	return []string{"wkhtmltopdf"}
+}
+
+func (this *Html2Pdfer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"html2pdf_max_page_size": this.maxPageSize,
+		"html2pdf_max_copies":    this.maxCopies,
 	}
+}
 
+func (this *Html2Pdfer) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := Html2PdferConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse html2pdf config failed, %s", decodeErr.Error()))
 		return
@@ -76,87 +74,43 @@ func (this *Html2Pdfer) InitConfig(jobConf string) (err error) {
 	return
 }
 
-func (this *Html2Pdfer) parse(cmd string) (url string, options *Html2PdfOptions, err error) {
-	pattern := `^html2pdf/url/[0-9a-zA-Z-_=]+(/gray/[0|1]|/low/[0|1]|/orient/(Portrait|Landscape)|/size/[A-B][0-8]|/title/[0-9a-zA-Z-_=]+|/collate/[0|1]|/copies/\d+){0,7}$`
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid html2pdf command format")
-		return
-	}
-
-	var decodeErr error
+var html2pdfParser = utils.NewCommandParser("html2pdf",
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "gray", Type: utils.PARAM_TYPE_BOOL, Default: false},
+	utils.ParamSpec{Name: "low", Type: utils.PARAM_TYPE_BOOL, Default: false},
+	utils.ParamSpec{Name: "orient", Type: utils.PARAM_TYPE_ENUM, Values: []string{"Portrait", "Landscape"}},
+	utils.ParamSpec{Name: "size", Type: utils.PARAM_TYPE_STRING, Pattern: "^[A-B][0-8]$"},
+	utils.ParamSpec{Name: "title", Type: utils.PARAM_TYPE_BASE64},
+	utils.ParamSpec{Name: "collate", Type: utils.PARAM_TYPE_BOOL, Default: true},
+	utils.ParamSpec{Name: "copies", Type: utils.PARAM_TYPE_INT, Default: 1, Min: 1},
+)
 
-	//url
-	url, decodeErr = utils.GetParamDecoded(cmd, `url/[0-9a-zA-Z-_=]+`, "url")
-	if decodeErr != nil {
-		err = errors.New("invalid html2pdf parameter 'url'")
+func (this *Html2Pdfer) parse(cmd string) (url string, options *Html2PdfOptions, err error) {
+	params, pErr := html2pdfParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
 
-	//get optional parameters
+	url = params.String("url")
 	options = &Html2PdfOptions{
-		Collate: true,
-		Copies:  1,
-	}
-
-	//get gray
-	grayStr := utils.GetParam(cmd, "gray/[0|1]", "gray")
-	if grayStr != "" {
-		grayInt, _ := strconv.Atoi(grayStr)
-		if grayInt == 1 {
-			options.Gray = true
-		}
-	}
-
-	//get low quality
-	lowStr := utils.GetParam(cmd, "low/[0|1]", "low")
-	if lowStr != "" {
-		lowInt, _ := strconv.Atoi(lowStr)
-		if lowInt == 1 {
-			options.LowQuality = true
-		}
-	}
-
-	//orient
-	options.Orientation = utils.GetParam(cmd, "orient/(Portrait|Landscape)", "orient")
-
-	//size
-	options.Size = utils.GetParam(cmd, "size/[A-B][0-8]", "size")
-
-	//title
-	title, decodeErr := utils.GetParamDecoded(cmd, "title/[0-9a-zA-Z-_=]+", "title")
-	if decodeErr != nil {
-		err = errors.New("invalid html2pdf parameter 'title'")
-		return
-	}
-	options.Title = title
-
-	//collate
-	collateStr := utils.GetParam(cmd, "collate/[0|1]", "collate")
-	if collateStr != "" {
-		collateInt, _ := strconv.Atoi(collateStr)
-		if collateInt == 0 {
-			options.Collate = false
-		}
-	}
-
-	//copies
-	copiesStr := utils.GetParam(cmd, `copies/\d+`, "copies")
-	if copiesStr != "" {
-		copiesInt, _ := strconv.Atoi(copiesStr)
-		if copiesInt <= 0 {
-			err = errors.New("invalid html2pdf parameter 'copies'")
-			return
-		} else {
-			options.Copies = copiesInt
-		}
+		Gray:        params.Bool("gray"),
+		LowQuality:  params.Bool("low"),
+		Orientation: params.String("orient"),
+		Size:        params.String("size"),
+		Title:       params.String("title"),
+		Collate:     params.Bool("collate"),
+		Copies:      params.Int("copies"),
 	}
-
 	return
 }
 
-func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
-	reqId := req.ReqId
+func (this *Html2Pdfer) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *Html2Pdfer) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	logger := req.Logger()
 	remoteSrcUrl, options, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -165,18 +119,29 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	//if not text format, error it
 	if !strings.HasPrefix(req.Src.MimeType, "text/") {
-		err = errors.New("unsupported file mime type, only text/* allowed")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported file mime type, only text/* allowed")
 		return
 	}
 
 	//if file size exceeds, error it
 	if req.Src.Fsize > this.maxPageSize {
-		err = errors.New("page file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "page file length exceeds the limit")
 		return
 	}
 
 	if options.Copies > this.maxCopies {
-		err = errors.New("pdf copies exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, "pdf copies exceeds the limit")
+		return
+	}
+
+	//the page is fetched by the converter itself, check the url and the
+	//addresses of its host before, for a clear error of the page url
+	if cErr := utils.DefaultFetcher().CheckURLAddrs(ctx, remoteSrcUrl); cErr != nil {
+		if _, ok := cErr.(*utils.URLPolicyError); ok {
+			err = ufop.NewUfopError(ufop.ERROR_URL_FORBIDDEN, cErr.Error())
+		} else {
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, cErr.Error())
+		}
 		return
 	}
 
@@ -185,6 +150,18 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//prepare command
 	cmdParams := make([]string, 0)
 	cmdParams = append(cmdParams, "-q")
+	//the page can not read the local files
+	cmdParams = append(cmdParams, "--disable-local-file-access")
+
+	//the page, its redirects and sub resources are fetched through the proxy,
+	//which checks them by the url policy when requested and connected
+	proxy, proxyErr := utils.DefaultFetcher().StartProxy(ctx)
+	if proxyErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, proxyErr.Error())
+		return
+	}
+	defer proxy.Close()
+	cmdParams = append(cmdParams, "--proxy", proxy.URL())
 
 	if options.Gray {
 		cmdParams = append(cmdParams, "--grayscale")
@@ -214,54 +191,68 @@ func (this *Html2Pdfer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	cmdParams = append(cmdParams, "--copies", fmt.Sprintf("%d", options.Copies))
 
-	//result tmp file
-	resultTmpFname := fmt.Sprintf("%s%d.result.pdf", jobPrefix, time.Now().UnixNano())
-	resultTmpFpath := filepath.Join(os.TempDir(), resultTmpFname)
+	//result tmp file in the scratch dir, removed with it
+	scratch := req.Scratch()
+	resultTmpFpath, tErr := scratch.TempPath(fmt.Sprintf("%s*.result.pdf", jobPrefix))
+	if tErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create result temp file failed, %s", tErr.Error()))
+		return
+	}
 
 	cmdParams = append(cmdParams, remoteSrcUrl, resultTmpFpath)
 
 	//cmd
-	convertCmd := exec.Command("wkhtmltopdf", cmdParams...)
-	log.Info(reqId, convertCmd.Path, convertCmd.Args)
+	convertCmd := scratch.CommandContext(ctx, "wkhtmltopdf", cmdParams...)
+	//the page url is hidden if redacted
+	logArgs := append([]string{}, convertCmd.Args...)
+	logArgs[len(logArgs)-2] = logger.Redact("url", remoteSrcUrl)
+	logger.Infof("run %v", logArgs)
 
 	stdErrPipe, pipeErr := convertCmd.StderrPipe()
 	if pipeErr != nil {
-		err = errors.New(fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open exec stderr pipe error, %s", pipeErr.Error()))
 		return
 	}
 
 	if startErr := convertCmd.Start(); startErr != nil {
-		err = errors.New(fmt.Sprintf("start html2pdf command error, %s", startErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("start html2pdf command error, %s", startErr.Error()))
 		return
 	}
 
 	stdErrData, readErr := ioutil.ReadAll(stdErrPipe)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read html2pdf command stderr error, %s", readErr.Error()))
-		defer os.Remove(resultTmpFpath)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("read html2pdf command stderr error, %s", readErr.Error()))
 		return
 	}
 
 	//check stderr output & output file
 	if string(stdErrData) != "" {
-		log.Info(reqId, string(stdErrData))
+		logger.Infof("wkhtmltopdf stderr, %s", stdErrData)
 	}
 
-	if waitErr := convertCmd.Wait(); waitErr != nil {
-		err = errors.New(fmt.Sprintf("wait html2pdf to exit error, %s", waitErr.Error()))
-		defer os.Remove(resultTmpFpath)
+	waitErr := convertCmd.Wait()
+	if rejected := proxy.Rejected(); rejected != nil {
+		err = ufop.NewUfopError(ufop.ERROR_URL_FORBIDDEN, rejected.Error())
+		return
+	}
+	if waitErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("wait html2pdf to exit error, %s", waitErr.Error()))
 		return
 	}
 
 	if oFileInfo, statErr := os.Stat(resultTmpFpath); statErr != nil || oFileInfo.Size() == 0 {
-		err = errors.New("html2pdf with no valid output result")
-		defer os.Remove(resultTmpFpath)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, "html2pdf with no valid output result")
+		return
+	}
+	if uErr := scratch.UpdateUsage(); uErr != nil {
+		err = uErr
 		return
 	}
 
 	//write result
-	result = resultTmpFpath
-	resultType = ufop.RESULT_TYPE_OCTECT_FILE
-	contentType = "application/pdf"
+	result.Type = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Body = resultTmpFpath
+	result.MimeType = "application/pdf"
+	result.Filename = "html2pdf.pdf"
 	return
 }
@@ -2,13 +2,9 @@ package imagecomp
 
 import (
 	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/rs"
-	"github.com/qiniu/rpc"
 	"image"
 	"image/color"
 	"image/draw"
@@ -16,10 +12,8 @@ import (
 	"image/png"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
-	"time"
 	"ufop"
 	"ufop/utils"
 )
@@ -41,35 +35,38 @@ const (
 )
 
 type ImageComposer struct {
-	mac *digest.Mac
+	storage ufop.UfopStorage
 }
 
 type ImageComposerConfig struct {
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
+	//ak & sk
+	ufop.UfopCredentials
 }
 
 func (this *ImageComposer) Name() string {
 	return "imagecomp"
 }
 
-func (this *ImageComposer) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open imagecomp config failed, %s", openErr.Error()))
-		return
+func (this *ImageComposer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"imagecomp_max_url_count": IMAGECOMP_MAX_URL_COUNT,
 	}
+}
 
+func (this *ImageComposer) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := ImageComposerConfig{}
 
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse imagecomp config failed, %s", decodeErr.Error()))
 		return
 	}
 
-	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	if credErr := config.LoadCredentials(); credErr != nil {
+		err = errors.New(fmt.Sprintf("Load imagecomp credentials failed, %s", credErr.Error()))
+		return
+	}
+	this.storage = storage.WithCredentials(config.AccessKey, config.SecretKey)
 	return
 }
 
@@ -90,61 +87,48 @@ imagecomp
 /url/<string>
 
 */
-func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign string,
-	rows, cols, order int, bgColor color.Color, margin int, urls []map[string]string, err error) {
-	pattern := `^imagecomp/bucket/[0-9a-zA-Z-_=]+(/format/(png|jpg|jpeg)|/halign/(left|right|center)|/valign/(top|bottom|middle)|/rows/\d+|/cols/\d+|/order/(0|1)|/alpha/\d+|/margin/\d+|/bgcolor/[0-9a-zA-Z-_=]+){0,9}(/url/[0-9a-zA-Z-_=]+)+$`
+var imagecompParser = utils.NewCommandParser("imagecomp",
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "format", Type: utils.PARAM_TYPE_ENUM, Default: "jpg", Values: []string{"png", "jpg", "jpeg"}},
+	utils.ParamSpec{Name: "rows", Type: utils.PARAM_TYPE_INT, Default: 0},
+	utils.ParamSpec{Name: "cols", Type: utils.PARAM_TYPE_INT, Default: 0},
+	utils.ParamSpec{Name: "halign", Type: utils.PARAM_TYPE_ENUM, Default: H_ALIGN_LEFT,
+		Values: []string{H_ALIGN_LEFT, H_ALIGN_RIGHT, H_ALIGN_CENTER}},
+	utils.ParamSpec{Name: "valign", Type: utils.PARAM_TYPE_ENUM, Default: V_ALIGN_TOP,
+		Values: []string{V_ALIGN_TOP, V_ALIGN_BOTTOM, V_ALIGN_MIDDLE}},
+	utils.ParamSpec{Name: "order", Type: utils.PARAM_TYPE_INT, Default: IMAGECOMP_ORDER_BY_COL, Max: 1},
+	utils.ParamSpec{Name: "alpha", Type: utils.PARAM_TYPE_INT, Max: 255},
+	utils.ParamSpec{Name: "bgcolor", Type: utils.PARAM_TYPE_BASE64},
+	utils.ParamSpec{Name: "margin", Type: utils.PARAM_TYPE_INT, Default: 0},
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Required: true, Repeatable: true},
+)
 
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid imagecomp command format")
-		return
+//the images are read from the bucket
+func (this *ImageComposer) Buckets(cmd string) (read []string, write []string, err error) {
+	bucket, _, _, _, _, _, _, _, _, _, err := this.parse(cmd)
+	if err == nil {
+		read = []string{bucket}
 	}
+	return
+}
 
-	var decodeErr error
-
-	//bucket
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid imagecomp parameter 'bucket'")
+func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign string,
+	rows, cols, order int, bgColor color.Color, margin int, urls []map[string]string, err error) {
+	params, pErr := imagecompParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
 
-	//format
-	format = "jpg"
-	if v := utils.GetParam(cmd, "format/(png|jpg|jpeg)", "format"); v != "" {
-		format = v
-	}
-
+	bucket = params.String("bucket")
+	format = params.String("format")
 	//check later by url count
-	//rows
-	rows = 0
-	if rowsStr := utils.GetParam(cmd, `rows/\d+`, "rows"); rowsStr != "" {
-		rows, _ = strconv.Atoi(rowsStr)
-	}
-
-	//cols
-	cols = 0
-	if colsStr := utils.GetParam(cmd, `cols/\d+`, "cols"); colsStr != "" {
-		cols, _ = strconv.Atoi(colsStr)
-	}
-
-	//halign
-	halign = H_ALIGN_LEFT
-	if v := utils.GetParam(cmd, "halign/(left|right|center)", "halign"); v != "" {
-		halign = v
-	}
-
-	//valign
-	valign = V_ALIGN_TOP
-	if v := utils.GetParam(cmd, "valign/(top|bottom|middle)", "valign"); v != "" {
-		valign = v
-	}
-
-	//order
-	order = IMAGECOMP_ORDER_BY_COL
-	if orderStr := utils.GetParam(cmd, "order/(0|1)", "order"); orderStr != "" {
-		order, _ = strconv.Atoi(orderStr)
-	}
+	rows = params.Int("rows")
+	cols = params.Int("cols")
+	halign = params.String("halign")
+	valign = params.String("valign")
+	order = params.Int("order")
+	margin = params.Int("margin")
 
 	//alpha
 	alpha := 255
@@ -153,66 +137,44 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		alpha = 0
 	}
 
-	if alphaStr := utils.GetParam(cmd, `alpha/\d+`, "alpha"); alphaStr != "" {
-		alpha, _ = strconv.Atoi(alphaStr)
-	}
-
-	if alpha < 0 || alpha > 255 {
-		err = errors.New("invalid imagecomp parameter 'alhpa', should between [0,255]")
-		return
+	if params.Has("alpha") {
+		alpha = params.Int("alpha")
 	}
 
 	//bgcolor, default white
 	bgColor = color.RGBA{0xFF, 0xFF, 0xFF, uint8(alpha)}
 
-	var bgColorStr string
-	bgColorStr, decodeErr = utils.GetParamDecoded(cmd, "bgcolor/[0-9a-zA-Z-_=]+", "bgcolor")
-	if decodeErr != nil {
-		err = errors.New("invalid imagecomp parameter 'bgcolor'")
-		return
-	} else {
-		if bgColorStr != "" {
-			colorPattern := `^#[a-fA-F0-9]{6}$`
-			if matched, _ := regexp.Match(colorPattern, []byte(bgColorStr)); !matched {
-				err = errors.New("invalid imagecomp parameter 'bgcolor', should in format '#FFFFFF'")
-				return
-			}
+	if bgColorStr := params.String("bgcolor"); bgColorStr != "" {
+		colorPattern := `^#[a-fA-F0-9]{6}$`
+		if matched, _ := regexp.Match(colorPattern, []byte(bgColorStr)); !matched {
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "invalid imagecomp parameter 'bgcolor', should in format '#FFFFFF'")
+			return
+		}
 
-			bgColorStr = bgColorStr[1:]
+		bgColorStr = bgColorStr[1:]
 
-			redPart := bgColorStr[0:2]
-			greenPart := bgColorStr[2:4]
-			bluePart := bgColorStr[4:6]
+		redPart := bgColorStr[0:2]
+		greenPart := bgColorStr[2:4]
+		bluePart := bgColorStr[4:6]
 
-			redInt, _ := strconv.ParseInt(redPart, 16, 64)
-			greenInt, _ := strconv.ParseInt(greenPart, 16, 64)
-			blueInt, _ := strconv.ParseInt(bluePart, 16, 64)
+		redInt, _ := strconv.ParseInt(redPart, 16, 64)
+		greenInt, _ := strconv.ParseInt(greenPart, 16, 64)
+		blueInt, _ := strconv.ParseInt(bluePart, 16, 64)
 
-			bgColor = color.RGBA{
-				uint8(redInt),
-				uint8(greenInt),
-				uint8(blueInt),
-				uint8(alpha),
-			}
+		bgColor = color.RGBA{
+			uint8(redInt),
+			uint8(greenInt),
+			uint8(blueInt),
+			uint8(alpha),
 		}
 	}
 
-	//margin
-	margin = 0
-	if marginStr := utils.GetParam(cmd, `margin/\d+`, "margin"); marginStr != "" {
-		margin, _ = strconv.Atoi(marginStr)
-	}
-
 	//urls
 	urls = make([]map[string]string, 0)
-	urlsPattern := regexp.MustCompile("url/[0-9a-zA-Z-_=]+")
-	urlStrings := urlsPattern.FindAllString(cmd, -1)
-	for _, urlString := range urlStrings {
-		urlBytes, _ := base64.URLEncoding.DecodeString(urlString[4:])
-		urlStr := string(urlBytes)
+	for _, urlStr := range params.Strings("url") {
 		uri, pErr := url.Parse(urlStr)
-		if pErr != nil {
-			err = errors.New(fmt.Sprintf("invalid imagecomp parameter 'url', wrong '%s'", urlStr))
+		if pErr != nil || uri.Path == "" {
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, fmt.Sprintf("invalid imagecomp parameter 'url', wrong '%s'", urlStr))
 			return
 		}
 
@@ -226,7 +188,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 	urlCount := len(urls)
 
 	if urlCount > IMAGECOMP_MAX_URL_COUNT {
-		err = errors.New(fmt.Sprintf("only allow url count not larger than %d", IMAGECOMP_MAX_URL_COUNT))
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, fmt.Sprintf("only allow url count not larger than %d", IMAGECOMP_MAX_URL_COUNT))
 		return
 	}
 
@@ -235,7 +197,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		rows = urlCount / cols
 	} else if rows == 0 && cols != 0 {
 		if cols > urlCount {
-			err = errors.New("cols larger than url count error")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "cols larger than url count error")
 			return
 		}
 		if urlCount%cols == 0 {
@@ -245,7 +207,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		}
 	} else if rows != 0 && cols == 0 {
 		if rows > urlCount {
-			err = errors.New("rows larger than url count error")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "rows larger than url count error")
 			return
 		}
 		if urlCount%rows == 0 {
@@ -255,7 +217,7 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 		}
 	} else {
 		if urlCount > rows*cols {
-			err = errors.New("url count larger than rows*cols error")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "url count larger than rows*cols error")
 			return
 		}
 
@@ -263,12 +225,12 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 			switch order {
 			case IMAGECOMP_ORDER_BY_ROW:
 				if urlCount < (rows-1)*cols+1 {
-					err = errors.New("url count less than (rows-1)*cols+1 error")
+					err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "url count less than (rows-1)*cols+1 error")
 					return
 				}
 			case IMAGECOMP_ORDER_BY_COL:
 				if urlCount < rows*(cols-1)+1 {
-					err = errors.New("url count less than rows*(cols-1)+1 error")
+					err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "url count less than rows*(cols-1)+1 error")
 					return
 				}
 			}
@@ -278,7 +240,11 @@ func (this *ImageComposer) parse(cmd string) (bucket, format, halign, valign str
 	return
 }
 
-func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *ImageComposer) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *ImageComposer) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
 	bucket, format, halign, valign, rows, cols, order, bgColor, margin, urls, pErr := this.parse(req.Cmd)
 	if pErr != nil {
 		err = pErr
@@ -292,64 +258,61 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 	}
 
 	//check urls validity, all should in bucket
-	statItems := make([]rs.EntryPath, 0)
+	statItems := make([]ufop.UfopEntryPath, 0)
 	statUrls := make([]string, 0)
 	for _, urlItem := range urls {
 		iPath := urlItem["path"]
 		iUrl := urlItem["url"]
-		entryPath := rs.EntryPath{
-			bucket, iPath,
+		entryPath := ufop.UfopEntryPath{
+			Bucket: bucket,
+			Key:    iPath,
 		}
 		statItems = append(statItems, entryPath)
 		statUrls = append(statUrls, iUrl)
 	}
 
-	qclient := rs.New(this.mac)
-
-	statRet, statErr := qclient.BatchStat(nil, statItems)
-
+	statRet, statErr := this.storage.BatchStat(ctx, statItems)
 	if statErr != nil {
-		if sErr, ok := statErr.(*rpc.ErrorInfo); !ok {
-			err = errors.New(fmt.Sprintf("batch stat error, %s", statErr.Error()))
-			return
-		} else {
-			if sErr.Err != "" {
-				err = errors.New(fmt.Sprintf("batch stat error, %s", sErr.Err))
-				return
-			}
-		}
+		err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat error, %s", statErr.Error()))
+		return
 	}
 
 	for index := 0; index < len(statRet); index++ {
 		ret := statRet[index]
-		if ret.Code != 200 {
-			if ret.Code == 612 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
-			} else if ret.Code == 631 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
+		if ret.Code != ufop.STORAGE_CODE_OK {
+			if ret.Code == ufop.STORAGE_CODE_NO_SUCH_FILE {
+				err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
+			} else if ret.Code == ufop.STORAGE_CODE_NO_SUCH_BUCKET {
+				err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
 			} else {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
+				err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
 			}
 			return
 		}
 	}
 
-	//download images by url
+	//download images by url into the scratch dir, removed with it
 	localImgPathTypeMap := make(map[string]string)
 	localImgPaths := make([]string, 0)
 	remoteImgUrls := make(map[string]string)
-	for _, urlItem := range urls {
+	for index, urlItem := range urls {
 		iUrl := urlItem["url"]
-		iLocalName := fmt.Sprintf("imagecomp_tmp_%s_%d", utils.Md5Hex(iUrl), time.Now().UnixNano())
-		iLocalPath := filepath.Join(os.TempDir(), iLocalName)
-		dContentType, dErr := utils.Download(iUrl, iLocalPath)
+		iLocalFp, tErr := req.Scratch().CreateTemp("imagecomp_tmp_")
+		if tErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open local image file failed, %s", tErr.Error()))
+			return
+		}
+		iLocalPath := iLocalFp.Name()
+		fetchCtx := utils.WithFetchOptions(ctx, utils.FetchOptions{Hash: utils.StatHash(iUrl, statRet[index].Data.Hash)})
+		dContentType, dErr := ufop.StorageDownloadTo(fetchCtx, this.storage, iUrl, iLocalFp)
+		iLocalFp.Close()
 		if dErr != nil {
-			err = dErr
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get resource by url '%s' failed, %s", iUrl, dErr.Error()))
 			return
 		}
 
 		if !(dContentType == "image/png" || dContentType == "image/jpeg") {
-			err = errors.New(fmt.Sprintf("unsupported mimetype of '%s', '%s'", iUrl, dContentType))
+			err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, fmt.Sprintf("unsupported mimetype of '%s', '%s'", iUrl, dContentType))
 			return
 		}
 
@@ -358,15 +321,7 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		remoteImgUrls[iLocalPath] = iUrl
 	}
 
-	defer func() {
-		for iPath, _ := range localImgPathTypeMap {
-			os.Remove(iPath)
-		}
-	}()
-
 	//layout the images
-	localImgFps := make([]*os.File, 0)
-
 	var localImgObjs [][]image.Image = make([][]image.Image, rows*cols)
 
 	for index := 0; index < rows; index++ {
@@ -378,30 +333,9 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 
 	for _, iLocalPath := range localImgPaths {
 		iContentType := localImgPathTypeMap[iLocalPath]
-		imgFp, openErr := os.Open(iLocalPath)
-		if openErr != nil {
-			err = errors.New(fmt.Sprintf("open local image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], openErr.Error()))
-			return
-		}
-		localImgFps = append(localImgFps, imgFp)
-
-		var imgObj image.Image
-		var dErr error
-
-		if iContentType == "image/png" {
-			imgObj, dErr = png.Decode(imgFp)
-			if dErr != nil {
-				err = errors.New(fmt.Sprintf("decode png image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error()))
-				return
-			}
-		} else if iContentType == "image/jpeg" {
-			imgObj, dErr = jpeg.Decode(imgFp)
-			if dErr != nil {
-				err = errors.New(fmt.Sprintf("decode jpeg image of remote '%s' failed, %s", remoteImgUrls[iLocalPath], dErr.Error()))
-				return
-			}
-		} else {
-			err = errors.New(fmt.Sprintf("unsupported src image format '%s' of url '%s'", iContentType, remoteImgUrls[iLocalPath]))
+		imgObj, dErr := decodeImage(iLocalPath, iContentType, remoteImgUrls[iLocalPath])
+		if dErr != nil {
+			err = dErr
 			return
 		}
 
@@ -427,13 +361,6 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 		}
 	}
 
-	//close file handlers
-	defer func() {
-		for _, fp := range localImgFps {
-			fp.Close()
-		}
-	}()
-
 	//calc the dst image size
 	dstImageWidth := 0
 	dstImageHeight := 0
@@ -528,14 +455,14 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 	}
 
 	//write result
-	contentType = formatMimes[format]
+	result.MimeType = formatMimes[format]
 
 	var buffer = bytes.NewBuffer(nil)
-	switch contentType {
+	switch result.MimeType {
 	case "image/png":
 		eErr := png.Encode(buffer, dstImage)
 		if eErr != nil {
-			err = errors.New(fmt.Sprintf("create dst png image failed, %s", eErr))
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create dst png image failed, %s", eErr))
 			return
 		}
 
@@ -544,12 +471,40 @@ func (this *ImageComposer) Do(req ufop.UfopRequest) (result interface{}, resultT
 			Quality: 75,
 		})
 		if eErr != nil {
-			err = errors.New(fmt.Sprintf("create dst jpeg image failed, %s", eErr))
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create dst jpeg image failed, %s", eErr))
 			return
 		}
 	}
 
-	result = buffer.Bytes()
-	resultType = ufop.RESULT_TYPE_OCTECT_BYTES
+	result.Type = ufop.RESULT_TYPE_OCTECT_BYTES
+	result.Body = buffer.Bytes()
+	result.Filename = fmt.Sprintf("imagecomp.%s", format)
+	return
+}
+
+//decode the local image, the file is closed once decoded
+func decodeImage(localPath, contentType, remoteUrl string) (imgObj image.Image, err error) {
+	imgFp, openErr := os.Open(localPath)
+	if openErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open local image of remote '%s' failed, %s", remoteUrl, openErr.Error()))
+		return
+	}
+	defer imgFp.Close()
+
+	var dErr error
+	switch contentType {
+	case "image/png":
+		imgObj, dErr = png.Decode(imgFp)
+		if dErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("decode png image of remote '%s' failed, %s", remoteUrl, dErr.Error()))
+		}
+	case "image/jpeg":
+		imgObj, dErr = jpeg.Decode(imgFp)
+		if dErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("decode jpeg image of remote '%s' failed, %s", remoteUrl, dErr.Error()))
+		}
+	default:
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, fmt.Sprintf("unsupported src image format '%s' of url '%s'", contentType, remoteUrl))
+	}
 	return
 }
@@ -0,0 +1,323 @@
+package ufop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_STATE_QUEUED  = "queued"
+	JOB_STATE_RUNNING = "running"
+	JOB_STATE_DONE    = "done"
+	JOB_STATE_FAILED  = "failed"
+)
+
+//the job runner, normally the server's runJob
+type UfopJobRunner func(ctx context.Context, ufopReq UfopRequest) (UfopResult, error)
+
+type UfopJob struct {
+	Id         string      `json:"id"`
+	Fop        string      `json:"fop"`
+	State      string      `json:"state"`
+	Progress   int         `json:"progress"`
+	Error      string      `json:"error,omitempty"`
+	ErrorCode  string      `json:"code,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Output     string      `json:"output,omitempty"`
+	CreatedAt  int64       `json:"created_at"`
+	StartedAt  int64       `json:"started_at,omitempty"`
+	FinishedAt int64       `json:"finished_at,omitempty"`
+
+	req    UfopRequest
+	result UfopResult
+	//local output file for octet results
+	outputPath string
+	//remote output for url results
+	outputUrl string
+}
+
+type UfopJobManager struct {
+	lock      sync.RWMutex
+	jobs      map[string]*UfopJob
+	queue     chan *UfopJob
+	runner    UfopJobRunner
+	resultDir string
+	jobTTL    time.Duration
+
+	//the jobs are run with the context, no more jobs accepted after closed
+	ctx    context.Context
+	closed bool
+}
+
+func NewJobManager(ctx context.Context, workers, queueSize int, resultDir string, jobTTL time.Duration,
+	runner UfopJobRunner) *UfopJobManager {
+	manager := UfopJobManager{
+		ctx:       ctx,
+		jobs:      make(map[string]*UfopJob),
+		queue:     make(chan *UfopJob, queueSize),
+		runner:    runner,
+		resultDir: resultDir,
+		jobTTL:    jobTTL,
+	}
+
+	for index := 0; index < workers; index++ {
+		go manager.work()
+	}
+	go manager.expire()
+
+	return &manager
+}
+
+//submit the request to the queue, fails when the queue is full
+func (this *UfopJobManager) Submit(fop string, ufopReq UfopRequest) (job UfopJob, err error) {
+	newJob := &UfopJob{
+		Id:        ufopReq.ReqId,
+		Fop:       fop,
+		State:     JOB_STATE_QUEUED,
+		CreatedAt: time.Now().Unix(),
+		req:       ufopReq,
+	}
+	newJob.req.progress = func(progress int) {
+		this.setProgress(newJob, progress)
+	}
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		err = NewUfopError(ERROR_SHUTTING_DOWN, "server is shutting down")
+		return
+	}
+	//the job of the same id is not replaced, its output would be orphaned
+	if _, exists := this.jobs[newJob.Id]; exists {
+		this.lock.Unlock()
+		err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("async job '%s' already exists", newJob.Id))
+		return
+	}
+	this.jobs[newJob.Id] = newJob
+	//snapshot before queued, the worker may update the job at once
+	snapshot := *newJob
+	this.lock.Unlock()
+
+	select {
+	case this.queue <- newJob:
+		job = snapshot
+	default:
+		this.lock.Lock()
+		delete(this.jobs, newJob.Id)
+		this.lock.Unlock()
+		err = NewUfopError(ERROR_QUEUE_FULL, "async job queue is full")
+	}
+	return
+}
+
+//get a snapshot of the job
+func (this *UfopJobManager) Get(jobId string) (job UfopJob, ok bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	var v *UfopJob
+	if v, ok = this.jobs[jobId]; ok {
+		job = *v
+	}
+	return
+}
+
+func (this *UfopJobManager) work() {
+	for job := range this.queue {
+		this.lock.Lock()
+		job.State = JOB_STATE_RUNNING
+		job.StartedAt = time.Now().Unix()
+		this.lock.Unlock()
+
+		var result UfopResult
+		var err error
+		if this.ctx.Err() != nil {
+			//the queued jobs are not started after the context is done
+			err = shutdownUfopError()
+		} else {
+			job.req.Logger().Infof("async job started")
+			result, err = this.runner(this.ctx, job.req)
+			if err == nil {
+				err = this.store(job, result)
+			}
+		}
+		//the outputs are saved out of the scratch dir
+		job.req.scratch.Remove()
+
+		this.lock.Lock()
+		job.FinishedAt = time.Now().Unix()
+		if err != nil {
+			job.State = JOB_STATE_FAILED
+			job.Error = err.Error()
+			job.ErrorCode = WrapUfopError(ERROR_FOP_FAILED, err).Code
+		} else {
+			job.State = JOB_STATE_DONE
+			job.Progress = 100
+		}
+		this.lock.Unlock()
+
+		job.req.Logger().Done(err)
+	}
+}
+
+//keep the result until the job expires, octet results are saved as local files
+func (this *UfopJobManager) store(job *UfopJob, result UfopResult) (err error) {
+	var outputPath string
+	var outputUrl string
+
+	switch result.Type {
+	case RESULT_TYPE_OCTECT_BYTES:
+		outputPath = filepath.Join(this.resultDir, fmt.Sprintf("ufop_job_%s", job.Id))
+		var data []byte
+		if v, ok := result.Body.([]byte); ok {
+			data = v
+		}
+		if wErr := ioutil.WriteFile(outputPath, data, 0644); wErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("save async job output failed, %s", wErr.Error()))
+			return
+		}
+	case RESULT_TYPE_OCTECT_FILE:
+		outputPath = filepath.Join(this.resultDir, fmt.Sprintf("ufop_job_%s", job.Id))
+		var localPath string
+		if v, ok := result.Body.(string); ok {
+			localPath = v
+		}
+		if mErr := moveFile(localPath, outputPath); mErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("save async job output failed, %s", mErr.Error()))
+			return
+		}
+	case RESULT_TYPE_OCTECT_STREAM:
+		outputPath = filepath.Join(this.resultDir, fmt.Sprintf("ufop_job_%s", job.Id))
+		outputFp, openErr := os.Create(outputPath)
+		if openErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("open async job output failed, %s", openErr.Error()))
+			return
+		}
+		var streamErr error
+		if stream, ok := result.Body.(UfopStreamWriter); ok {
+			streamErr = stream(outputFp)
+		}
+		outputFp.Close()
+		if streamErr != nil {
+			os.Remove(outputPath)
+			err = WrapUfopError(ERROR_PROCESS_FAILED, streamErr)
+			return
+		}
+	case RESULT_TYPE_OCTECT_URL:
+		if v, ok := result.Body.(string); ok {
+			outputUrl = v
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	job.result = result
+	job.outputPath = outputPath
+	job.outputUrl = outputUrl
+	if result.Type == RESULT_TYPE_JSON {
+		job.Result = result.Body
+	} else {
+		job.Output = fmt.Sprintf("/jobs/%s/output", job.Id)
+	}
+	return
+}
+
+func (this *UfopJobManager) setProgress(job *UfopJob, progress int) {
+	if progress < 0 {
+		progress = 0
+	} else if progress > 99 {
+		//100 is reserved for the finished job
+		progress = 99
+	}
+
+	this.lock.Lock()
+	job.Progress = progress
+	this.lock.Unlock()
+}
+
+//remove the finished jobs and their outputs after the ttl
+func (this *UfopJobManager) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deadline := time.Now().Add(-this.jobTTL).Unix()
+		outputPaths := make([]string, 0)
+
+		this.lock.Lock()
+		for jobId, job := range this.jobs {
+			if job.FinishedAt != 0 && job.FinishedAt < deadline {
+				delete(this.jobs, jobId)
+				if job.outputPath != "" {
+					outputPaths = append(outputPaths, job.outputPath)
+				}
+			}
+		}
+		this.lock.Unlock()
+
+		for _, outputPath := range outputPaths {
+			os.Remove(outputPath)
+		}
+	}
+}
+
+//stop accepting new jobs, the queued jobs are still run
+func (this *UfopJobManager) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+}
+
+//remove the outputs of all the jobs, called on shutdown
+func (this *UfopJobManager) RemoveOutputs() {
+	this.lock.Lock()
+	outputPaths := make([]string, 0)
+	for _, job := range this.jobs {
+		if job.outputPath != "" {
+			outputPaths = append(outputPaths, job.outputPath)
+			job.outputPath = ""
+		}
+	}
+	this.lock.Unlock()
+
+	for _, outputPath := range outputPaths {
+		os.Remove(outputPath)
+	}
+}
+
+//rename the file, or copy it when they are on different devices
+func moveFile(srcPath, dstPath string) (err error) {
+	if os.Rename(srcPath, dstPath) == nil {
+		return
+	}
+	defer os.Remove(srcPath)
+
+	srcFp, openErr := os.Open(srcPath)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer srcFp.Close()
+
+	dstFp, createErr := os.Create(dstPath)
+	if createErr != nil {
+		err = createErr
+		return
+	}
+	_, cpErr := io.Copy(dstFp, srcFp)
+	closeErr := dstFp.Close()
+	if cpErr == nil {
+		cpErr = closeErr
+	}
+	if cpErr != nil {
+		os.Remove(dstPath)
+		err = cpErr
+	}
+	return
+}
@@ -0,0 +1,27 @@
+package ufop_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"ufop"
+)
+
+func TestJobIdExists(t *testing.T) {
+	//no workers, the jobs stay queued
+	manager := ufop.NewJobManager(context.Background(), 0, 10, t.TempDir(), time.Hour,
+		func(ctx context.Context, ufopReq ufop.UfopRequest) (ufop.UfopResult, error) {
+			return ufop.UfopResult{}, nil
+		})
+
+	ufopReq := ufop.UfopRequest{ReqId: "job-1"}
+	if _, err := manager.Submit("mkzip", ufopReq); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Submit("unzip", ufopReq); err == nil || err.Error() != "async job 'job-1' already exists" {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if job, ok := manager.Get("job-1"); !ok || job.Fop != "mkzip" {
+		t.Fatalf("unexpected job %v", job)
+	}
+}
@@ -0,0 +1,133 @@
+package ufop
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull    = NewUfopError(ERROR_QUEUE_FULL, "too many jobs waiting, please retry later")
+	ErrQueueTimeout = NewUfopError(ERROR_QUEUE_TIMEOUT, "wait for the job slot timeout, please retry later")
+)
+
+//limit the jobs running at the same time, globally and per fop,
+//jobs exceeding the limits wait in a bounded queue
+type UfopLimiter struct {
+	lock         sync.Mutex
+	global       limiterSlots
+	fops         map[string]*limiterSlots
+	waiting      int
+	maxWaiting   int
+	queueTimeout time.Duration
+	//closed and replaced when the slots are released or the limits change,
+	//to wake up the waiting jobs
+	changed chan struct{}
+}
+
+//the running jobs are counted even when the limit is off, so they are kept
+//when the limit changes, limit <= 0 means no limit
+type limiterSlots struct {
+	limit   int
+	running int
+}
+
+func (this *limiterSlots) available() bool {
+	return this.limit <= 0 || this.running < this.limit
+}
+
+//maxConcurrency <= 0 means no global limit
+func NewLimiter(maxConcurrency, maxWaiting int, queueTimeout time.Duration) *UfopLimiter {
+	limiter := UfopLimiter{
+		global:       limiterSlots{limit: maxConcurrency},
+		fops:         make(map[string]*limiterSlots),
+		maxWaiting:   maxWaiting,
+		queueTimeout: queueTimeout,
+		changed:      make(chan struct{}),
+	}
+	return &limiter
+}
+
+//set the limit of the fop, maxConcurrency <= 0 means no limit, the running
+//jobs of the fop still take the slots of the new limit
+func (this *UfopLimiter) SetFopLimit(fop string, maxConcurrency int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if slots, ok := this.fops[fop]; ok {
+		slots.limit = maxConcurrency
+	} else {
+		this.fops[fop] = &limiterSlots{limit: maxConcurrency}
+	}
+	this.notify()
+}
+
+//get a job slot for the fop, call release when the job is done
+func (this *UfopLimiter) Acquire(ctx context.Context, fop string) (release func(), err error) {
+	var timer *time.Timer
+	this.lock.Lock()
+	for {
+		fopSlots, ok := this.fops[fop]
+		if !ok {
+			fopSlots = &limiterSlots{}
+			this.fops[fop] = fopSlots
+		}
+		//both slots are taken at once, the waiting jobs hold none
+		if fopSlots.available() && this.global.available() {
+			fopSlots.running += 1
+			this.global.running += 1
+			this.lock.Unlock()
+			release = this.releaseFunc(fopSlots)
+			return
+		}
+
+		//enter the wait queue
+		if timer == nil {
+			if this.waiting >= this.maxWaiting {
+				this.lock.Unlock()
+				err = ErrQueueFull
+				return
+			}
+			this.waiting += 1
+			timer = time.NewTimer(this.queueTimeout)
+			defer timer.Stop()
+			defer func() {
+				this.lock.Lock()
+				this.waiting -= 1
+				this.lock.Unlock()
+			}()
+		}
+		changed := this.changed
+		this.lock.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			err = ErrQueueTimeout
+			return
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
+		this.lock.Lock()
+	}
+}
+
+func (this *UfopLimiter) releaseFunc(fopSlots *limiterSlots) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.lock.Lock()
+			defer this.lock.Unlock()
+			fopSlots.running -= 1
+			this.global.running -= 1
+			this.notify()
+		})
+	}
+}
+
+//wake up the waiting jobs, called in the lock
+func (this *UfopLimiter) notify() {
+	close(this.changed)
+	this.changed = make(chan struct{})
+}
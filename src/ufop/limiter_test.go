@@ -0,0 +1,150 @@
+package ufop_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"ufop"
+)
+
+//the handler holds its job slot until the release channel is closed
+type blockHandler struct {
+	name    string
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockHandler(name string) *blockHandler {
+	return &blockHandler{name: name, started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (this *blockHandler) Name() string {
+	return this.name
+}
+
+func (this *blockHandler) InitConfig(jobConf []byte, storage ufop.UfopStorage) error {
+	return nil
+}
+
+func (this *blockHandler) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *blockHandler) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	this.started <- struct{}{}
+	select {
+	case <-this.release:
+		result = ufop.UfopResult{Type: ufop.RESULT_TYPE_JSON, Body: "done"}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+//register the handler with its concurrency limit
+func (this *testEnv) registerLimited(handler ufop.UfopJobHandler, maxConcurrency int) {
+	if this.cfg.Handlers == nil {
+		this.cfg.Handlers = make(map[string]ufop.UfopHandlerConfig)
+	}
+	this.cfg.Handlers[handler.Name()] = ufop.UfopHandlerConfig{MaxConcurrency: maxConcurrency, Settings: []byte("{}")}
+	if err := this.serv.RegisterJobHandler(handler); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+//serve the request without checking the scratch dirs, which are in use by
+//the other requests
+func (this *testEnv) serve(cmd string) *httptest.ResponseRecorder {
+	reqData, _ := json.Marshal(map[string]interface{}{"cmd": testPrefix + cmd})
+	w := httptest.NewRecorder()
+	this.serv.ServeUfop(w, httptest.NewRequest("POST", "/uop", bytes.NewReader(reqData)))
+	return w
+}
+
+//run the request in the background, the response is sent to the channel
+func (this *testEnv) serveBackground(cmd string) chan *httptest.ResponseRecorder {
+	respCh := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		respCh <- this.serve(cmd)
+	}()
+	return respCh
+}
+
+func newLimitedEnv(t *testing.T, maxConcurrency, maxQueueSize, queueTimeout int) *testEnv {
+	env := newTestEnv(t)
+	env.cfg.MaxConcurrency = maxConcurrency
+	env.cfg.MaxQueueSize = maxQueueSize
+	env.cfg.QueueTimeout = queueTimeout
+	env.serv = ufop.NewServer(env.cfg)
+	return env
+}
+
+func TestLimiterFop(t *testing.T) {
+	env := newLimitedEnv(t, 0, 1, 1)
+	handler := newBlockHandler("block")
+	env.registerLimited(handler, 1)
+
+	first := env.serveBackground("block")
+	<-handler.started
+
+	//the second waits in the queue until timeout, the third finds it full
+	second := env.serveBackground("block")
+	time.Sleep(100 * time.Millisecond)
+	w := env.serve("block")
+	expectError(t, w, 503, ufop.ERROR_QUEUE_FULL, "too many jobs waiting, please retry later")
+	expectError(t, <-second, 503, ufop.ERROR_QUEUE_TIMEOUT, "wait for the job slot timeout, please retry later")
+
+	close(handler.release)
+	expectStatus(t, <-first, 200)
+	expectStatus(t, env.serve("block"), 200)
+}
+
+func TestLimiterGlobal(t *testing.T) {
+	env := newLimitedEnv(t, 1, 0, 1)
+	handlerA := newBlockHandler("block-a")
+	handlerB := newBlockHandler("block-b")
+	env.registerLimited(handlerA, 0)
+	env.registerLimited(handlerB, 0)
+
+	//the fops share the global slot
+	first := env.serveBackground("block-a")
+	<-handlerA.started
+	w := env.serve("block-b")
+	expectError(t, w, 503, ufop.ERROR_QUEUE_FULL, "too many jobs waiting, please retry later")
+
+	close(handlerA.release)
+	expectStatus(t, <-first, 200)
+	close(handlerB.release)
+	expectStatus(t, env.serve("block-b"), 200)
+}
+
+func TestLimiterReload(t *testing.T) {
+	env := newLimitedEnv(t, 0, 0, 1)
+	handler := newBlockHandler("block")
+	env.registerLimited(handler, 1)
+
+	first := env.serveBackground("block")
+	<-handler.started
+	w := env.serve("block")
+	expectError(t, w, 503, ufop.ERROR_QUEUE_FULL, "too many jobs waiting, please retry later")
+
+	//the running job still takes one of the new slots
+	cfg := reloadTestConfig(t, `{
+		"ufop_prefix": "qn-",
+		"handlers": {"block": {"max_concurrency": 2, "settings": {}}}
+	}`)
+	if errs := env.serv.Reload(cfg, []ufop.UfopJobHandler{handler}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	second := env.serveBackground("block")
+	<-handler.started
+	w = env.serve("block")
+	expectError(t, w, 503, ufop.ERROR_QUEUE_FULL, "too many jobs waiting, please retry later")
+
+	close(handler.release)
+	expectStatus(t, <-first, 200)
+	expectStatus(t, <-second, 200)
+}
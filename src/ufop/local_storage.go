@@ -0,0 +1,228 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"ufop/utils"
+)
+
+//the urls of the files in the local storage, like ufop-local://<bucket>/<key>
+const LOCAL_STORAGE_URL_SCHEME = "ufop-local"
+
+//the buckets are the sub dirs of the root dir, used for development and tests,
+//urls of other schemes are read by http get
+type LocalStorage struct {
+	rootDir string
+}
+
+func NewLocalStorage(rootDir string) (storage *LocalStorage, err error) {
+	if rootDir == "" {
+		err = errors.New("no storage dir configured for the local storage")
+		return
+	}
+	if mErr := os.MkdirAll(rootDir, 0755); mErr != nil {
+		err = errors.New(fmt.Sprintf("create storage dir failed, %s", mErr.Error()))
+		return
+	}
+	storage = &LocalStorage{rootDir: rootDir}
+	return
+}
+
+func (this *LocalStorage) WithCredentials(accessKey, secretKey string) UfopStorage {
+	return this
+}
+
+//the url to read the file by Get
+func (this *LocalStorage) Url(bucket, key string) string {
+	resUri := url.URL{
+		Scheme: LOCAL_STORAGE_URL_SCHEME,
+		Host:   bucket,
+		Path:   "/" + key,
+	}
+	return resUri.String()
+}
+
+func (this *LocalStorage) bucketDir(bucket string) (bucketDir string, err error) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		err = errors.New(fmt.Sprintf("invalid bucket '%s'", bucket))
+		return
+	}
+	bucketDir = filepath.Join(this.rootDir, bucket)
+	return
+}
+
+func (this *LocalStorage) filePath(bucket, key string) (fpath string, err error) {
+	bucketDir, err := this.bucketDir(bucket)
+	if err != nil {
+		return
+	}
+	fpath = filepath.Join(bucketDir, filepath.FromSlash(key))
+	if key == "" || !strings.HasPrefix(fpath, bucketDir+string(filepath.Separator)) {
+		err = errors.New(fmt.Sprintf("invalid key '%s'", key))
+	}
+	return
+}
+
+func (this *LocalStorage) stat(bucket, key string) (entry UfopEntry, code int, err error) {
+	bucketDir, bErr := this.bucketDir(bucket)
+	if bErr != nil {
+		code, err = 400, bErr
+		return
+	}
+	if _, sErr := os.Stat(bucketDir); sErr != nil {
+		code, err = STORAGE_CODE_NO_SUCH_BUCKET, errors.New("no such bucket")
+		return
+	}
+
+	fpath, pErr := this.filePath(bucket, key)
+	if pErr != nil {
+		code, err = 400, pErr
+		return
+	}
+	fp, openErr := os.Open(fpath)
+	if openErr != nil {
+		code, err = STORAGE_CODE_NO_SUCH_FILE, errors.New("no such file or directory")
+		return
+	}
+	defer fp.Close()
+
+	stat, sErr := fp.Stat()
+	if sErr != nil || !stat.Mode().IsRegular() {
+		code, err = STORAGE_CODE_NO_SUCH_FILE, errors.New("no such file or directory")
+		return
+	}
+	hash, hErr := utils.Etag(fp)
+	if hErr != nil {
+		code, err = 599, hErr
+		return
+	}
+
+	code = STORAGE_CODE_OK
+	entry = UfopEntry{
+		Hash:     hash,
+		Fsize:    stat.Size(),
+		PutTime:  stat.ModTime().UnixNano() / 100,
+		MimeType: localMimeType(key),
+	}
+	return
+}
+
+func localMimeType(key string) (mimeType string) {
+	mimeType = mime.TypeByExtension(filepath.Ext(key))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	return
+}
+
+func (this *LocalStorage) Stat(ctx context.Context, bucket, key string) (entry UfopEntry, err error) {
+	entry, _, err = this.stat(bucket, key)
+	return
+}
+
+func (this *LocalStorage) BatchStat(ctx context.Context, entries []UfopEntryPath) (statRet []UfopStatResult, err error) {
+	statRet = make([]UfopStatResult, 0, len(entries))
+	for _, entryPath := range entries {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		entry, code, sErr := this.stat(entryPath.Bucket, entryPath.Key)
+		ret := UfopStatResult{
+			Data: entry,
+			Code: code,
+		}
+		if sErr != nil {
+			ret.Error = sErr.Error()
+		}
+		statRet = append(statRet, ret)
+	}
+	return
+}
+
+func (this *LocalStorage) Get(ctx context.Context, resUrl string) (body io.ReadCloser, mimeType string, err error) {
+	resUri, pErr := url.Parse(resUrl)
+	if pErr != nil || resUri.Scheme != LOCAL_STORAGE_URL_SCHEME {
+		//not a local file
+		return httpGet(ctx, resUrl)
+	}
+
+	key := strings.TrimPrefix(resUri.Path, "/")
+	fpath, fErr := this.filePath(resUri.Host, key)
+	if fErr != nil {
+		err = fErr
+		return
+	}
+	fp, openErr := os.Open(fpath)
+	if openErr != nil {
+		err = errors.New("no such file or directory")
+		return
+	}
+	body = fp
+	mimeType = localMimeType(key)
+	return
+}
+
+func (this *LocalStorage) Put(ctx context.Context, bucket, key string, data io.Reader,
+	extra *UfopPutExtra) (putRet UfopPutResult, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	fpath, fErr := this.filePath(bucket, key)
+	if fErr != nil {
+		err = fErr
+		return
+	}
+	if _, sErr := os.Stat(fpath); sErr == nil && (extra == nil || !extra.Overwrite) {
+		err = errors.New("file exists")
+		return
+	}
+	if mErr := os.MkdirAll(filepath.Dir(fpath), 0755); mErr != nil {
+		err = mErr
+		return
+	}
+
+	//write to the temp file first, the readers never see the partial file
+	tmpFp, tmpErr := ioutil.TempFile(filepath.Dir(fpath), ".ufop_put_")
+	if tmpErr != nil {
+		err = tmpErr
+		return
+	}
+	tmpPath := tmpFp.Name()
+	_, cpErr := io.Copy(tmpFp, data)
+	tmpFp.Close()
+	if cpErr != nil {
+		os.Remove(tmpPath)
+		err = cpErr
+		return
+	}
+	if rErr := os.Rename(tmpPath, fpath); rErr != nil {
+		os.Remove(tmpPath)
+		err = rErr
+		return
+	}
+
+	entry, _, sErr := this.stat(bucket, key)
+	if sErr != nil {
+		err = sErr
+		return
+	}
+	putRet = UfopPutResult{
+		Hash: entry.Hash,
+		Key:  key,
+	}
+	return
+}
+
+func (this *LocalStorage) PutResumable(ctx context.Context, bucket, key string, data io.ReaderAt, fsize int64,
+	extra *UfopPutExtra) (putRet UfopPutResult, err error) {
+	return this.Put(ctx, bucket, key, io.NewSectionReader(data, 0, fsize), extra)
+}
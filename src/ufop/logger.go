@@ -0,0 +1,190 @@
+package ufop
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the request id header, sent back with each response, the incoming one from
+//qiniu is not used as the request id, but logged and sent back by the client
+//request id header to correlate the logs
+const (
+	REQUEST_ID_HEADER        = "X-Reqid"
+	CLIENT_REQUEST_ID_HEADER = "X-Client-Reqid"
+)
+
+//the value of the redacted parameters in the logs
+const LOG_REDACTED = "<redacted>"
+
+//the incoming request ids kept in the logs and the responses
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var logOutput = &ufopLogOutput{w: os.Stderr}
+
+type ufopLogOutput struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+func (this *ufopLogOutput) write(data []byte) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.w.Write(data)
+}
+
+//set the output of the request logs, stderr by default
+func SetLogOutput(w io.Writer) {
+	logOutput.lock.Lock()
+	defer logOutput.lock.Unlock()
+	logOutput.w = w
+}
+
+//the structured log of a request, each line is a json object carrying the
+//request id, the fop, the bucket, the src size and the duration so far, the
+//outcome and the error code are on the last line
+type UfopLogger struct {
+	reqId string
+	//the incoming request id, empty if none or not safe
+	clientReqId string
+	fop         string
+	bucket      string
+	srcSize     uint64
+	start       time.Time
+	//the command and the src url with the redacted parameters, on the first
+	//and the last lines only
+	cmd    string
+	srcUrl string
+	//the command parameters hidden in the logs
+	redactParams []string
+}
+
+type ufopLogLine struct {
+	Time        string `json:"time"`
+	Level       string `json:"level"`
+	ReqId       string `json:"reqid"`
+	ClientReqId string `json:"client_reqid,omitempty"`
+	Fop         string `json:"fop,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	SrcSize     uint64 `json:"src_size,omitempty"`
+	Duration    int64  `json:"duration_ms"`
+	Cmd         string `json:"cmd,omitempty"`
+	SrcUrl      string `json:"src_url,omitempty"`
+	Outcome     string `json:"outcome,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Msg         string `json:"msg"`
+}
+
+func NewLogger(reqId string) *UfopLogger {
+	return &UfopLogger{
+		reqId: reqId,
+		start: time.Now(),
+	}
+}
+
+//fill the fields of the parsed request, the values of the redact params in
+//the command are hidden, and the src url too if "src" is one of them
+func (this *UfopLogger) setRequest(ufopReq UfopRequest, bucket string, redactParams []string) {
+	this.fop = cmdFop(ufopReq.Cmd)
+	this.bucket = bucket
+	this.srcSize = ufopReq.Src.Fsize
+	this.redactParams = redactParams
+	this.cmd = redactCmd(ufopReq.Cmd, redactParams)
+	this.srcUrl = ufopReq.Src.Url
+	if containsString(redactParams, "src") && this.srcUrl != "" {
+		this.srcUrl = LOG_REDACTED
+	}
+}
+
+//the value of the command parameter to log, hidden if the parameter is redacted
+func (this *UfopLogger) Redact(param, value string) string {
+	if containsString(this.redactParams, param) {
+		return LOG_REDACTED
+	}
+	return value
+}
+
+func (this *UfopLogger) Infof(format string, v ...interface{}) {
+	this.output("info", fmt.Sprintf(format, v...), nil)
+}
+
+func (this *UfopLogger) Warnf(format string, v ...interface{}) {
+	this.output("warn", fmt.Sprintf(format, v...), nil)
+}
+
+func (this *UfopLogger) Errorf(format string, v ...interface{}) {
+	this.output("error", fmt.Sprintf(format, v...), nil)
+}
+
+//the request is accepted, with the command and the src url
+func (this *UfopLogger) Start() {
+	this.output("info", "request started", func(line *ufopLogLine) {
+		line.Cmd = this.cmd
+		line.SrcUrl = this.srcUrl
+	})
+}
+
+//the last line of the request or the async job, with the outcome
+func (this *UfopLogger) Done(err error) {
+	level := "info"
+	msg := "request done"
+	outcome := "ok"
+	var code string
+	if err != nil {
+		ufopErr := WrapUfopError(ERROR_FOP_FAILED, err)
+		level = "error"
+		msg = "request failed, " + ufopErr.Message
+		outcome = "error"
+		code = ufopErr.Code
+	}
+	this.output(level, msg, func(line *ufopLogLine) {
+		line.Cmd = this.cmd
+		line.SrcUrl = this.srcUrl
+		line.Outcome = outcome
+		line.Code = code
+	})
+}
+
+func (this *UfopLogger) output(level, msg string, fill func(line *ufopLogLine)) {
+	now := time.Now()
+	line := ufopLogLine{
+		Time:        now.Format(time.RFC3339Nano),
+		Level:       level,
+		ReqId:       this.reqId,
+		ClientReqId: this.clientReqId,
+		Fop:         this.fop,
+		Bucket:      this.bucket,
+		SrcSize:     this.srcSize,
+		Duration:    now.Sub(this.start).Milliseconds(),
+		Msg:         strings.TrimSuffix(msg, "\n"),
+	}
+	if fill != nil {
+		fill(&line)
+	}
+	data, _ := json.Marshal(&line)
+	logOutput.write(append(data, '\n'))
+}
+
+//hide the values of the params in each fop of the command, the command is
+//in format <fop>/<param>/<value>/<param>/<value>...[|<fop>/...]
+func redactCmd(cmd string, redactParams []string) string {
+	if len(redactParams) == 0 {
+		return cmd
+	}
+	stages := strings.Split(cmd, PIPELINE_SEPARATOR)
+	for index, stage := range stages {
+		items := strings.Split(stage, "/")
+		for itemIndex := 1; itemIndex+1 < len(items); itemIndex += 2 {
+			if containsString(redactParams, items[itemIndex]) {
+				items[itemIndex+1] = LOG_REDACTED
+			}
+		}
+		stages[index] = strings.Join(items, "/")
+	}
+	return strings.Join(stages, PIPELINE_SEPARATOR)
+}
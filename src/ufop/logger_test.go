@@ -0,0 +1,126 @@
+package ufop_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"ufop"
+	"ufop/mkzip"
+)
+
+type testLogLine struct {
+	Level       string `json:"level"`
+	ReqId       string `json:"reqid"`
+	ClientReqId string `json:"client_reqid"`
+	Fop         string `json:"fop"`
+	Bucket      string `json:"bucket"`
+	SrcSize     uint64 `json:"src_size"`
+	Duration    *int64 `json:"duration_ms"`
+	Cmd         string `json:"cmd"`
+	Outcome     string `json:"outcome"`
+	Code        string `json:"code"`
+	Msg         string `json:"msg"`
+}
+
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buffer bytes.Buffer
+	ufop.SetLogOutput(&buffer)
+	t.Cleanup(func() {
+		ufop.SetLogOutput(os.Stderr)
+	})
+	return &buffer
+}
+
+func parseLogs(t *testing.T, buffer *bytes.Buffer) (lines []testLogLine) {
+	for _, data := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+		var line testLogLine
+		if err := json.Unmarshal([]byte(data), &line); err != nil {
+			t.Fatalf("invalid log line %s", data)
+		}
+		lines = append(lines, line)
+	}
+	buffer.Reset()
+	return
+}
+
+func TestRequestLogs(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.LogRedactParams = []string{"url"}
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	buffer := captureLogs(t)
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	body := `{"cmd":"qn-mkzip/bucket/` + encode(testBucket) + `/url/` + encode(urlA) + `","src":{"fsize":10}}`
+	req := newAuthRequest(body)
+	req.Header.Set("X-Reqid", "dora-req-1")
+	w := serveAuth(env, req)
+	expectStatus(t, w, 200)
+	//the incoming request id is only for the correlation
+	reqId := w.Header().Get("X-Reqid")
+	if reqId == "" || reqId == "dora-req-1" || w.Header().Get("X-Client-Reqid") != "dora-req-1" {
+		t.Fatalf("unexpected reqid %q %q", reqId, w.Header().Get("X-Client-Reqid"))
+	}
+
+	lines := parseLogs(t, buffer)
+	if len(lines) < 3 {
+		t.Fatalf("unexpected log lines %+v", lines)
+	}
+	for _, line := range lines {
+		if line.ReqId != reqId || line.ClientReqId != "dora-req-1" || line.Fop != "qn-mkzip" ||
+			line.Bucket != testBucket || line.SrcSize != 10 || line.Duration == nil {
+			t.Fatalf("unexpected log line %+v", line)
+		}
+	}
+	first, last := lines[0], lines[len(lines)-1]
+	if first.Msg != "request started" || strings.Contains(first.Cmd, encode(urlA)) ||
+		!strings.Contains(first.Cmd, "/url/<redacted>") {
+		t.Fatalf("unexpected first line %+v", first)
+	}
+	if last.Outcome != "ok" || last.Code != "" || last.Cmd != first.Cmd {
+		t.Fatalf("unexpected last line %+v", last)
+	}
+
+	//the unsafe incoming request id is dropped
+	req = newAuthRequest(`{"cmd":"qn-none"}`)
+	req.Header.Set("X-Reqid", "../dora")
+	w = serveAuth(env, req)
+	expectError(t, w, 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+	reqId = w.Header().Get("X-Reqid")
+	if reqId == "" || reqId == "../dora" || w.Header().Get("X-Client-Reqid") != "" {
+		t.Fatalf("unexpected reqid %q", reqId)
+	}
+	lines = parseLogs(t, buffer)
+	last = lines[len(lines)-1]
+	if last.ReqId != reqId || last.ClientReqId != "" || last.Outcome != "error" || last.Code != ufop.ERROR_NO_FOP ||
+		last.Level != "error" {
+		t.Fatalf("unexpected last line %+v", last)
+	}
+}
+
+func TestRequestIdOfJobs(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	captureLogs(t)
+	defer env.serv.Shutdown()
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	body := `{"cmd":"qn-mkzip/bucket/` + encode(testBucket) + `/url/` + encode(urlA) + `","async":true}`
+	//the jobs of the same incoming request id have their own ids
+	jobIds := make(map[string]bool)
+	for index := 0; index < 2; index++ {
+		req := newAuthRequest(body)
+		req.Header.Set("X-Reqid", "dora-job-1")
+		w := httptest.NewRecorder()
+		env.serv.ServeUfop(w, req)
+		expectStatus(t, w, 202)
+		var job ufop.UfopJob
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Id == "dora-job-1" || job.Id != w.Header().Get("X-Reqid") || jobIds[job.Id] {
+			t.Fatalf("unexpected job id %q of request %d", job.Id, index)
+		}
+		jobIds[job.Id] = true
+	}
+}
@@ -0,0 +1,207 @@
+package ufop
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"ufop/utils"
+)
+
+//label of the requests for no registered fop, avoid unbounded label values
+const METRICS_UNKNOWN_FOP = "unknown"
+
+//upper bounds of the latency histogram in seconds
+var metricsLatencyBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800}
+
+type errorMetricKey struct {
+	fop   string
+	cause string
+}
+
+type latencyHistogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+//metrics in the prometheus text exposition format, no external dependency
+type UfopMetrics struct {
+	lock          sync.Mutex
+	requests      map[string]int64
+	errors        map[errorMetricKey]int64
+	latencies     map[string]*latencyHistogram
+	inFlight      map[string]int64
+	downloadBytes map[string]int64
+	responseBytes map[string]int64
+	//stats of the fetch cache, nil if no cache
+	fetchCache *utils.FetchCache
+}
+
+func NewMetrics() *UfopMetrics {
+	return &UfopMetrics{
+		requests:      make(map[string]int64),
+		errors:        make(map[errorMetricKey]int64),
+		latencies:     make(map[string]*latencyHistogram),
+		inFlight:      make(map[string]int64),
+		downloadBytes: make(map[string]int64),
+		responseBytes: make(map[string]int64),
+	}
+}
+
+//count the request and mark it in flight, call the returned func when it is done,
+//the cause is the error code of the failed request
+func (this *UfopMetrics) StartJob(fop string) (done func(cause string)) {
+	startTime := time.Now()
+
+	this.lock.Lock()
+	this.requests[fop] += 1
+	this.inFlight[fop] += 1
+	this.lock.Unlock()
+
+	done = func(cause string) {
+		elapsed := time.Since(startTime).Seconds()
+
+		this.lock.Lock()
+		defer this.lock.Unlock()
+
+		this.inFlight[fop] -= 1
+		if cause != "" {
+			this.errors[errorMetricKey{fop, cause}] += 1
+		}
+
+		histogram, ok := this.latencies[fop]
+		if !ok {
+			histogram = &latencyHistogram{
+				counts: make([]int64, len(metricsLatencyBuckets)),
+			}
+			this.latencies[fop] = histogram
+		}
+		for index, bound := range metricsLatencyBuckets {
+			if elapsed <= bound {
+				histogram.counts[index] += 1
+			}
+		}
+		histogram.count += 1
+		histogram.sum += elapsed
+	}
+	return
+}
+
+func (this *UfopMetrics) AddDownloadBytes(fop string, n int64) {
+	this.lock.Lock()
+	this.downloadBytes[fop] += n
+	this.lock.Unlock()
+}
+
+func (this *UfopMetrics) AddResponseBytes(fop string, n int64) {
+	this.lock.Lock()
+	this.responseBytes[fop] += n
+	this.lock.Unlock()
+}
+
+func (this *UfopMetrics) WriteTo(w http.ResponseWriter) {
+	buffer := bytes.NewBuffer(nil)
+
+	this.lock.Lock()
+	writeCounterMetric(buffer, "ufop_requests_total", "counter", "Total number of fop requests.", this.requests)
+
+	fmt.Fprintf(buffer, "# HELP ufop_errors_total Total number of failed fop requests by cause.\n")
+	fmt.Fprintf(buffer, "# TYPE ufop_errors_total counter\n")
+	errorKeys := make([]errorMetricKey, 0, len(this.errors))
+	for key := range this.errors {
+		errorKeys = append(errorKeys, key)
+	}
+	sort.Slice(errorKeys, func(i, j int) bool {
+		if errorKeys[i].fop != errorKeys[j].fop {
+			return errorKeys[i].fop < errorKeys[j].fop
+		}
+		return errorKeys[i].cause < errorKeys[j].cause
+	})
+	for _, key := range errorKeys {
+		fmt.Fprintf(buffer, "ufop_errors_total{fop=%s,cause=%s} %d\n",
+			strconv.Quote(key.fop), strconv.Quote(key.cause), this.errors[key])
+	}
+
+	fmt.Fprintf(buffer, "# HELP ufop_request_duration_seconds Latency of the fop requests.\n")
+	fmt.Fprintf(buffer, "# TYPE ufop_request_duration_seconds histogram\n")
+	for _, fop := range sortedKeys(this.latencies) {
+		histogram := this.latencies[fop]
+		for index, bound := range metricsLatencyBuckets {
+			fmt.Fprintf(buffer, "ufop_request_duration_seconds_bucket{fop=%s,le=\"%s\"} %d\n",
+				strconv.Quote(fop), strconv.FormatFloat(bound, 'g', -1, 64), histogram.counts[index])
+		}
+		fmt.Fprintf(buffer, "ufop_request_duration_seconds_bucket{fop=%s,le=\"+Inf\"} %d\n", strconv.Quote(fop), histogram.count)
+		fmt.Fprintf(buffer, "ufop_request_duration_seconds_sum{fop=%s} %s\n", strconv.Quote(fop),
+			strconv.FormatFloat(histogram.sum, 'f', -1, 64))
+		fmt.Fprintf(buffer, "ufop_request_duration_seconds_count{fop=%s} %d\n", strconv.Quote(fop), histogram.count)
+	}
+
+	writeCounterMetric(buffer, "ufop_jobs_in_flight", "gauge", "Number of fop jobs running or waiting for a slot.", this.inFlight)
+	writeCounterMetric(buffer, "ufop_src_download_bytes_total", "counter", "Bytes downloaded from the src urls.", this.downloadBytes)
+	writeCounterMetric(buffer, "ufop_response_bytes_total", "counter", "Bytes written in the responses.", this.responseBytes)
+	this.lock.Unlock()
+
+	if this.fetchCache != nil {
+		stats := this.fetchCache.Stats()
+		writeValueMetric(buffer, "ufop_fetch_cache_hits_total", "counter", "Fetches served by the cache.", stats.Hits)
+		writeValueMetric(buffer, "ufop_fetch_cache_misses_total", "counter", "Fetches not served by the cache.", stats.Misses)
+		writeValueMetric(buffer, "ufop_fetch_cache_entries", "gauge", "Number of the cached resources.", stats.Entries)
+		writeValueMetric(buffer, "ufop_fetch_cache_bytes", "gauge", "Bytes of the cached resources.", stats.Size)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(200)
+	w.Write(buffer.Bytes())
+}
+
+func writeCounterMetric(buffer *bytes.Buffer, name, metricType, help string, values map[string]int64) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, metricType)
+	for _, fop := range sortedKeys(values) {
+		fmt.Fprintf(buffer, "%s{fop=%s} %d\n", name, strconv.Quote(fop), values[fop])
+	}
+}
+
+func writeValueMetric(buffer *bytes.Buffer, name, metricType, help string, value int64) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, metricType)
+	fmt.Fprintf(buffer, "%s %d\n", name, value)
+}
+
+func sortedKeys(m interface{}) (keys []string) {
+	switch v := m.(type) {
+	case map[string]int64:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	case map[string]*latencyHistogram:
+		for key := range v {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+//count the bytes written to the client
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (this *countingResponseWriter) Write(data []byte) (n int, err error) {
+	n, err = this.ResponseWriter.Write(data)
+	this.written += int64(n)
+	return
+}
+
+//the stream results flush through the wrapper
+func (this *countingResponseWriter) Flush() {
+	if flusher, ok := this.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
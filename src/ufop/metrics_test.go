@@ -0,0 +1,54 @@
+package ufop_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"ufop"
+	"ufop/mkzip"
+)
+
+func TestMetrics(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	handler := newBlockHandler("block")
+	env.registerLimited(handler, 0)
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	ok := env.do("mkzip/bucket/"+encode(testBucket)+"/url/"+encode(urlA), ufop.UfopRequestSrc{})
+	expectStatus(t, ok, 200)
+	failed := env.do("mkzip/bucket/"+encode(testBucket), ufop.UfopRequestSrc{})
+	expectError(t, failed, 400, ufop.ERROR_BAD_COMMAND, "invalid mkzip command format, missing parameter 'url'")
+
+	blocked := env.serveBackground("block")
+	<-handler.started
+	defer func() {
+		close(handler.release)
+		<-blocked
+	}()
+
+	w := httptest.NewRecorder()
+	env.serv.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	expectStatus(t, w, 200)
+	for _, line := range []string{
+		`ufop_requests_total{fop="qn-mkzip"} 2`,
+		`ufop_requests_total{fop="qn-block"} 1`,
+		`ufop_errors_total{fop="qn-mkzip",cause="BAD_COMMAND"} 1`,
+		`ufop_request_duration_seconds_bucket{fop="qn-mkzip",le="1800"} 2`,
+		`ufop_request_duration_seconds_bucket{fop="qn-mkzip",le="+Inf"} 2`,
+		`ufop_request_duration_seconds_count{fop="qn-mkzip"} 2`,
+		`ufop_jobs_in_flight{fop="qn-mkzip"} 0`,
+		`ufop_jobs_in_flight{fop="qn-block"} 1`,
+		`ufop_src_download_bytes_total{fop="qn-mkzip"} 5`,
+		fmt.Sprintf(`ufop_response_bytes_total{fop="qn-mkzip"} %d`, ok.Body.Len()+failed.Body.Len()),
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("metric %q not found in %s", line, w.Body.String())
+		}
+	}
+	//the running job is not in the histogram yet
+	if strings.Contains(w.Body.String(), `ufop_request_duration_seconds_count{fop="qn-block"}`) {
+		t.Fatalf("unexpected latency of the running job in %s", w.Body.String())
+	}
+}
@@ -2,19 +2,12 @@ package mkzip
 
 import (
 	"archive/zip"
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/rs"
-	"github.com/qiniu/rpc"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"regexp"
 	"strings"
 	"ufop"
 	"ufop/utils"
@@ -33,15 +26,14 @@ const (
 )
 
 type Mkzipper struct {
-	mac           *digest.Mac
+	storage       ufop.UfopStorage
 	maxFileLength int64
 	maxFileCount  int
 }
 
 type MkzipperConfig struct {
 	//ak & sk
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
+	ufop.UfopCredentials
 
 	MkzipMaxFileLength int64 `json:"mkzip_max_file_length,omitempty"`
 	MkzipMaxFileCount  int   `json:"mkzip_max_file_count,omitempty"`
@@ -57,16 +49,16 @@ func (this *Mkzipper) Name() string {
 	return "mkzip"
 }
 
-func (this *Mkzipper) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open mkzip config failed, %s", openErr.Error()))
-		return
+func (this *Mkzipper) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"mkzip_max_file_length": this.maxFileLength,
+		"mkzip_max_file_count":  this.maxFileCount,
 	}
+}
 
+func (this *Mkzipper) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := MkzipperConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse mkzip config failed, %s", decodeErr.Error()))
 		return
@@ -84,67 +76,51 @@ func (this *Mkzipper) InitConfig(jobConf string) (err error) {
 		this.maxFileLength = config.MkzipMaxFileLength
 	}
 
-	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	if credErr := config.LoadCredentials(); credErr != nil {
+		err = errors.New(fmt.Sprintf("Load mkzip credentials failed, %s", credErr.Error()))
+		return
+	}
+	this.storage = storage.WithCredentials(config.AccessKey, config.SecretKey)
 
 	return
 }
 
-func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFiles []ZipFile, err error) {
-	pattern := "^mkzip/bucket/[0-9a-zA-Z-_=]+(/encoding/[0-9a-zA-Z-_=]+){0,1}(/url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1})+$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid mkzip command format")
-		return
-	}
+var mkzipParser = utils.NewCommandParser("mkzip",
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "encoding", Type: utils.PARAM_TYPE_BASE64},
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Required: true, Repeatable: true},
+	utils.ParamSpec{Name: "alias", Type: utils.PARAM_TYPE_BASE64, Follows: "url", Default: ""},
+)
 
-	var decodeErr error
-	//get bucket
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid mkzip paramter 'bucket'")
-		return
+//the files are read from the bucket
+func (this *Mkzipper) Buckets(cmd string) (read []string, write []string, err error) {
+	bucket, _, _, err := this.parse(cmd)
+	if err == nil {
+		read = []string{bucket}
 	}
-	//get encoding
-	encoding, decodeErr = utils.GetParamDecoded(cmd, "encoding/[0-9a-zA-Z-_=]+", "encoding")
-	if decodeErr != nil {
-		err = errors.New("invalid mkzip parameter 'encoding'")
+	return
+}
+
+func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFiles []ZipFile, err error) {
+	params, pErr := mkzipParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
+
+	bucket = params.String("bucket")
+	encoding = params.String("encoding")
+
 	//get url & alias
-	urlAliasRegx := regexp.MustCompile("url/[0-9a-zA-Z-_=]+(/alias/[0-9a-zA-Z-_=]+){0,1}")
-	urlAliasPairs := urlAliasRegx.FindAllString(cmd, -1)
+	aliases := params.Strings("alias")
 	paliasMap := make(map[string]string, 0)
-	for _, urlAliasPair := range urlAliasPairs {
-		urlAliasItems := strings.Split(urlAliasPair, "/")
+	for index, purl := range params.Strings("url") {
 		zipFile := ZipFile{}
-		var purl string
-		var palias string
+		palias := aliases[index]
 		var key string
-		switch len(urlAliasItems) {
-		case 2:
-			urlBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[1])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'url'")
-				return
-			}
-			purl = string(urlBytes)
-		case 4:
-			urlBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[1])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'url'")
-				return
-			}
-			aliasBytes, decodeErr := base64.URLEncoding.DecodeString(urlAliasItems[3])
-			if decodeErr != nil {
-				err = errors.New("invalid mkzip parameter 'alias'")
-				return
-			}
-			purl = string(urlBytes)
-			palias = string(aliasBytes)
-		}
 		uri, parseErr := url.Parse(purl)
 		if parseErr != nil {
-			err = errors.New("mkzip parameter 'url' format error")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "mkzip parameter 'url' format error")
 			return
 		}
 
@@ -159,11 +135,11 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 		}
 
 		if key == "" {
-			err = errors.New("invalid mkzip resource url")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "invalid mkzip resource url")
 			return
 		}
 		if _, ok := paliasMap[palias]; ok {
-			err = errors.New("duplicate mkzip resource alias")
+			err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "duplicate mkzip resource alias")
 			return
 		}
 		paliasMap[palias] = palias
@@ -177,7 +153,11 @@ func (this *Mkzipper) parse(cmd string) (bucket string, encoding string, zipFile
 	return
 }
 
-func (this *Mkzipper) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Mkzipper) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *Mkzipper) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
 	//parse command
 	bucket, encoding, zipFiles, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -187,105 +167,116 @@ func (this *Mkzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 
 	//check file count
 	if len(zipFiles) > this.maxFileCount {
-		err = errors.New("zip file count exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, "zip file count exceeds the limit")
 		return
 	}
 	if len(zipFiles) > MKZIP_MAX_FILE_LIMIT {
-		err = errors.New("only support items less than 1000")
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, "only support items less than 1000")
 		return
 	}
 	//check whether file in bucket and exceeds the limit
-	statItems := make([]rs.EntryPath, 0)
+	statItems := make([]ufop.UfopEntryPath, 0)
 	statUrls := make([]string, 0)
 	for _, zipFile := range zipFiles {
-		entryPath := rs.EntryPath{
-			bucket, zipFile.key,
+		entryPath := ufop.UfopEntryPath{
+			Bucket: bucket,
+			Key:    zipFile.key,
 		}
 		statItems = append(statItems, entryPath)
 		statUrls = append(statUrls, zipFile.url)
 	}
-	qclient := rs.New(this.mac)
-
-	statRet, statErr := qclient.BatchStat(nil, statItems)
-
+	statRet, statErr := this.storage.BatchStat(ctx, statItems)
 	if statErr != nil {
-		if _, ok := statErr.(*rpc.ErrorInfo); !ok {
-			err = errors.New(fmt.Sprintf("batch stat error, %s", statErr.Error()))
-			return
-		}
+		err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat error, %s", statErr.Error()))
+		return
 	}
 
 	for index := 0; index < len(statRet); index++ {
 		ret := statRet[index]
-		if ret.Code != 200 {
-			if ret.Code == 612 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
-			} else if ret.Code == 631 {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
+		if ret.Code != ufop.STORAGE_CODE_OK {
+			if ret.Code == ufop.STORAGE_CODE_NO_SUCH_FILE {
+				err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such file or directory", statUrls[index]))
+			} else if ret.Code == ufop.STORAGE_CODE_NO_SUCH_BUCKET {
+				err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such bucket", statUrls[index]))
 			} else {
-				err = errors.New(fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
+				err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat '%s' error, %d", statUrls[index], ret.Code))
 			}
 			return
 		}
 	}
 
-	//retrieve resource and create zip file
+	//convert encoding before streaming, so the error can still be reported
 	var tErr error
-	zipBuffer := new(bytes.Buffer)
-	zipWriter := zip.NewWriter(zipBuffer)
-
+	fnames := make([]string, 0, len(zipFiles))
 	for _, zipFile := range zipFiles {
-		//convert encoding
 		fname := zipFile.alias
 		if encoding == "gbk" {
 			fname, tErr = utils.Utf82Gbk(fname)
 			if tErr != nil {
-				err = errors.New(fmt.Sprintf("unsupported encoding gbk, %s", tErr))
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("unsupported encoding gbk, %s", tErr))
 				return
 			}
 		}
+		fnames = append(fnames, fname)
+	}
 
-		//create each zip file writer
-		fw, fErr := zipWriter.Create(fname)
-		if fErr != nil {
-			err = errors.New(fmt.Sprintf("create zip file error, %s", fErr))
-			return
-		}
-		//read data and write
-		resResp, respErr := http.Get(zipFile.url)
-		if respErr != nil || resResp.StatusCode != 200 {
-			if respErr != nil {
-				err = errors.New("get zip file resource error, " + respErr.Error())
-			} else {
-				err = errors.New(fmt.Sprintf("get zip file resource error, %s", resResp.Status))
-				if resResp.Body != nil {
-					resResp.Body.Close()
-				}
+	//retrieve resource and write zip file to the response directly
+	logger := req.Logger()
+	result.Body = ufop.UfopStreamWriter(func(w io.Writer) (err error) {
+		logger.Infof("start to zip %d files", len(zipFiles))
+		zipWriter := zip.NewWriter(w)
+
+		for index, zipFile := range zipFiles {
+			//create each zip file writer
+			fw, fErr := zipWriter.Create(fnames[index])
+			if fErr != nil {
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create zip file error, %s", fErr))
+				return
+			}
+			//read data and write, checked against the stat result
+			fetchCtx := utils.WithFetchOptions(ctx, utils.FetchOptions{
+				MaxBytes: this.maxFileLength,
+				Hash:     utils.StatHash(zipFile.url, statRet[index].Data.Hash),
+			})
+			resBody, _, getErr := this.storage.Get(fetchCtx, zipFile.url)
+			if getErr == utils.ErrFetchTooLarge {
+				err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "zip file length exceeds the limit")
+				return
+			}
+			if getErr != nil {
+				logger.Warnf("get zip file %s error, %s", logger.Redact("url", zipFile.url), getErr)
+				err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, "get zip file resource error, "+getErr.Error())
+				return
+			}
+			_, cpErr := io.Copy(fw, resBody)
+			resBody.Close()
+			if cpErr == utils.ErrFetchTooLarge {
+				err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "zip file length exceeds the limit")
+				return
+			}
+			if cpErr != nil {
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("write zip file content error, %s", cpErr))
+				return
+			}
+			//send each file to the client once it is zipped
+			if fErr := zipWriter.Flush(); fErr != nil {
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("write zip file content error, %s", fErr))
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
 			}
-			return
-		}
-		respData, readErr := ioutil.ReadAll(resResp.Body)
-		if readErr != nil {
-			err = errors.New(fmt.Sprintf("read zip file resource content error, %s", readErr))
-			return
 		}
-		resResp.Body.Close()
-
-		_, writeErr := fw.Write(respData)
-		if writeErr != nil {
-			err = errors.New(fmt.Sprintf("write zip file content error, %s", writeErr))
+		//close zip file
+		if cErr := zipWriter.Close(); cErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("close zip file error, %s", cErr))
 			return
 		}
-	}
-	//close zip file
-	if cErr := zipWriter.Close(); cErr != nil {
-		err = errors.New(fmt.Sprintf("close zip file error, %s", cErr))
+		logger.Infof("zip files done")
 		return
-	}
-
-	//write result
-	result = zipBuffer.Bytes()
-	resultType = ufop.RESULT_TYPE_OCTECT_BYTES
-	contentType = "application/zip"
+	})
+	result.Type = ufop.RESULT_TYPE_OCTECT_STREAM
+	result.MimeType = "application/zip"
+	result.Filename = "mkzip.zip"
 	return
 }
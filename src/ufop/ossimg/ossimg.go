@@ -2,18 +2,17 @@ package ossimg
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/qiniu/log"
 	"io"
-	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
 	"ufop"
+	"ufop/utils"
 )
 
 /*
@@ -46,6 +45,9 @@ const (
 
 const FONT_SIZE_FACTOR = 20
 
+//the imageInfo response is a small json
+const IMAGE_INFO_MAX_LENGTH = 64 * 1024
+
 var OSS_QINIU_GRAVITY = map[int]string{
 	1: "NorthWest",
 	2: "North",
@@ -213,16 +215,9 @@ func (this *OSSImager) Name() string {
 	return "ossimg"
 }
 
-func (this *OSSImager) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open ossimg config failed, %s", openErr.Error()))
-		return
-	}
-
+func (this *OSSImager) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := OSSImageConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse ossimg config failed, %s", decodeErr.Error()))
 		return
@@ -236,11 +231,13 @@ func (this *OSSImager) InitConfig(jobConf string) (err error) {
 /**
 juju-ossimg/jujucommentpic@4.png@960w_90Q_1l.jpg
 */
-func (this *OSSImager) parse(cmd string, operations *[]OSSImageOperation) (bucket, path string, err error) {
+//the command is the rewritten aliyun oss image url, <bucket>@<path>@<operations>,
+//not in the <param>/<value> format of utils.CommandParser, so it is parsed here
+func (this *OSSImager) parse(cmd string, operations *[]OSSImageOperation, logger *ufop.UfopLogger) (bucket, path string, err error) {
 	cmdParam := strings.TrimPrefix(strings.TrimPrefix(cmd, this.Name()), "/")
 	items := strings.Split(cmdParam, "@")
 	if len(items) < 2 {
-		err = errors.New("invalid rewrite url")
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "invalid rewrite url")
 		return
 	}
 
@@ -251,7 +248,7 @@ func (this *OSSImager) parse(cmd string, operations *[]OSSImageOperation) (bucke
 	for _, operStr := range operStrItems {
 		if strings.HasPrefix(operStr, "watermark") {
 			//watermark operation
-			operation := this.parseWatermarkOperation(operStr)
+			operation := this.parseWatermarkOperation(operStr, logger)
 			*operations = append(*operations, operation)
 		} else {
 			//image operation
@@ -263,9 +260,10 @@ func (this *OSSImager) parse(cmd string, operations *[]OSSImageOperation) (bucke
 	return
 }
 
-func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *OSSImager) Do(req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	logger := req.Logger()
 	operations := make([]OSSImageOperation, 0)
-	bucket, path, pErr := this.parse(req.Cmd, &operations)
+	bucket, path, pErr := this.parse(req.Cmd, &operations, logger)
 	if pErr != nil {
 		err = pErr
 		return
@@ -274,7 +272,7 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 	var srcDomain string
 	var cdnDomain string
 	if v, ok := this.domainMapping[bucket]; !ok {
-		err = errors.New("invalid bucket specified")
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "invalid bucket specified")
 		return
 	} else {
 		srcDomain = v.SrcDomain
@@ -282,12 +280,12 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 	}
 
 	if srcDomain == "" {
-		err = errors.New("invalid src domain")
+		err = ufop.NewUfopError(ufop.ERROR_INTERNAL, "invalid src domain")
 		return
 	}
 
 	if cdnDomain == "" {
-		err = errors.New("invalid cdn domain")
+		err = ufop.NewUfopError(ufop.ERROR_INTERNAL, "invalid cdn domain")
 		return
 	}
 
@@ -298,7 +296,7 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 		var fop string
 		switch oper.Name {
 		case OSS_OPER_IMAGE:
-			fop = this.formatQiniuImageFop(oper, srcDomain, path)
+			fop = this.formatQiniuImageFop(oper, srcDomain, path, logger)
 		case OSS_OPER_WATERMARK:
 			fop = this.formatQiniuWatermarkFop(oper, cdnDomain)
 		}
@@ -312,12 +310,12 @@ func (this *OSSImager) Do(req ufop.UfopRequest) (result interface{}, resultType
 		}
 	}
 
-	result = qiniuUrl
-	resultType = ufop.RESULT_TYPE_OCTECT_URL
+	result.Type = ufop.RESULT_TYPE_OCTECT_URL
+	result.Body = qiniuUrl
 
 	//for debug
-	//result = []byte(qiniuUrl)
-	//resultType = ufop.RESULT_TYPE_OCTECT_BYTES
+	//result.Type = ufop.RESULT_TYPE_OCTECT_BYTES
+	//result.Body = []byte(qiniuUrl)
 	return
 }
 
@@ -472,7 +470,7 @@ func (this *OSSImager) scanImageParamInt(cmd string, tag string, pattern string)
 }
 
 //get watermark operation parameters
-func (this *OSSImager) parseWatermarkOperation(oper string) (operation OSSImageOperation) {
+func (this *OSSImager) parseWatermarkOperation(oper string, logger *ufop.UfopLogger) (operation OSSImageOperation) {
 	paramItems := strings.Split(oper, "&")
 	params := map[string]string{}
 	for _, paramItem := range paramItems {
@@ -490,21 +488,21 @@ func (this *OSSImager) parseWatermarkOperation(oper string) (operation OSSImageO
 	operation.WMType = this.wmInt(params["watermark"])
 
 	//wmText
-	operation.WMText = this.wmBase64Decode("text", params["text"])
+	operation.WMText = this.wmBase64Decode("text", params["text"], logger)
 	//wmFontType
-	operation.WMFontType = this.wmBase64Decode("type", params["type"])
+	operation.WMFontType = this.wmBase64Decode("type", params["type"], logger)
 	//wmFontColor
-	operation.WMFontColor = this.wmBase64Decode("color", params["color"])
+	operation.WMFontColor = this.wmBase64Decode("color", params["color"], logger)
 
 	//wmFontSize
 	if wmFontSize, pErr := strconv.Atoi(params["size"]); pErr != nil {
-		log.Error(fmt.Sprintf("invalid watermark font size, '%s'", params["size"]))
+		logger.Warnf("invalid watermark font size, '%s'", params["size"])
 	} else {
 		operation.WMFontSize = wmFontSize
 	}
 
 	//wmImage
-	operation.WMImage = this.wmBase64Decode("object", params["object"])
+	operation.WMImage = this.wmBase64Decode("object", params["object"], logger)
 
 	//position
 	operation.WMGravity = this.wmInt(params["p"])
@@ -539,7 +537,7 @@ func (this *OSSImager) wmInt(value string) (result int) {
 	return
 }
 
-func (this *OSSImager) wmBase64Decode(key string, value string) (result string) {
+func (this *OSSImager) wmBase64Decode(key string, value string, logger *ufop.UfopLogger) (result string) {
 	fLen := len(value)
 	toDecodeStr := value
 	if (fLen+1)*6%8 == 0 {
@@ -550,7 +548,7 @@ func (this *OSSImager) wmBase64Decode(key string, value string) (result string)
 
 	resultBytes, pErr := base64.URLEncoding.DecodeString(toDecodeStr)
 	if pErr != nil {
-		log.Error(fmt.Sprintf("invalid watermark base64 param value for '%s'", key))
+		logger.Warnf("invalid watermark base64 param value for '%s'", key)
 	}
 
 	result = string(resultBytes)
@@ -560,10 +558,12 @@ func (this *OSSImager) wmBase64Decode(key string, value string) (result string)
 /*
 get image width or height
 */
-func (this *OSSImager) getImageInfo(imageUrl string) (imageInfo *ImageInfo, err error) {
+func (this *OSSImager) getImageInfo(imageUrl string, logger *ufop.UfopLogger) (imageInfo *ImageInfo, err error) {
 	imageInfoUrl := fmt.Sprintf("%s?imageInfo", imageUrl)
-	log.Debug(imageInfoUrl)
-	resp, respErr := http.Get(imageInfoUrl)
+	//the image url is hidden like the src url if redacted
+	logger.Infof("get image info, %s", logger.Redact("src", imageInfoUrl))
+	resp, respErr := utils.DefaultFetcher().Open(context.Background(), imageInfoUrl,
+		utils.FetchOptions{MaxBytes: IMAGE_INFO_MAX_LENGTH})
 	if respErr != nil {
 		err = respErr
 		return
@@ -584,12 +584,13 @@ func (this *OSSImager) getImageInfo(imageUrl string) (imageInfo *ImageInfo, err
 	return
 }
 
-func (this *OSSImager) formatQiniuImageFop(oper OSSImageOperation, srcDomain string, path string) (qFop string) {
+func (this *OSSImager) formatQiniuImageFop(oper OSSImageOperation, srcDomain string, path string,
+	logger *ufop.UfopLogger) (qFop string) {
 	srcUrl := fmt.Sprintf("%s%s", srcDomain, path)
 
-	imageInfo, gErr := this.getImageInfo(srcUrl)
+	imageInfo, gErr := this.getImageInfo(srcUrl, logger)
 	if gErr != nil {
-		log.Error("get image info error", gErr.Error())
+		logger.Errorf("get image info error, %s", gErr.Error())
 		return
 	}
 
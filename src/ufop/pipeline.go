@@ -0,0 +1,198 @@
+package ufop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"ufop/utils"
+)
+
+//fops in one command are chained by '|', like
+//html2image/url/<encoded url>|roundpic/radius/20
+const PIPELINE_SEPARATOR = "|"
+
+//wait for the slot of the fop and set its deadline, release is called when
+//the result of the fop is consumed
+type fopStarter func(ctx context.Context, fop string) (fopCtx context.Context, release func(), err error)
+
+//the first fop of the command
+func cmdFop(cmd string) string {
+	if index := strings.IndexAny(cmd, "/"+PIPELINE_SEPARATOR); index != -1 {
+		return cmd[:index]
+	}
+	return cmd
+}
+
+//run the fops one by one, the result of each fop is the src of the next one,
+//each fop holds its own slot and deadline until its result is saved as the
+//src of the next one, the intermediate results are removed when the final
+//result is written
+func handlePipeline(ctx context.Context, ufopReq UfopRequest, ufopPrefix string,
+	jobHandlers map[string]UfopJobHandler, start fopStarter) (result UfopResult, err error) {
+	cmds := strings.Split(ufopReq.Cmd, PIPELINE_SEPARATOR)
+	for _, cmd := range cmds {
+		if _, ok := jobHandlers[cmdFop(cmd)]; !ok {
+			err = NewUfopError(ERROR_NO_FOP, fmt.Sprintf("no fop available for '%s' in the pipeline", cmdFop(cmd)))
+			return
+		}
+	}
+
+	cleanups := make([]func(), 0, len(cmds)-1)
+	cleanup := func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+
+	stageReq := ufopReq
+	for index, cmd := range cmds {
+		stageReq.Cmd = cmd
+		fopCtx, release, sErr := start(ctx, cmdFop(cmd))
+		if sErr != nil {
+			err = stageUfopError(cmd, sErr)
+			cleanup()
+			return
+		}
+		result, err = handleFop(fopCtx, stageReq, ufopPrefix, jobHandlers)
+		if err != nil {
+			release()
+			err = stageUfopError(cmd, err)
+			cleanup()
+			return
+		}
+		if index == len(cmds)-1 {
+			result = releaseAfterWritten(result, err, release)
+			break
+		}
+
+		src, srcCleanup, srcErr := pipeSrc(fopCtx, ufopReq.scratch, result)
+		if srcErr != nil && fopCtx.Err() != nil {
+			srcErr = contextUfopError(fopCtx)
+		}
+		release()
+		cleanups = append(cleanups, srcCleanup)
+		if srcErr != nil {
+			err = stageUfopError(cmd, srcErr)
+			cleanup()
+			return
+		}
+		stageReq.Src = src
+	}
+
+	//the stream may still read the intermediate results
+	if result.Type == RESULT_TYPE_OCTECT_STREAM {
+		if stream := toStreamWriter(result.Body); stream != nil {
+			result.Body = UfopStreamWriter(func(w io.Writer) error {
+				defer cleanup()
+				return stream(w)
+			})
+			return
+		}
+	}
+	cleanup()
+	return
+}
+
+//the error of the fop in the pipeline, with the code of the fop error
+func stageUfopError(cmd string, err error) *UfopError {
+	ufopErr := WrapUfopError(ERROR_FOP_FAILED, err)
+	return NewUfopError(ufopErr.Code, fmt.Sprintf("fop '%s' in the pipeline failed, %s", cmdFop(cmd), ufopErr.Message))
+}
+
+//release the slot of the fop when the result is consumed, at once unless
+//the result is a stream, which is run when written
+func releaseAfterWritten(result UfopResult, err error, release func()) UfopResult {
+	if err == nil && result.Type == RESULT_TYPE_OCTECT_STREAM {
+		if stream := toStreamWriter(result.Body); stream != nil {
+			result.Body = UfopStreamWriter(func(w io.Writer) error {
+				defer release()
+				return stream(w)
+			})
+			return result
+		}
+	}
+	release()
+	return result
+}
+
+//turn the fop result into the src of the next fop, saved in the scratch dir
+//so the next fop gets its real size, the url results are downloaded
+func pipeSrc(ctx context.Context, scratch *UfopScratch, result UfopResult) (src UfopRequestSrc, cleanup func(), err error) {
+	cleanup = func() {}
+	src.MimeType = result.MimeType
+
+	var localPath string
+	switch result.Type {
+	case RESULT_TYPE_JSON:
+		err = NewUfopError(ERROR_BAD_COMMAND, "json result can not be the src of the next fop")
+		return
+	case RESULT_TYPE_OCTECT_FILE:
+		localPath, _ = result.Body.(string)
+	case RESULT_TYPE_OCTECT_BYTES, RESULT_TYPE_OCTECT_STREAM, RESULT_TYPE_OCTECT_URL:
+		tmpFp, tmpErr := scratch.CreateTemp("ufop_pipe_")
+		if tmpErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("open pipeline temp file failed, %s", tmpErr.Error()))
+			return
+		}
+		localPath = tmpFp.Name()
+
+		var wErr error
+		switch result.Type {
+		case RESULT_TYPE_OCTECT_BYTES:
+			data, _ := result.Body.([]byte)
+			_, wErr = tmpFp.Write(data)
+		case RESULT_TYPE_OCTECT_STREAM:
+			if stream := toStreamWriter(result.Body); stream != nil {
+				wErr = stream(tmpFp)
+			}
+		case RESULT_TYPE_OCTECT_URL:
+			var mimeType string
+			mimeType, wErr = downloadPipeSrc(ctx, result, tmpFp)
+			if src.MimeType == "" {
+				src.MimeType = mimeType
+			}
+		}
+		tmpFp.Close()
+		if wErr != nil {
+			os.Remove(localPath)
+			err = WrapUfopError(ERROR_PROCESS_FAILED, wErr)
+			return
+		}
+	}
+
+	cleanup = func() {
+		os.Remove(localPath)
+	}
+	stat, statErr := os.Stat(localPath)
+	if statErr != nil {
+		err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("stat pipeline temp file failed, %s", statErr.Error()))
+		return
+	}
+
+	pipeUrl, unregister := utils.RegisterPipeFile(localPath, src.MimeType)
+	src.Url = pipeUrl
+	src.Fsize = uint64(stat.Size())
+	cleanup = func() {
+		unregister()
+		os.Remove(localPath)
+	}
+	return
+}
+
+//download the url result, the mime type of the response is returned
+func downloadPipeSrc(ctx context.Context, result UfopResult, w io.Writer) (mimeType string, err error) {
+	resUrl, _ := result.Body.(string)
+	resp, respErr := utils.DefaultFetcher().Open(ctx, resUrl, utils.FetchOptions{})
+	if respErr != nil {
+		err = NewUfopError(ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get pipeline result '%s' failed, %s", resUrl, respErr.Error()))
+		return
+	}
+	defer resp.Body.Close()
+	mimeType = resp.MimeType
+	if _, cpErr := io.Copy(w, resp.Body); cpErr != nil {
+		err = NewUfopError(ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get pipeline result '%s' failed, %s", resUrl, cpErr.Error()))
+	}
+	return
+}
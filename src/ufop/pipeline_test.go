@@ -0,0 +1,100 @@
+package ufop_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"ufop"
+	"ufop/html2pdf"
+	"ufop/mkzip"
+	"ufop/ossimg"
+	"ufop/unzip"
+	"ufop/utils"
+)
+
+func TestPipeline(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	env.register(&unzip.Unzipper{}, map[string]interface{}{})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	mkzipCmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA)
+	unzipCmd := testPrefix + "unzip/bucket/" + encode(testBucket) + "/prefix/" + encode("out/")
+
+	//the zip stream is the src of unzip
+	w := env.do(mkzipCmd+"|"+unzipCmd, ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+	if file, _ := env.fake.GetFile(testBucket, "out/a.txt"); string(file.Data) != "hello" {
+		t.Fatalf("unexpected pipeline result %s", w.Body.String())
+	}
+
+	w = env.do(mkzipCmd+"|"+testPrefix+"none", ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_NO_FOP, "no fop available for 'qn-none' in the pipeline")
+
+	w = env.do(mkzipCmd+"|"+unzipCmd+"|"+testPrefix+mkzipCmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_BAD_COMMAND,
+		"fop 'qn-unzip' in the pipeline failed, json result can not be the src of the next fop")
+}
+
+func TestPipelineLimits(t *testing.T) {
+	env := newTestEnv(t)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	env.register(&ossimg.OSSImager{}, map[string]interface{}{
+		"mapping": map[string]interface{}{
+			"oss-bucket":  map[string]string{"src_domain": env.fake.Domain(testBucket), "cdn_domain": env.fake.Domain(testBucket)},
+			"slow-bucket": map[string]string{"src_domain": slow.URL, "cdn_domain": slow.URL},
+		},
+	})
+	env.register(&html2pdf.Html2Pdfer{}, map[string]interface{}{
+		"html2pdf_max_page_size": 1024,
+	})
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	page := env.src("page.html", []byte("<html></html>"), "text/html")
+	html2pdfCmd := testPrefix + "html2pdf/url/" + encode(page.Url)
+
+	//the url result is downloaded, its real size is checked by the next fop
+	env.fake.PutFile(testBucket, "large.html", make([]byte, 2048), "text/html")
+	w := env.do("ossimg/oss-bucket@large.html|"+html2pdfCmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 413, ufop.ERROR_SRC_TOO_LARGE,
+		"fop 'qn-html2pdf' in the pipeline failed, page file length exceeds the limit")
+
+	//each fop has its own deadline, not the one of the first fop
+	env.setPolicy("ossimg", func(handlerCfg *ufop.UfopHandlerConfig) {
+		handlerCfg.Timeout = 1
+	})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	mkzipCmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA)
+	w = env.do(mkzipCmd+"|"+testPrefix+"ossimg/slow-bucket@page.html|"+html2pdfCmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 504, ufop.ERROR_JOB_TIMEOUT,
+		"fop 'qn-ossimg' in the pipeline failed, job cancelled, deadline exceeded")
+}
+
+func TestPipeFile(t *testing.T) {
+	path := t.TempDir() + "/result.png"
+	ioutil.WriteFile(path, []byte("png"), 0644)
+	pipeUrl, unregister := utils.RegisterPipeFile(path, "image/png")
+
+	resp, err := utils.DefaultFetcher().Open(context.Background(), pipeUrl, utils.FetchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "png" || resp.MimeType != "image/png" || resp.ContentLength != 3 {
+		t.Fatalf("unexpected pipe file %q %s %d", data, resp.MimeType, resp.ContentLength)
+	}
+
+	//the unregistered files can not be read
+	unregister()
+	if _, err := utils.DefaultFetcher().Open(context.Background(), pipeUrl, utils.FetchOptions{}); err == nil {
+		t.Fatal("unregistered pipe file read")
+	}
+}
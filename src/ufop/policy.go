@@ -0,0 +1,236 @@
+package ufop
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the kinds of the policy keys
+const (
+	POLICY_KEY_BUCKET = "bucket"
+	POLICY_KEY_FOP    = "fop"
+	POLICY_KEY_CALLER = "caller"
+)
+
+//the rate limit and the daily quota of a bucket, a fop or a caller
+type UfopRateLimit struct {
+	//jobs per second and the burst of them, rate <= 0 means no limit, the
+	//burst is at least 1
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	//bytes fetched by the jobs per day in utc, <= 0 means no quota
+	DailyBytes int64 `json:"daily_bytes,omitempty"`
+}
+
+//the bucket, the fop or the caller the job is limited by
+type policyKey struct {
+	kind  string
+	name  string
+	limit UfopRateLimit
+}
+
+func (this policyKey) String() string {
+	return fmt.Sprintf("%s '%s'", this.kind, this.name)
+}
+
+//the token bucket and the bytes of the day of a key
+type policyCounter struct {
+	tokens float64
+	last   time.Time
+	day    string
+	bytes  int64
+}
+
+//the state of the rate limits and the quotas, the limits are given by the
+//config in use on each check, so the counters are kept on reload
+type UfopPolicy struct {
+	lock     sync.Mutex
+	counters map[string]*policyCounter
+	now      func() time.Time
+}
+
+func NewPolicy() *UfopPolicy {
+	return &UfopPolicy{
+		counters: make(map[string]*policyCounter),
+		now:      time.Now,
+	}
+}
+
+//the buckets of the job, checked against the read and write buckets of the
+//handler config, empty means any bucket
+func checkBuckets(name string, handlerCfg UfopHandlerConfig, read, write []string) (err error) {
+	for _, bucket := range read {
+		if len(handlerCfg.ReadBuckets) > 0 && !containsString(handlerCfg.ReadBuckets, bucket) {
+			err = NewUfopError(ERROR_BUCKET_FORBIDDEN, fmt.Sprintf("fop '%s' not allowed to read bucket '%s'", name, bucket))
+			return
+		}
+	}
+	for _, bucket := range write {
+		if len(handlerCfg.WriteBuckets) > 0 && !containsString(handlerCfg.WriteBuckets, bucket) {
+			err = NewUfopError(ERROR_BUCKET_FORBIDDEN, fmt.Sprintf("fop '%s' not allowed to write bucket '%s'", name, bucket))
+			return
+		}
+	}
+	return
+}
+
+//take a token of each key, none is taken if any key is limited, the error
+//tells when to retry
+func (this *UfopPolicy) take(keys []policyKey) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.now()
+	day := now.UTC().Format("2006-01-02")
+	counters := make([]*policyCounter, len(keys))
+	for index, key := range keys {
+		counter := this.counter(key, now)
+		counters[index] = counter
+		if counter.day != day {
+			counter.day = day
+			counter.bytes = 0
+		}
+		if key.limit.DailyBytes > 0 && counter.bytes >= key.limit.DailyBytes {
+			tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			err = policyUfopError(ERROR_QUOTA_EXCEEDED, fmt.Sprintf("daily byte quota of %s exceeded", key),
+				tomorrow.Sub(now))
+			return
+		}
+		if key.limit.Rate > 0 {
+			burst := float64(maxInt(key.limit.Burst, 1))
+			counter.tokens = math.Min(burst, counter.tokens+now.Sub(counter.last).Seconds()*key.limit.Rate)
+			counter.last = now
+			if counter.tokens < 1 {
+				wait := time.Duration((1 - counter.tokens) / key.limit.Rate * float64(time.Second))
+				err = policyUfopError(ERROR_RATE_LIMITED, fmt.Sprintf("rate limit of %s exceeded", key), wait)
+				return
+			}
+		}
+	}
+	for index, key := range keys {
+		if key.limit.Rate > 0 {
+			counters[index].tokens -= 1
+		}
+	}
+	return
+}
+
+//count the bytes fetched by the job to the quotas of the keys
+func (this *UfopPolicy) addBytes(keys []policyKey, n int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	now := this.now()
+	day := now.UTC().Format("2006-01-02")
+	for _, key := range keys {
+		if key.limit.DailyBytes <= 0 {
+			continue
+		}
+		counter := this.counter(key, now)
+		if counter.day != day {
+			counter.day = day
+			counter.bytes = 0
+		}
+		counter.bytes += n
+	}
+}
+
+//the counter is created full
+func (this *UfopPolicy) counter(key policyKey, now time.Time) *policyCounter {
+	id := key.kind + ":" + key.name
+	counter, ok := this.counters[id]
+	if !ok {
+		counter = &policyCounter{
+			tokens: float64(maxInt(key.limit.Burst, 1)),
+			last:   now,
+		}
+		this.counters[id] = counter
+	}
+	return counter
+}
+
+//the keys limiting the job, the fops of the pipeline, the buckets they use
+//and the caller, the buckets are checked against the handler configs
+func policyKeys(cfg *UfopConfig, jobHandlers map[string]UfopJobHandler, ufopReq UfopRequest) (keys []policyKey, err error) {
+	fopCmd, saveasBucket, _, saveas, saveasErr := parseSaveas(ufopReq.Cmd)
+	if saveasErr != nil {
+		//reported when the job runs
+		saveas = false
+	}
+
+	buckets := make(map[string]bool)
+	fops := make(map[string]bool)
+	cmds := strings.Split(fopCmd, PIPELINE_SEPARATOR)
+	for index, cmd := range cmds {
+		fop := cmdFop(cmd)
+		jobHandler, ok := jobHandlers[fop]
+		if !ok {
+			continue
+		}
+		name := strings.TrimPrefix(fop, cfg.UfopPrefix)
+		handlerCfg := cfg.Handlers[name]
+		var read, write []string
+		if bucketUser, ok := jobHandler.(UfopBucketUser); ok {
+			//the bad commands are reported by the handler
+			read, write, _ = bucketUser.Buckets(strings.TrimPrefix(cmd, cfg.UfopPrefix))
+		}
+		//the result of the last fop is saved by saveas
+		if saveas && index == len(cmds)-1 {
+			write = append(write, saveasBucket)
+		}
+		if err = checkBuckets(name, handlerCfg, read, write); err != nil {
+			return
+		}
+		for _, bucket := range append(read, write...) {
+			buckets[bucket] = true
+		}
+		if (handlerCfg.Rate > 0 || handlerCfg.DailyBytes > 0) && !fops[name] {
+			fops[name] = true
+			keys = append(keys, policyKey{POLICY_KEY_FOP, name, handlerCfg.UfopRateLimit})
+		}
+	}
+
+	bucketNames := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		bucketNames = append(bucketNames, bucket)
+	}
+	sort.Strings(bucketNames)
+	for _, bucket := range bucketNames {
+		if limit, ok := cfg.BucketLimits[bucket]; ok {
+			keys = append(keys, policyKey{POLICY_KEY_BUCKET, bucket, limit})
+		}
+	}
+	if limit, ok := cfg.CallerLimits[ufopReq.caller]; ok && ufopReq.caller != "" {
+		keys = append(keys, policyKey{POLICY_KEY_CALLER, ufopReq.caller, limit})
+	}
+	return
+}
+
+//the error with the seconds to retry, at least 1
+func policyUfopError(code, message string, wait time.Duration) *UfopError {
+	ufopErr := NewUfopError(code, message)
+	ufopErr.RetryAfter = int(math.Ceil(wait.Seconds()))
+	if ufopErr.RetryAfter < 1 {
+		ufopErr.RetryAfter = 1
+	}
+	return ufopErr
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package ufop_test
+
+import (
+	"image/color"
+	"testing"
+	"ufop"
+	"ufop/imagecomp"
+	"ufop/mkzip"
+)
+
+//set the bucket and rate settings of the registered handler
+func (this *testEnv) setPolicy(name string, update func(handlerCfg *ufop.UfopHandlerConfig)) {
+	handlerCfg := this.cfg.Handlers[name]
+	update(&handlerCfg)
+	this.cfg.Handlers[name] = handlerCfg
+}
+
+func TestPolicyBuckets(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA)
+
+	env.setPolicy("mkzip", func(handlerCfg *ufop.UfopHandlerConfig) {
+		handlerCfg.ReadBuckets = []string{"other"}
+	})
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 403, ufop.ERROR_BUCKET_FORBIDDEN, "fop 'mkzip' not allowed to read bucket '"+testBucket+"'")
+
+	//the saveas bucket is written by the fop
+	env.setPolicy("mkzip", func(handlerCfg *ufop.UfopHandlerConfig) {
+		handlerCfg.ReadBuckets = []string{testBucket}
+		handlerCfg.WriteBuckets = []string{testBucket}
+	})
+	expectStatus(t, env.do(cmd, ufop.UfopRequestSrc{}), 200)
+	w = env.do(cmd+"/saveas/"+encode("other:out.zip"), ufop.UfopRequestSrc{})
+	expectError(t, w, 403, ufop.ERROR_BUCKET_FORBIDDEN, "fop 'mkzip' not allowed to write bucket 'other'")
+}
+
+func TestPolicyRateLimit(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	env.register(&imagecomp.ImageComposer{}, map[string]interface{}{})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	mkzipCmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA)
+
+	env.setPolicy("mkzip", func(handlerCfg *ufop.UfopHandlerConfig) {
+		handlerCfg.Rate = 0.01
+		handlerCfg.Burst = 2
+	})
+	expectStatus(t, env.do(mkzipCmd, ufop.UfopRequestSrc{}), 200)
+	expectStatus(t, env.do(mkzipCmd, ufop.UfopRequestSrc{}), 200)
+	w := env.do(mkzipCmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 429, ufop.ERROR_RATE_LIMITED, "rate limit of fop 'mkzip' exceeded")
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "100" {
+		t.Fatalf("unexpected retry after %q", retryAfter)
+	}
+
+	//the bucket is shared by the fops
+	env.setPolicy("mkzip", func(handlerCfg *ufop.UfopHandlerConfig) {
+		handlerCfg.Rate = 0
+	})
+	env.cfg.BucketLimits = map[string]ufop.UfopRateLimit{testBucket: {Rate: 0.01}}
+	expectStatus(t, env.do(mkzipCmd, ufop.UfopRequestSrc{}), 200)
+	tileUrl := env.fake.PutFile(testBucket, "tile.png", makePng(t, 10, 10, color.RGBA{0xFF, 0, 0, 0xFF}), "image/png")
+	w = env.do("imagecomp/bucket/"+encode(testBucket)+"/url/"+encode(tileUrl), ufop.UfopRequestSrc{})
+	expectError(t, w, 429, ufop.ERROR_RATE_LIMITED, "rate limit of bucket '"+testBucket+"' exceeded")
+}
+
+func TestPolicyDailyQuota(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{})
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA)
+
+	env.cfg.BucketLimits = map[string]ufop.UfopRateLimit{testBucket: {DailyBytes: 8}}
+	expectStatus(t, env.do(cmd, ufop.UfopRequestSrc{}), 200)
+	expectStatus(t, env.do(cmd, ufop.UfopRequestSrc{}), 200)
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 429, ufop.ERROR_QUOTA_EXCEEDED, "daily byte quota of bucket '"+testBucket+"' exceeded")
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("no retry after")
+	}
+}
+
+func TestPolicyCaller(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.AuthType = ufop.AUTH_TYPE_HMAC
+	env.cfg.AuthKeys = []ufop.UfopCredentials{
+		{AccessKey: "caller-a", SecretKey: "secret-a"},
+		{AccessKey: "caller-b", SecretKey: "secret-b"},
+	}
+	env.cfg.CallerLimits = map[string]ufop.UfopRateLimit{"caller-a": {Rate: 0.01}}
+	env.serv = ufop.NewServer(env.cfg)
+	body := `{"cmd":"qn-none"}`
+
+	req := newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	expectError(t, serveAuth(env, req), 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-a", "secret-a")
+	expectError(t, serveAuth(env, req), 429, ufop.ERROR_RATE_LIMITED, "rate limit of caller 'caller-a' exceeded")
+
+	req = newAuthRequest(body)
+	ufop.SignRequest(req, []byte(body), "caller-b", "secret-b")
+	expectError(t, serveAuth(env, req), 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+}
@@ -0,0 +1,187 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/qiniu/api.v6/auth/digest"
+	fio "github.com/qiniu/api.v6/io"
+	rio "github.com/qiniu/api.v6/resumable/io"
+	"github.com/qiniu/api.v6/rs"
+	"github.com/qiniu/rpc"
+	"io"
+	"sync"
+)
+
+var qiniuSettingsOnce sync.Once
+
+//the buckets of qiniu, the resources are read by their urls
+type QiniuStorage struct {
+	mac *digest.Mac
+}
+
+func NewQiniuStorage(accessKey, secretKey string) *QiniuStorage {
+	qiniuSettingsOnce.Do(func() {
+		rputSettings := rio.Settings{
+			ChunkSize: 4 * 1024 * 1024,
+			Workers:   8,
+		}
+		rio.SetSettings(&rputSettings)
+	})
+	return &QiniuStorage{
+		mac: &digest.Mac{AccessKey: accessKey, SecretKey: []byte(secretKey)},
+	}
+}
+
+func (this *QiniuStorage) WithCredentials(accessKey, secretKey string) UfopStorage {
+	if accessKey == "" || secretKey == "" {
+		return this
+	}
+	return NewQiniuStorage(accessKey, secretKey)
+}
+
+func (this *QiniuStorage) checkMac() error {
+	if this.mac.AccessKey == "" || len(this.mac.SecretKey) == 0 {
+		return errors.New("no access key configured")
+	}
+	return nil
+}
+
+//keep the message of the service only
+func qiniuError(err error) error {
+	if v, ok := err.(*rpc.ErrorInfo); ok {
+		return errors.New(v.Err)
+	}
+	return err
+}
+
+func (this *QiniuStorage) Stat(ctx context.Context, bucket, key string) (entry UfopEntry, err error) {
+	if err = this.checkMac(); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	rsEntry, statErr := rs.New(this.mac).Stat(nil, bucket, key)
+	if statErr != nil {
+		err = qiniuError(statErr)
+		return
+	}
+	entry = UfopEntry{
+		Hash:     rsEntry.Hash,
+		Fsize:    rsEntry.Fsize,
+		PutTime:  rsEntry.PutTime,
+		MimeType: rsEntry.MimeType,
+	}
+	return
+}
+
+func (this *QiniuStorage) BatchStat(ctx context.Context, entries []UfopEntryPath) (statRet []UfopStatResult, err error) {
+	if err = this.checkMac(); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	statItems := make([]rs.EntryPath, 0, len(entries))
+	for _, entry := range entries {
+		statItems = append(statItems, rs.EntryPath{Bucket: entry.Bucket, Key: entry.Key})
+	}
+
+	rsRet, statErr := rs.New(this.mac).BatchStat(nil, statItems)
+	//the batch api returns error if any item fails, the items tell the details
+	if statErr != nil {
+		if _, ok := statErr.(*rpc.ErrorInfo); !ok || len(rsRet) != len(entries) {
+			err = qiniuError(statErr)
+			return
+		}
+	}
+
+	statRet = make([]UfopStatResult, 0, len(rsRet))
+	for _, ret := range rsRet {
+		statRet = append(statRet, UfopStatResult{
+			Data: UfopEntry{
+				Hash:     ret.Data.Hash,
+				Fsize:    ret.Data.Fsize,
+				PutTime:  ret.Data.PutTime,
+				MimeType: ret.Data.MimeType,
+			},
+			Error: ret.Error,
+			Code:  ret.Code,
+		})
+	}
+	return
+}
+
+func (this *QiniuStorage) Get(ctx context.Context, resUrl string) (body io.ReadCloser, mimeType string, err error) {
+	return httpGet(ctx, resUrl)
+}
+
+func (this *QiniuStorage) uptoken(bucket, key string, extra *UfopPutExtra) string {
+	policy := rs.PutPolicy{
+		Scope: bucket,
+	}
+	if extra != nil && extra.Overwrite {
+		policy.Scope = fmt.Sprintf("%s:%s", bucket, key)
+	}
+	policy.Expires = 24 * 3600 //24 hours
+	return policy.Token(this.mac)
+}
+
+func (this *QiniuStorage) Put(ctx context.Context, bucket, key string, data io.Reader,
+	extra *UfopPutExtra) (putRet UfopPutResult, err error) {
+	if err = this.checkMac(); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var fputExtra *fio.PutExtra
+	if extra != nil && extra.MimeType != "" {
+		fputExtra = &fio.PutExtra{
+			MimeType: extra.MimeType,
+		}
+	}
+
+	var fputRet fio.PutRet
+	if putErr := fio.Put(nil, &fputRet, this.uptoken(bucket, key, extra), key, data, fputExtra); putErr != nil {
+		err = qiniuError(putErr)
+		return
+	}
+	putRet = UfopPutResult{
+		Hash: fputRet.Hash,
+		Key:  fputRet.Key,
+	}
+	return
+}
+
+func (this *QiniuStorage) PutResumable(ctx context.Context, bucket, key string, data io.ReaderAt, fsize int64,
+	extra *UfopPutExtra) (putRet UfopPutResult, err error) {
+	if err = this.checkMac(); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var rputExtra *rio.PutExtra
+	if extra != nil && extra.MimeType != "" {
+		rputExtra = &rio.PutExtra{
+			MimeType: extra.MimeType,
+		}
+	}
+
+	var rputRet rio.PutRet
+	if putErr := rio.Put(nil, &rputRet, this.uptoken(bucket, key, extra), key, data, fsize, rputExtra); putErr != nil {
+		err = qiniuError(putErr)
+		return
+	}
+	putRet = UfopPutResult{
+		Hash: rputRet.Hash,
+		Key:  rputRet.Key,
+	}
+	return
+}
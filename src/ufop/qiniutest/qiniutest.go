@@ -0,0 +1,588 @@
+package qiniutest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/qiniu/api.v6/conf"
+	"hash/crc32"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"ufop/utils"
+)
+
+//the stand-in of the qiniu service for the tests, the rs api (stat, batch),
+//the up api (form upload, mkblk, bput, mkfile) and the source download of
+//each bucket are served by the local http servers
+type FakeQiniu struct {
+	Server    *httptest.Server
+	AccessKey string
+	SecretKey string
+
+	lock    sync.Mutex
+	buckets map[string]*fakeBucket
+	blocks  map[string]*fakeBlock
+}
+
+type FakeFile struct {
+	Data     []byte
+	Hash     string
+	MimeType string
+	PutTime  int64
+}
+
+type fakeBucket struct {
+	files  map[string]FakeFile
+	server *httptest.Server
+	//the request uris of the source downloads
+	downloads []string
+}
+
+type fakeBlock struct {
+	size int
+	data []byte
+}
+
+type fakeEntry struct {
+	Hash     string `json:"hash"`
+	Fsize    int64  `json:"fsize"`
+	PutTime  int64  `json:"putTime"`
+	MimeType string `json:"mimeType"`
+}
+
+type fakeBatchItem struct {
+	Code  int        `json:"code"`
+	Data  *fakeEntry `json:"data,omitempty"`
+	Error string     `json:"error,omitempty"`
+}
+
+type fakePutPolicy struct {
+	Scope    string `json:"scope"`
+	Deadline int64  `json:"deadline"`
+}
+
+type fakeError struct {
+	code    int
+	message string
+}
+
+func (this *fakeError) Error() string {
+	return this.message
+}
+
+func NewFakeQiniu(accessKey, secretKey string) *FakeQiniu {
+	fake := FakeQiniu{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		buckets:   make(map[string]*fakeBucket),
+		blocks:    make(map[string]*fakeBlock),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stat/", fake.serveStat)
+	mux.HandleFunc("/batch", fake.serveBatch)
+	mux.HandleFunc("/mkblk/", fake.serveMkblk)
+	mux.HandleFunc("/bput/", fake.serveBput)
+	mux.HandleFunc("/mkfile/", fake.serveMkfile)
+	mux.HandleFunc("/", fake.serveFormUpload)
+	fake.Server = httptest.NewServer(mux)
+	return &fake
+}
+
+func (this *FakeQiniu) Close() {
+	this.lock.Lock()
+	servers := make([]*httptest.Server, 0, len(this.buckets))
+	for _, bucket := range this.buckets {
+		servers = append(servers, bucket.server)
+	}
+	this.lock.Unlock()
+
+	for _, server := range servers {
+		server.Close()
+	}
+	this.Server.Close()
+}
+
+//point the rs and up hosts of the sdk to the fake, call restore when done
+func (this *FakeQiniu) SetHosts() (restore func()) {
+	rsHost, upHost := conf.RS_HOST, conf.UP_HOST
+	conf.RS_HOST = this.Server.URL
+	conf.UP_HOST = this.Server.URL
+	restore = func() {
+		conf.RS_HOST = rsHost
+		conf.UP_HOST = upHost
+	}
+	return
+}
+
+//create the bucket and its source download server
+func (this *FakeQiniu) MakeBucket(bucket string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.bucket(bucket, true)
+}
+
+func (this *FakeQiniu) bucket(name string, create bool) *fakeBucket {
+	bucket, ok := this.buckets[name]
+	if !ok && create {
+		bucket = &fakeBucket{
+			files: make(map[string]FakeFile),
+		}
+		bucket.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			this.serveDownload(bucket, w, req)
+		}))
+		this.buckets[name] = bucket
+	}
+	return bucket
+}
+
+//save the file to the bucket directly, return the download url
+func (this *FakeQiniu) PutFile(bucket, key string, data []byte, mimeType string) (resUrl string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.bucket(bucket, true).files[key] = newFakeFile(key, data, mimeType)
+	return this.url(bucket, key)
+}
+
+func (this *FakeQiniu) GetFile(bucket, key string) (file FakeFile, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if b := this.bucket(bucket, false); b != nil {
+		file, ok = b.files[key]
+	}
+	return
+}
+
+//the keys of the files in the bucket
+func (this *FakeQiniu) Keys(bucket string) (keys []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	keys = make([]string, 0)
+	if b := this.bucket(bucket, false); b != nil {
+		for key := range b.files {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+//the source download url of the file, the file needs not exist
+func (this *FakeQiniu) Url(bucket, key string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.url(bucket, key)
+}
+
+func (this *FakeQiniu) url(bucket, key string) string {
+	return fmt.Sprintf("%s/%s", this.bucket(bucket, true).server.URL, key)
+}
+
+//the source download domain of the bucket, like http://127.0.0.1:<port>
+func (this *FakeQiniu) Domain(bucket string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.bucket(bucket, true).server.URL
+}
+
+//the request uris of the source downloads of the bucket
+func (this *FakeQiniu) Downloads(bucket string) (uris []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if b := this.bucket(bucket, false); b != nil {
+		uris = append(uris, b.downloads...)
+	}
+	return
+}
+
+func newFakeFile(key string, data []byte, mimeType string) FakeFile {
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(filepath.Ext(key))
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+	}
+	hash, _ := utils.Etag(bytes.NewReader(data))
+	return FakeFile{
+		Data:     data,
+		Hash:     hash,
+		MimeType: mimeType,
+		PutTime:  time.Now().UnixNano() / 100,
+	}
+}
+
+func writeFakeJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+func writeFakeError(w http.ResponseWriter, err error) {
+	statusCode := 400
+	if v, ok := err.(*fakeError); ok {
+		statusCode = v.code
+	}
+	writeFakeJson(w, statusCode, map[string]string{"error": err.Error()})
+}
+
+func (this *FakeQiniu) sign(data []byte) string {
+	h := hmac.New(sha1.New, []byte(this.SecretKey))
+	h.Write(data)
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+//check the QBox authorization of the rs requests
+func (this *FakeQiniu) checkMac(req *http.Request, body []byte) error {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "QBox ")
+	items := strings.SplitN(token, ":", 2)
+	if len(items) != 2 || items[0] != this.AccessKey {
+		return &fakeError{401, "bad token"}
+	}
+
+	data := req.URL.Path
+	if req.URL.RawQuery != "" {
+		data += "?" + req.URL.RawQuery
+	}
+	data += "\n"
+	if req.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+		data += string(body)
+	}
+	if this.sign([]byte(data)) != items[1] {
+		return &fakeError{401, "bad token"}
+	}
+	return nil
+}
+
+//check the upload token, return the bucket and the key in the scope
+func (this *FakeQiniu) checkUptoken(uptoken string) (bucket, scopeKey string, err error) {
+	items := strings.Split(uptoken, ":")
+	if len(items) != 3 || items[0] != this.AccessKey || this.sign([]byte(items[2])) != items[1] {
+		err = &fakeError{401, "bad token"}
+		return
+	}
+
+	policyData, decodeErr := base64.URLEncoding.DecodeString(items[2])
+	if decodeErr != nil {
+		err = &fakeError{401, "bad token"}
+		return
+	}
+	var policy fakePutPolicy
+	if jErr := json.Unmarshal(policyData, &policy); jErr != nil {
+		err = &fakeError{401, "bad token"}
+		return
+	}
+	if policy.Deadline < time.Now().Unix() {
+		err = &fakeError{401, "token out of date"}
+		return
+	}
+
+	scope := strings.SplitN(policy.Scope, ":", 2)
+	bucket = scope[0]
+	if len(scope) == 2 {
+		scopeKey = scope[1]
+	}
+	return
+}
+
+func (this *FakeQiniu) stat(entryUri string) (entry fakeEntry, err error) {
+	entryData, decodeErr := base64.URLEncoding.DecodeString(entryUri)
+	if decodeErr != nil {
+		err = &fakeError{400, "invalid entry uri"}
+		return
+	}
+	items := strings.SplitN(string(entryData), ":", 2)
+	if len(items) != 2 {
+		err = &fakeError{400, "invalid entry uri"}
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	bucket := this.bucket(items[0], false)
+	if bucket == nil {
+		err = &fakeError{631, "no such bucket"}
+		return
+	}
+	file, ok := bucket.files[items[1]]
+	if !ok {
+		err = &fakeError{612, "no such file or directory"}
+		return
+	}
+	entry = fakeEntry{
+		Hash:     file.Hash,
+		Fsize:    int64(len(file.Data)),
+		PutTime:  file.PutTime,
+		MimeType: file.MimeType,
+	}
+	return
+}
+
+func (this *FakeQiniu) serveStat(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := this.checkMac(req, body); err != nil {
+		writeFakeError(w, err)
+		return
+	}
+
+	entry, err := this.stat(strings.TrimPrefix(req.URL.Path, "/stat/"))
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	writeFakeJson(w, 200, entry)
+}
+
+func (this *FakeQiniu) serveBatch(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := this.checkMac(req, body); err != nil {
+		writeFakeError(w, err)
+		return
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := req.ParseForm(); err != nil {
+		writeFakeError(w, err)
+		return
+	}
+
+	statusCode := 200
+	items := make([]fakeBatchItem, 0)
+	for _, op := range req.PostForm["op"] {
+		var item fakeBatchItem
+		if !strings.HasPrefix(op, "/stat/") {
+			item = fakeBatchItem{Code: 400, Error: "unsupported op"}
+		} else if entry, err := this.stat(strings.TrimPrefix(op, "/stat/")); err != nil {
+			item = fakeBatchItem{Code: err.(*fakeError).code, Error: err.Error()}
+		} else {
+			item = fakeBatchItem{Code: 200, Data: &entry}
+		}
+		if item.Code != 200 {
+			//partial success
+			statusCode = 298
+		}
+		items = append(items, item)
+	}
+	writeFakeJson(w, statusCode, items)
+}
+
+//save the uploaded file, the existing file is replaced only when the key is in the scope
+func (this *FakeQiniu) save(uptoken, key string, data []byte, mimeType string) (file FakeFile, err error) {
+	bucketName, scopeKey, tErr := this.checkUptoken(uptoken)
+	if tErr != nil {
+		err = tErr
+		return
+	}
+	if scopeKey != "" && scopeKey != key {
+		err = &fakeError{403, "key doesn't match with scope"}
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	bucket := this.bucket(bucketName, false)
+	if bucket == nil {
+		err = &fakeError{631, "no such bucket"}
+		return
+	}
+	file = newFakeFile(key, data, mimeType)
+	if oldFile, ok := bucket.files[key]; ok && scopeKey == "" && oldFile.Hash != file.Hash {
+		err = &fakeError{614, "file exists"}
+		return
+	}
+	bucket.files[key] = file
+	return
+}
+
+func (this *FakeQiniu) serveFormUpload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" || req.URL.Path != "/" {
+		writeFakeError(w, &fakeError{404, "not found"})
+		return
+	}
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		writeFakeError(w, &fakeError{400, fmt.Sprintf("invalid multipart form, %s", err.Error())})
+		return
+	}
+
+	fileFp, fileHeader, fErr := req.FormFile("file")
+	if fErr != nil {
+		writeFakeError(w, &fakeError{400, "file is not specified in multipart"})
+		return
+	}
+	defer fileFp.Close()
+	data, _ := ioutil.ReadAll(fileFp)
+
+	key := req.FormValue("key")
+	file, err := this.save(req.FormValue("token"), key, data, fileHeader.Header.Get("Content-Type"))
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	writeFakeJson(w, 200, map[string]string{"hash": file.Hash, "key": key})
+}
+
+func (this *FakeQiniu) uptoken(req *http.Request) string {
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "UpToken ")
+}
+
+func (this *FakeQiniu) writeBlkputRet(w http.ResponseWriter, ctx string, chunk []byte, offset int) {
+	writeFakeJson(w, 200, map[string]interface{}{
+		"ctx":      ctx,
+		"checksum": "",
+		"crc32":    crc32.ChecksumIEEE(chunk),
+		"offset":   offset,
+		"host":     this.Server.URL,
+	})
+}
+
+func (this *FakeQiniu) serveMkblk(w http.ResponseWriter, req *http.Request) {
+	if _, _, err := this.checkUptoken(this.uptoken(req)); err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	blockSize, pErr := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/mkblk/"))
+	if pErr != nil || blockSize <= 0 || blockSize > utils.ETAG_BLOCK_SIZE {
+		writeFakeError(w, &fakeError{400, "invalid block size"})
+		return
+	}
+	chunk, _ := ioutil.ReadAll(req.Body)
+	if len(chunk) > blockSize {
+		writeFakeError(w, &fakeError{400, "chunk exceeds the block size"})
+		return
+	}
+
+	ctxBytes := make([]byte, 16)
+	rand.Read(ctxBytes)
+	ctx := hex.EncodeToString(ctxBytes)
+
+	this.lock.Lock()
+	this.blocks[ctx] = &fakeBlock{blockSize, chunk}
+	this.lock.Unlock()
+	this.writeBlkputRet(w, ctx, chunk, len(chunk))
+}
+
+func (this *FakeQiniu) serveBput(w http.ResponseWriter, req *http.Request) {
+	if _, _, err := this.checkUptoken(this.uptoken(req)); err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	items := strings.Split(strings.TrimPrefix(req.URL.Path, "/bput/"), "/")
+	if len(items) != 2 {
+		writeFakeError(w, &fakeError{400, "invalid bput url"})
+		return
+	}
+	ctx := items[0]
+	offset, _ := strconv.Atoi(items[1])
+	chunk, _ := ioutil.ReadAll(req.Body)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	block, ok := this.blocks[ctx]
+	if !ok {
+		writeFakeError(w, &fakeError{701, "invalid ctx"})
+		return
+	}
+	if offset != len(block.data) || offset+len(chunk) > block.size {
+		writeFakeError(w, &fakeError{701, "invalid offset"})
+		return
+	}
+	block.data = append(block.data, chunk...)
+	this.writeBlkputRet(w, ctx, chunk, len(block.data))
+}
+
+func (this *FakeQiniu) serveMkfile(w http.ResponseWriter, req *http.Request) {
+	//mkfile/<fsize>[/mimeType/<encoded>][/key/<encoded>][/x:<param>/<encoded>]
+	items := strings.Split(strings.TrimPrefix(req.URL.Path, "/mkfile/"), "/")
+	fsize, pErr := strconv.Atoi(items[0])
+	if pErr != nil || len(items)%2 != 1 {
+		writeFakeError(w, &fakeError{400, "invalid mkfile url"})
+		return
+	}
+	params := make(map[string]string)
+	for index := 1; index < len(items); index += 2 {
+		value, _ := base64.URLEncoding.DecodeString(items[index+1])
+		params[items[index]] = string(value)
+	}
+
+	ctxData, _ := ioutil.ReadAll(req.Body)
+	data := make([]byte, 0, fsize)
+	this.lock.Lock()
+	for _, ctx := range strings.Split(string(ctxData), ",") {
+		block, ok := this.blocks[ctx]
+		if !ok || len(block.data) != block.size {
+			this.lock.Unlock()
+			writeFakeError(w, &fakeError{701, "invalid ctx"})
+			return
+		}
+		data = append(data, block.data...)
+		delete(this.blocks, ctx)
+	}
+	this.lock.Unlock()
+
+	if len(data) != fsize {
+		writeFakeError(w, &fakeError{400, "file size not match"})
+		return
+	}
+
+	file, err := this.save(this.uptoken(req), params["key"], data, params["mimeType"])
+	if err != nil {
+		writeFakeError(w, err)
+		return
+	}
+	writeFakeJson(w, 200, map[string]string{"hash": file.Hash, "key": params["key"]})
+}
+
+//the imageInfo of the images is returned for the imageInfo query, the other
+//fops in the query return the source file with the query appended, so that the
+//result differs from the source file, the named params like the token are ignored
+func (this *FakeQiniu) serveDownload(bucket *fakeBucket, w http.ResponseWriter, req *http.Request) {
+	this.lock.Lock()
+	bucket.downloads = append(bucket.downloads, req.URL.RequestURI())
+	file, ok := bucket.files[strings.TrimPrefix(req.URL.Path, "/")]
+	this.lock.Unlock()
+
+	if !ok {
+		writeFakeError(w, &fakeError{404, "Document not found"})
+		return
+	}
+	if req.URL.RawQuery == "imageInfo" {
+		imgConfig, format, decodeErr := image.DecodeConfig(bytes.NewReader(file.Data))
+		if decodeErr != nil {
+			writeFakeError(w, &fakeError{400, "unsupported format"})
+			return
+		}
+		writeFakeJson(w, 200, map[string]interface{}{
+			"format": format,
+			"width":  imgConfig.Width,
+			"height": imgConfig.Height,
+		})
+		return
+	}
+	if fop := strings.SplitN(req.URL.RawQuery, "&", 2)[0]; fop != "" && !strings.Contains(fop, "=") {
+		data := append(append([]byte{}, file.Data...), "?"+fop...)
+		w.Header().Set("Content-Type", file.MimeType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", file.MimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, file.Hash))
+	w.Write(file.Data)
+}
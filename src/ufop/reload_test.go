@@ -0,0 +1,107 @@
+package ufop_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"ufop"
+	"ufop/mkzip"
+	"ufop/unzip"
+)
+
+func reloadTestConfig(t *testing.T, confData string) *ufop.UfopConfig {
+	cfg, err := loadTestConfig(t, t.TempDir(), confData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReload(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{
+		"mkzip_max_file_count": 1,
+	})
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA) + "/alias/" + encode("1") +
+		"/url/" + encode(urlA) + "/alias/" + encode("2")
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_LIMIT_EXCEEDED, "zip file count exceeds the limit")
+
+	cfg := reloadTestConfig(t, `{
+		"ufop_prefix": "qn-",
+		"access_key": "`+testAccessKey+`",
+		"secret_key": "`+testSecretKey+`",
+		"enabled": ["mkzip"],
+		"handlers": {"mkzip": {"settings": {"mkzip_max_file_count": 2}}}
+	}`)
+	if errs := env.serv.Reload(cfg, []ufop.UfopJobHandler{&mkzip.Mkzipper{}, &unzip.Unzipper{}}); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	w = env.do(cmd, ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+
+	//the unzip is not enabled
+	w = env.do("unzip/bucket/"+encode(testBucket), env.src("a.zip", makeZip(t, nil), "application/zip"))
+	expectError(t, w, 400, ufop.ERROR_NO_FOP, "no fop available for the request")
+}
+
+func TestReloadFailed(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&mkzip.Mkzipper{}, map[string]interface{}{
+		"mkzip_max_file_count": 1,
+	})
+
+	//the mkzip config is kept when the unzip fails
+	cfg := reloadTestConfig(t, `{
+		"ufop_prefix": "qn-",
+		"handlers": {
+			"mkzip": {"settings": {"mkzip_max_file_count": 2}},
+			"unzip": {"settings": {"unzip_max_file_cuont": 2}}
+		}
+	}`)
+	errs := env.serv.Reload(cfg, []ufop.UfopJobHandler{&mkzip.Mkzipper{}, &unzip.Unzipper{}})
+	if len(errs) != 1 || errs[0].Error() != `init job handler for cmd 'unzip' error, Parse unzip config failed, json: unknown field "unzip_max_file_cuont"` {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+
+	urlA := env.fake.PutFile(testBucket, "a.txt", []byte("hello"), "text/plain")
+	cmd := "mkzip/bucket/" + encode(testBucket) + "/url/" + encode(urlA) + "/alias/" + encode("1") +
+		"/url/" + encode(urlA) + "/alias/" + encode("2")
+	w := env.do(cmd, ufop.UfopRequestSrc{})
+	expectError(t, w, 400, ufop.ERROR_LIMIT_EXCEEDED, "zip file count exceeds the limit")
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	keepPath := filepath.Join(dir, "keep.txt")
+	ioutil.WriteFile(keepPath, []byte("keep"), 0644)
+	storageDir := filepath.Join(dir, "storage")
+
+	//the scratch and cache dirs are not swept, the storage dir is not created
+	cfg := reloadTestConfig(t, `{
+		"ufop_prefix": "qn-",
+		"storage_type": "local",
+		"storage_dir": "`+storageDir+`",
+		"scratch_dir": "`+dir+`",
+		"fetch_cache_dir": "`+dir+`",
+		"fetch_cache_size": 1024,
+		"enabled": ["mkzip", "unzip"],
+		"handlers": {
+			"mkzip": {"settings": {"mkzip_max_file_count": 2}},
+			"unzip": {"settings": {"unzip_max_file_cuont": 2}}
+		}
+	}`)
+	errs := ufop.CheckConfig(cfg, []ufop.UfopJobHandler{&mkzip.Mkzipper{}, &unzip.Unzipper{}})
+	if len(errs) != 1 || errs[0].Error() != `init job handler for cmd 'unzip' error, Parse unzip config failed, json: unknown field "unzip_max_file_cuont"` {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+	if _, err := os.Stat(keepPath); err != nil {
+		t.Fatalf("file removed by the check, %s", err)
+	}
+	if _, err := os.Stat(storageDir); !os.IsNotExist(err) {
+		t.Fatalf("storage dir created by the check, %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package roundpic
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,13 +11,9 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io/ioutil"
-	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
-	"time"
 	"ufop"
 	"ufop/utils"
 )
@@ -26,6 +23,7 @@ const (
 )
 
 type RoundPicer struct {
+	storage     ufop.UfopStorage
 	maxFileSize uint64
 }
 
@@ -43,17 +41,16 @@ func (this *RoundPicer) Name() string {
 	return "roundpic"
 }
 
-func (this *RoundPicer) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open roundpic config failed, %s", openErr.Error()))
-		return
+func (this *RoundPicer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"round_pic_max_file_size": this.maxFileSize,
 	}
+}
 
+func (this *RoundPicer) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := RoundPicConfig{}
 
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse roundpic config failed, %s", decodeErr.Error()))
 		return
@@ -65,34 +62,38 @@ func (this *RoundPicer) InitConfig(jobConf string) (err error) {
 		this.maxFileSize = config.RoundPicMaxFileSize
 	}
 
+	this.storage = storage
 	return
 }
 
+var roundpicParser = utils.NewCommandParser("roundpic",
+	utils.ParamSpec{Name: "radius", Type: utils.PARAM_TYPE_STRING, Pattern: `^\d+(\.\d+){0,1}%{0,1}$`},
+	utils.ParamSpec{Name: "radius-x", Type: utils.PARAM_TYPE_STRING, Pattern: `^\d+(\.\d+){0,1}%{0,1}$`},
+	utils.ParamSpec{Name: "radius-y", Type: utils.PARAM_TYPE_STRING, Pattern: `^\d+(\.\d+){0,1}%{0,1}$`},
+)
+
 func (this *RoundPicer) parse(cmd string) (params RoundPicParams, err error) {
-	pattern := `^roundpic((/radius/\d+(\.\d+){0,1}%{0,1})|(/radius-x/\d+(\.\d+){0,1}%{0,1}/radius-y/\d+(\.\d+){0,1}%{0,1}))$`
-	if matched, _ := regexp.MatchString(pattern, cmd); !matched {
-		err = errors.New("invalid roundpic command")
+	cmdParams, pErr := roundpicParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
 
-	params = RoundPicParams{}
-
-	//get radius if specified
-	params.Radius = utils.GetParam(cmd, `radius/\d+(\.\d+){0,1}%{0,1}`, "radius")
-
-	//get radius-x, radius-y
-	params.RadiusX = utils.GetParam(cmd, `radius-x/\d+(\.\d+){0,1}%{0,1}`, "radius-x")
-	params.RadiusY = utils.GetParam(cmd, `radius-y/\d+(\.\d+){0,1}%{0,1}`, "radius-y")
+	params = RoundPicParams{
+		Radius:  cmdParams.String("radius"),
+		RadiusX: cmdParams.String("radius-x"),
+		RadiusY: cmdParams.String("radius-y"),
+	}
 
 	if params.Radius == "" && (params.RadiusX == "" || params.RadiusY == "") {
-		err = errors.New("roundpic radius or radius-x or radius-y empty error")
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "roundpic radius or radius-x or radius-y empty error")
 		return
 	}
 
 	return
 }
 
-func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *RoundPicer) Do(req ufop.UfopRequest) (result ufop.UfopResult, err error) {
 	//parse cmd
 	cmdParams, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -102,33 +103,26 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 
 	//check src image
 	if matched, _ := regexp.MatchString("image/(png|jpeg)", req.Src.MimeType); !matched {
-		err = errors.New("unsupported mimetype, only 'image/png' and 'image/jpeg' supported")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported mimetype, only 'image/png' and 'image/jpeg' supported")
 		return
 	}
 
 	if req.Src.Fsize > this.maxFileSize {
-		err = errors.New("src image size too large, exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src image size too large, exceeds the limit")
 		return
 	}
 
 	//download the image
-	resp, respErr := http.Get(req.Src.Url)
-	if respErr != nil || resp.StatusCode != http.StatusOK {
-		if respErr != nil {
-			err = errors.New(fmt.Sprintf("get image data failed, %s", respErr.Error()))
-		} else {
-			err = errors.New(fmt.Sprintf("get image data failed, %s", resp.Status))
-			if resp.Body != nil {
-				resp.Body.Close()
-			}
-		}
+	resBody, _, getErr := this.storage.Get(context.Background(), req.Src.Url)
+	if getErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get image data failed, %s", getErr.Error()))
 		return
 	}
-	defer resp.Body.Close()
+	defer resBody.Close()
 
-	srcImgData, readErr := ioutil.ReadAll(resp.Body)
+	srcImgData, readErr := ioutil.ReadAll(resBody)
 	if readErr != nil {
-		err = errors.New(fmt.Sprintf("read image data failed, %s", readErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("read image data failed, %s", readErr.Error()))
 		return
 	}
 
@@ -143,7 +137,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	}
 
 	if decodeErr != nil {
-		err = errors.New(fmt.Sprintf("decode image failed, %s", decodeErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("decode image failed, %s", decodeErr.Error()))
 		return
 	}
 
@@ -168,7 +162,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//draw mask
 	nErr := maskDraw.NewImage(uint(srcImgWidth), uint(srcImgHeight), backDraw)
 	if nErr != nil {
-		err = errors.New(fmt.Sprintf("create mask image failed, %s", nErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create mask image failed, %s", nErr.Error()))
 		return
 	}
 
@@ -181,7 +175,7 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	//draw round pic
 	dErr := maskDraw.DrawImage(roundDraw)
 	if dErr != nil {
-		err = errors.New(fmt.Sprintf("draw mask image failed, %s", dErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("draw mask image failed, %s", dErr.Error()))
 		return
 	}
 
@@ -190,30 +184,39 @@ func (this *RoundPicer) Do(req ufop.UfopRequest) (result interface{}, resultType
 	defer srcDraw.Destroy()
 	rErr := srcDraw.ReadImageBlob(srcImgData)
 	if rErr != nil {
-		err = errors.New(fmt.Sprintf("read src image failed, %s", rErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("read src image failed, %s", rErr.Error()))
 		return
 	}
 
 	//composite the mask and the src image
 	cErr := maskDraw.CompositeImage(srcDraw, imagick.COMPOSITE_OP_SRC_IN, 0, 0)
 	if cErr != nil {
-		err = errors.New(fmt.Sprintf("composite mask and src image failed, %s", cErr.Error()))
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("composite mask and src image failed, %s", cErr.Error()))
 		return
 	}
 
-	//write dest image
-	oTmpFpath := filepath.Join(os.TempDir(), fmt.Sprintf("roundpic_tmp_result_%d.png", time.Now().UnixNano()))
+	//write dest image into the scratch dir, removed with it
+	scratch := req.Scratch()
+	oTmpFpath, tErr := scratch.TempPath("roundpic_tmp_result_*.png")
+	if tErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create dest image file failed, %s", tErr.Error()))
+		return
+	}
 	wErr := maskDraw.WriteImage(oTmpFpath)
 	if wErr != nil {
-		err = errors.New(fmt.Sprintf("write dest image failed, %s", wErr.Error()))
-		defer os.Remove(oTmpFpath)
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("write dest image failed, %s", wErr.Error()))
+		return
+	}
+	if uErr := scratch.UpdateUsage(); uErr != nil {
+		err = uErr
 		return
 	}
 
 	//write result
-	result = oTmpFpath
-	resultType = ufop.RESULT_TYPE_OCTECT_FILE
-	contentType = "image/png"
+	result.Type = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Body = oTmpFpath
+	result.MimeType = "image/png"
+	result.Filename = "roundpic.png"
 
 	return
 }
@@ -0,0 +1,134 @@
+package ufop
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	SAVEAS_RESUMABLE_PUT_THRESHOLD = 20 * 1024 * 1024
+)
+
+//the saveas parameter ends the command, the last fop of a pipeline
+var saveasPattern = regexp.MustCompile(`/saveas/([0-9a-zA-Z-_=]+)$`)
+
+//the result of the fop is saved to the bucket instead of returned
+type UfopSaveasResult struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Hash   string `json:"hash"`
+	Fsize  int64  `json:"fsize"`
+}
+
+//remove the saveas parameter from the command, ok is false if no saveas
+func parseSaveas(cmd string) (fopCmd, bucket, key string, ok bool, err error) {
+	fopCmd = cmd
+	matches := saveasPattern.FindStringSubmatch(cmd)
+	if matches == nil {
+		return
+	}
+
+	ok = true
+	fopCmd = strings.TrimSuffix(cmd, matches[0])
+	entryBytes, decodeErr := base64.URLEncoding.DecodeString(matches[1])
+	if decodeErr != nil {
+		err = NewUfopError(ERROR_BAD_COMMAND, "invalid parameter 'saveas', should be url safe base64 encoded")
+		return
+	}
+
+	items := strings.SplitN(string(entryBytes), ":", 2)
+	if len(items) != 2 || items[0] == "" || items[1] == "" {
+		err = NewUfopError(ERROR_BAD_COMMAND, "invalid parameter 'saveas', should be in format '<bucket>:<key>'")
+		return
+	}
+	bucket = items[0]
+	key = items[1]
+	return
+}
+
+//upload the octet result to the bucket, the key is overwritten if exists, the
+//stream and url results are saved in the scratch dir first
+func saveResult(ctx context.Context, storage UfopStorage, scratch *UfopScratch, result UfopResult,
+	bucket, key string) (saveasResult UfopSaveasResult, err error) {
+	var data []byte
+	var localPath string
+	switch result.Type {
+	case RESULT_TYPE_JSON:
+		err = NewUfopError(ERROR_BAD_COMMAND, "json result can not be saved")
+		return
+	case RESULT_TYPE_OCTECT_BYTES:
+		data, _ = result.Body.([]byte)
+	case RESULT_TYPE_OCTECT_FILE:
+		localPath, _ = result.Body.(string)
+		defer os.Remove(localPath)
+	case RESULT_TYPE_OCTECT_STREAM, RESULT_TYPE_OCTECT_URL:
+		tmpFp, tmpErr := scratch.CreateTemp("ufop_saveas_")
+		if tmpErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("open saveas temp file failed, %s", tmpErr.Error()))
+			return
+		}
+		localPath = tmpFp.Name()
+		defer os.Remove(localPath)
+
+		var wErr error
+		if result.Type == RESULT_TYPE_OCTECT_STREAM {
+			if stream := toStreamWriter(result.Body); stream != nil {
+				wErr = stream(tmpFp)
+			}
+			tmpFp.Close()
+		} else {
+			resUrl, _ := result.Body.(string)
+			if _, dErr := StorageDownloadTo(ctx, storage, resUrl, tmpFp); dErr != nil {
+				wErr = NewUfopError(ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get resource by url '%s' failed, %s", resUrl, dErr.Error()))
+			}
+			tmpFp.Close()
+		}
+		if wErr != nil {
+			err = WrapUfopError(ERROR_PROCESS_FAILED, wErr)
+			return
+		}
+	}
+
+	extra := UfopPutExtra{
+		MimeType:  result.MimeType,
+		Overwrite: true,
+	}
+
+	var fsize int64
+	var putRet UfopPutResult
+	var putErr error
+	if localPath != "" {
+		stat, statErr := os.Stat(localPath)
+		if statErr != nil {
+			err = NewUfopError(ERROR_INTERNAL, fmt.Sprintf("stat saveas file failed, %s", statErr.Error()))
+			return
+		}
+		fsize = stat.Size()
+		putRet, putErr = StoragePutFile(ctx, storage, bucket, key, localPath, SAVEAS_RESUMABLE_PUT_THRESHOLD, &extra)
+	} else {
+		fsize = int64(len(data))
+		if fsize <= SAVEAS_RESUMABLE_PUT_THRESHOLD {
+			putRet, putErr = storage.Put(ctx, bucket, key, bytes.NewReader(data), &extra)
+		} else {
+			putRet, putErr = storage.PutResumable(ctx, bucket, key, bytes.NewReader(data), fsize, &extra)
+		}
+	}
+
+	if putErr != nil {
+		err = NewUfopError(ERROR_STORAGE_FAILED, fmt.Sprintf("save result to bucket error, %s", putErr.Error()))
+		return
+	}
+
+	saveasResult = UfopSaveasResult{
+		Bucket: bucket,
+		Key:    key,
+		Hash:   putRet.Hash,
+		Fsize:  fsize,
+	}
+	return
+}
@@ -0,0 +1,268 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/qiniu/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+//the scratch dirs of the requests are the sub dirs of the root dir, named by
+//the request ids, the root dir is the owned sub dir of the configured scratch
+//dir, whatever left in it is removed at start, the files in the scratch dirs
+//are limited by the quota
+type UfopScratchManager struct {
+	rootDir string
+	//total bytes of the scratch dirs, <= 0 means no limit
+	quota int64
+
+	lock sync.Mutex
+	used int64
+}
+
+//the scratch dir of one request, removed after the response is written, or
+//after the result of the async job is saved
+type UfopScratch struct {
+	manager *UfopScratchManager
+	dir     string
+
+	lock      sync.Mutex
+	used      int64
+	overQuota bool
+	removed   bool
+}
+
+//the temp file in the scratch dir, the data written by Write, WriteString and
+//ReadFrom is counted against the quota
+type UfopScratchFile struct {
+	*os.File
+	scratch *UfopScratch
+}
+
+//create the root dir and sweep the dirs left by the previous runs, the manager
+//is returned even on error, the scratch dirs fail to create then
+func NewScratchManager(rootDir string, quota int64) (manager *UfopScratchManager, err error) {
+	manager = &UfopScratchManager{
+		rootDir: rootDir,
+		quota:   quota,
+	}
+	if rootDir == "" {
+		err = errors.New("scratch dir not set")
+		return
+	}
+	if mErr := os.MkdirAll(rootDir, 0755); mErr != nil {
+		err = errors.New(fmt.Sprintf("create scratch dir failed, %s", mErr.Error()))
+		return
+	}
+	manager.RemoveAll()
+	return
+}
+
+//create the scratch dir of the request
+func (this *UfopScratchManager) New(reqId string) (scratch *UfopScratch, err error) {
+	if this.rootDir == "" {
+		err = errors.New("scratch dir not set")
+		return
+	}
+	dir := filepath.Join(this.rootDir, reqId)
+	if mErr := os.Mkdir(dir, 0755); mErr != nil {
+		err = errors.New(fmt.Sprintf("create scratch dir failed, %s", mErr.Error()))
+		return
+	}
+	scratch = &UfopScratch{
+		manager: this,
+		dir:     dir,
+	}
+	return
+}
+
+//bytes used by the scratch dirs
+func (this *UfopScratchManager) Used() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.used
+}
+
+//remove everything in the root dir, the orphaned dirs at start, and the dirs
+//of the jobs not stopped on shutdown
+func (this *UfopScratchManager) RemoveAll() {
+	if this.rootDir == "" {
+		return
+	}
+	fileInfos, readErr := ioutil.ReadDir(this.rootDir)
+	if readErr != nil {
+		log.Error("read scratch dir error,", readErr)
+		return
+	}
+	for _, fileInfo := range fileInfos {
+		if rErr := os.RemoveAll(filepath.Join(this.rootDir, fileInfo.Name())); rErr != nil {
+			log.Error("remove scratch dir error,", rErr)
+		}
+	}
+}
+
+func (this *UfopScratchManager) reserve(n int64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.quota > 0 && this.used+n > this.quota {
+		return false
+	}
+	this.used += n
+	return true
+}
+
+func (this *UfopScratchManager) release(n int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.used -= n
+}
+
+func (this *UfopScratch) Dir() string {
+	return this.dir
+}
+
+//create a temp file in the scratch dir, the pattern is the same as ioutil.TempFile
+func (this *UfopScratch) CreateTemp(pattern string) (file *UfopScratchFile, err error) {
+	fp, err := ioutil.TempFile(this.dir, pattern)
+	if err != nil {
+		return
+	}
+	file = &UfopScratchFile{
+		File:    fp,
+		scratch: this,
+	}
+	return
+}
+
+//create the file by the path, which should be in the scratch dir, like the
+//files in the sub dirs of TempDir
+func (this *UfopScratch) Create(path string) (file *UfopScratchFile, err error) {
+	fp, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	file = &UfopScratchFile{
+		File:    fp,
+		scratch: this,
+	}
+	return
+}
+
+//the path of a new empty file in the scratch dir, the output path of the
+//external programs, count the output by UpdateUsage
+func (this *UfopScratch) TempPath(pattern string) (path string, err error) {
+	fp, err := ioutil.TempFile(this.dir, pattern)
+	if err != nil {
+		return
+	}
+	path = fp.Name()
+	fp.Close()
+	return
+}
+
+//create a sub dir in the scratch dir, the pattern is the same as ioutil.TempDir
+func (this *UfopScratch) TempDir(pattern string) (string, error) {
+	return ioutil.TempDir(this.dir, pattern)
+}
+
+//the external program with the scratch dir as its TMPDIR
+func (this *UfopScratch) CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "TMPDIR="+this.dir)
+	return cmd
+}
+
+//recount the size of the scratch dir, for the files not written by the
+//UfopScratchFile, the error is returned when it exceeds the quota
+func (this *UfopScratch) UpdateUsage() (err error) {
+	var size int64
+	walkErr := filepath.Walk(this.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if walkErr != nil {
+		err = walkErr
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.removed {
+		return
+	}
+	delta := size - this.used
+	if delta <= 0 {
+		this.manager.release(-delta)
+		this.used = size
+		return
+	}
+	if !this.manager.reserve(delta) {
+		this.overQuota = true
+		err = NewUfopError(ERROR_SCRATCH_FULL, "scratch space quota exceeded")
+		return
+	}
+	this.used = size
+	return
+}
+
+//remove the scratch dir and release its quota, safe to call more than once
+func (this *UfopScratch) Remove() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.removed {
+		return
+	}
+	this.removed = true
+	if rErr := os.RemoveAll(this.dir); rErr != nil {
+		log.Error("remove scratch dir error,", rErr)
+	}
+	this.manager.release(this.used)
+	this.used = 0
+}
+
+//whether any write failed for the quota, the error of the handler is replaced then
+func (this *UfopScratch) exceeded() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.overQuota
+}
+
+func (this *UfopScratch) reserve(n int64) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.removed {
+		err = errors.New("scratch dir removed")
+		return
+	}
+	if !this.manager.reserve(n) {
+		this.overQuota = true
+		err = NewUfopError(ERROR_SCRATCH_FULL, "scratch space quota exceeded")
+		return
+	}
+	this.used += n
+	return
+}
+
+func (this *UfopScratchFile) Write(p []byte) (n int, err error) {
+	if err = this.scratch.reserve(int64(len(p))); err != nil {
+		return
+	}
+	return this.File.Write(p)
+}
+
+func (this *UfopScratchFile) WriteString(s string) (n int, err error) {
+	return this.Write([]byte(s))
+}
+
+//io.Copy to the file goes through Write instead of the ReadFrom of os.File
+func (this *UfopScratchFile) ReadFrom(r io.Reader) (n int64, err error) {
+	return io.Copy(struct{ io.Writer }{this}, r)
+}
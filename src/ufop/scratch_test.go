@@ -0,0 +1,117 @@
+package ufop_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"ufop"
+)
+
+//writes the bytes of the given count to the scratch dir, and returns the file
+type scratchHandler struct{}
+
+func (this *scratchHandler) Name() string {
+	return "scratch"
+}
+
+func (this *scratchHandler) InitConfig(jobConf []byte, storage ufop.UfopStorage) error {
+	return nil
+}
+
+func (this *scratchHandler) Do(req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	count, _ := strconv.Atoi(strings.TrimPrefix(req.Cmd, "scratch/"))
+	tmpFp, err := req.Scratch().CreateTemp("scratch_")
+	if err != nil {
+		return
+	}
+	defer tmpFp.Close()
+	if _, err = tmpFp.Write(bytes.Repeat([]byte("a"), count)); err != nil {
+		return
+	}
+
+	result.Type = ufop.RESULT_TYPE_OCTECT_FILE
+	result.Body = tmpFp.Name()
+	return
+}
+
+func TestScratchQuota(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.ScratchQuota = 100
+	env.serv = ufop.NewServer(env.cfg)
+	env.register(&scratchHandler{}, map[string]interface{}{})
+
+	w := env.do("scratch/60", ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+	if w.Body.Len() != 60 {
+		t.Fatalf("unexpected body length %d", w.Body.Len())
+	}
+
+	//the quota is released with the scratch dir
+	w = env.do("scratch/60", ufop.UfopRequestSrc{})
+	expectStatus(t, w, 200)
+
+	w = env.do("scratch/160", ufop.UfopRequestSrc{})
+	expectError(t, w, 507, ufop.ERROR_SCRATCH_FULL, "scratch space quota exceeded")
+}
+
+func TestScratchSweep(t *testing.T) {
+	env := newTestEnv(t)
+	orphanDir := filepath.Join(env.cfg.ScratchRoot(), "orphan")
+	os.MkdirAll(orphanDir, 0755)
+	ioutil.WriteFile(filepath.Join(orphanDir, "tmp"), []byte("hello"), 0644)
+	//the files of others in the scratch dir are kept
+	otherPath := filepath.Join(env.cfg.ScratchDir, "other.txt")
+	ioutil.WriteFile(otherPath, []byte("hello"), 0644)
+
+	ufop.NewServer(env.cfg)
+	if _, err := os.Stat(orphanDir); !os.IsNotExist(err) {
+		t.Fatalf("orphan dir not removed, %v", err)
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Fatalf("file out of the owned dir removed, %s", err)
+	}
+}
+
+func TestScratchAsync(t *testing.T) {
+	env := newTestEnv(t)
+	env.register(&scratchHandler{}, map[string]interface{}{})
+	endPoint, _ := listenTestServer(t, env)
+	defer env.serv.Shutdown()
+
+	w := env.doAsync("scratch/10")
+	expectStatus(t, w, 202)
+	var job ufop.UfopJob
+	json.Unmarshal(w.Body.Bytes(), &job)
+
+	//the output is kept after the scratch dir is removed
+	for index := 0; index < 50 && job.State != ufop.JOB_STATE_DONE; index++ {
+		time.Sleep(20 * time.Millisecond)
+		resp, err := http.Get(endPoint + "/jobs/" + job.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+	}
+	if job.State != ufop.JOB_STATE_DONE {
+		t.Fatalf("unexpected job state %s", job.State)
+	}
+	env.expectScratchEmpty()
+
+	resp, err := http.Get(endPoint + job.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	output, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(output) != "aaaaaaaaaa" {
+		t.Fatalf("unexpected output %d %s", resp.StatusCode, output)
+	}
+}
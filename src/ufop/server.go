@@ -1,168 +1,762 @@
 package ufop
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/qiniu/log"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"ufop/utils"
 )
 
+//time to wait for the cancelled jobs to stop on shutdown
+const SHUTDOWN_CLEANUP_TIMEOUT = 10 * time.Second
+
 type UfopServer struct {
+	jobManager *UfopJobManager
+	limiter    *UfopLimiter
+	policy     *UfopPolicy
+	metrics    *UfopMetrics
+	scratch    *UfopScratchManager
+	version    string
+
+	//the base context of the requests and the async jobs, cancelled on shutdown
+	ctx        context.Context
+	cancel     context.CancelFunc
+	httpServer *http.Server
+	//running jobs, and whether the server is shutting down
+	inflight     int64
+	shuttingDown int32
+
+	//the config, the storage and the handlers, replaced together on reload,
+	//the listen, async and global concurrency settings are taken from the
+	//config at start
+	lock        sync.RWMutex
 	cfg         *UfopConfig
 	jobHandlers map[string]UfopJobHandler
+	storage     UfopStorage
+	//handlers failed to register, shown by /ready and /handlers
+	failedHandlers []UfopHandlerFailure
+	//nil if the requests are not authenticated
+	auth *UfopAuthenticator
 }
 
 func NewServer(cfg *UfopConfig) *UfopServer {
 	serv := UfopServer{}
 	serv.cfg = cfg
 	serv.jobHandlers = make(map[string]UfopJobHandler, 0)
+	serv.metrics = NewMetrics()
+	storage, storageErr := NewStorage(cfg)
+	if storageErr != nil {
+		log.Error("create storage error,", storageErr)
+	}
+	serv.storage = storage
+	scratch, scratchErr := NewScratchManager(cfg.ScratchRoot(), cfg.ScratchQuota)
+	if scratchErr != nil {
+		log.Error("create scratch manager error,", scratchErr)
+	}
+	serv.scratch = scratch
+	fetcher := utils.NewFetcher(time.Duration(cfg.FetchConnectTimeout)*time.Second,
+		time.Duration(cfg.FetchReadTimeout)*time.Second, cfg.FetchRetries, utils.FETCH_RETRY_INTERVAL)
+	if cfg.FetchCacheSize > 0 {
+		cache, cacheErr := utils.NewFetchCache(cfg.FetchCacheRoot(), cfg.FetchCacheSize)
+		if cacheErr != nil {
+			log.Error("create fetch cache error,", cacheErr)
+		} else {
+			fetcher.SetCache(cache)
+			serv.metrics.fetchCache = cache
+		}
+	}
+	policy, policyErr := cfg.URLPolicy()
+	if policyErr != nil {
+		//the default policy is still safe
+		log.Error("create url policy error,", policyErr)
+		policy, _ = utils.NewURLPolicy(nil, nil, nil, false)
+	}
+	fetcher.SetPolicy(policy)
+	utils.SetDefaultFetcher(fetcher)
+	auth, authErr := NewAuthenticator(cfg)
+	if authErr != nil {
+		//the broken auth config must not open the server
+		log.Error("create authenticator error,", authErr)
+		auth = newDenyAllAuthenticator()
+	}
+	serv.auth = auth
+	serv.policy = NewPolicy()
+	serv.limiter = NewLimiter(cfg.MaxConcurrency, cfg.MaxQueueSize, time.Duration(cfg.QueueTimeout)*time.Second)
+	serv.ctx, serv.cancel = context.WithCancel(context.Background())
+	serv.jobManager = NewJobManager(serv.ctx, cfg.AsyncWorkers, cfg.AsyncQueueSize, cfg.AsyncResultDir,
+		time.Duration(cfg.AsyncJobTTL)*time.Second, serv.runJob)
 	return &serv
 }
 
-func (this *UfopServer) RegisterJobHandler(jobConf string, jobHandler interface{}) (err error) {
-	if h, ok := jobHandler.(UfopJobHandler); ok {
-		initErr := h.InitConfig(jobConf)
-		if initErr != nil {
-			err = errors.New(fmt.Sprintf("init job handler for cmd '%s' error, %s", h.Name(), initErr.Error()))
-			return
+//check the config and init the enabled handlers without creating the server,
+//nothing is created or removed on the disk, all the errors are returned
+func CheckConfig(cfg *UfopConfig, jobHandlers []UfopJobHandler) (errs []error) {
+	if _, policyErr := cfg.URLPolicy(); policyErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create url policy error, %s", policyErr)))
+	}
+	if _, authErr := NewAuthenticator(cfg); authErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create authenticator error, %s", authErr)))
+	}
+	storage, storageErr := newCheckStorage(cfg)
+	if storageErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create storage error, %s", storageErr)))
+		return
+	}
+	for _, jobHandler := range jobHandlers {
+		if !cfg.IsEnabled(jobHandler.Name()) {
+			continue
+		}
+		if err := initJobHandler(cfg, storage, jobHandler); err != nil {
+			errs = append(errs, err)
 		}
+	}
+	return
+}
 
-		this.jobHandlers[this.cfg.UfopPrefix+h.Name()] = h
-	} else {
-		err = errors.New(fmt.Sprintf("job handler of [%s] must implement interface UfopJobHandler", jobConf))
+//replace the storage of the config, must be called before the handlers are registered
+func (this *UfopServer) SetStorage(storage UfopStorage) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.storage = storage
+}
+
+//the version shown by /handlers
+func (this *UfopServer) SetVersion(version string) {
+	this.version = version
+}
+
+//the config, the handlers and the storage in use, the requests keep the ones
+//they start with
+func (this *UfopServer) current() (cfg *UfopConfig, jobHandlers map[string]UfopJobHandler, storage UfopStorage) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.cfg, this.jobHandlers, this.storage
+}
+
+func initJobHandler(cfg *UfopConfig, storage UfopStorage, jobHandler UfopJobHandler) (err error) {
+	name := jobHandler.Name()
+	jobConf, initErr := cfg.LoadJobConfig(name)
+	if initErr == nil {
+		if storage == nil {
+			initErr = errors.New("no storage available")
+		} else {
+			initErr = jobHandler.InitConfig(jobConf, storage)
+		}
+	}
+	if initErr != nil {
+		err = errors.New(fmt.Sprintf("init job handler for cmd '%s' error, %s", name, initErr.Error()))
 	}
 	return
 }
 
-func (this *UfopServer) Listen() {
+//init the handler by its config in the ufop config and register it
+func (this *UfopServer) RegisterJobHandler(jobHandler UfopJobHandler) (err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	name := jobHandler.Name()
+	if err = initJobHandler(this.cfg, this.storage, jobHandler); err != nil {
+		this.failedHandlers = append(this.failedHandlers, UfopHandlerFailure{name, err.Error()})
+		return
+	}
+
+	//the map in use is never modified
+	fop := this.cfg.UfopPrefix + name
+	jobHandlers := make(map[string]UfopJobHandler, len(this.jobHandlers)+1)
+	for oldFop, oldHandler := range this.jobHandlers {
+		jobHandlers[oldFop] = oldHandler
+	}
+	jobHandlers[fop] = jobHandler
+	this.jobHandlers = jobHandlers
+	if handlerCfg, ok := this.cfg.Handlers[name]; ok {
+		this.limiter.SetFopLimit(fop, handlerCfg.MaxConcurrency)
+	}
+	return
+}
+
+//init the enabled handlers by the new config and replace the config, the
+//storage and the handlers with them, nothing is changed if any of them fails,
+//the handlers should be new instances, the running jobs finish with the old ones
+func (this *UfopServer) Reload(cfg *UfopConfig, jobHandlers []UfopJobHandler) (errs []error) {
+	storage, storageErr := NewStorage(cfg)
+	if storageErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create storage error, %s", storageErr)))
+		return
+	}
+	policy, policyErr := cfg.URLPolicy()
+	if policyErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create url policy error, %s", policyErr)))
+		return
+	}
+	auth, authErr := NewAuthenticator(cfg)
+	if authErr != nil {
+		errs = append(errs, errors.New(fmt.Sprintf("create authenticator error, %s", authErr)))
+		return
+	}
+
+	newHandlers := make(map[string]UfopJobHandler, len(jobHandlers))
+	for _, jobHandler := range jobHandlers {
+		if !cfg.IsEnabled(jobHandler.Name()) {
+			continue
+		}
+		if err := initJobHandler(cfg, storage, jobHandler); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		newHandlers[cfg.UfopPrefix+jobHandler.Name()] = jobHandler
+	}
+	if len(errs) > 0 {
+		return
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	//the running jobs keep their slots, and are counted by the new limits
+	for fop := range this.jobHandlers {
+		if _, ok := newHandlers[fop]; !ok {
+			this.limiter.SetFopLimit(fop, 0)
+		}
+	}
+	for fop := range newHandlers {
+		name := strings.TrimPrefix(fop, cfg.UfopPrefix)
+		this.limiter.SetFopLimit(fop, cfg.Handlers[name].MaxConcurrency)
+	}
+
+	this.cfg = cfg
+	this.storage = storage
+	this.jobHandlers = newHandlers
+	this.failedHandlers = nil
+	this.auth = auth
+	utils.DefaultFetcher().SetPolicy(policy)
+	return
+}
+
+//check the request by the authenticator in use, the 401 error is written if
+//rejected, the caller is empty if the authentication is off
+func (this *UfopServer) authenticate(w http.ResponseWriter, req *http.Request, body []byte) (caller string, ok bool) {
+	this.lock.RLock()
+	auth := this.auth
+	this.lock.RUnlock()
+	if auth == nil {
+		ok = true
+		return
+	}
+	caller, err := auth.Verify(req, body)
+	if err != nil {
+		log.Warnf("reject the request of %s %s from %s, %s", req.Method, req.URL.Path, req.RemoteAddr, err)
+		writeUfopError(w, err)
+		return
+	}
+	ok = true
+	return
+}
+
+//serve until the server is shut down, nil is returned after Shutdown
+func (this *UfopServer) Listen() (err error) {
 	//define handler
-	http.HandleFunc("/uop", this.serveUfop)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/uop", this.serveUfop)
+	mux.HandleFunc("/jobs/", this.serveJob)
+	mux.HandleFunc("/metrics", this.serveMetrics)
+	mux.HandleFunc("/health", this.serveHealth)
+	mux.HandleFunc("/ready", this.serveReady)
+	mux.HandleFunc("/handlers", this.serveHandlers)
 
 	//bind and listen
-	endPoint := fmt.Sprintf("%s:%d", this.cfg.ListenHost, this.cfg.ListenPort)
+	cfg, _, _ := this.current()
+	endPoint := fmt.Sprintf("%s:%d", cfg.ListenHost, cfg.ListenPort)
 	ufopServer := &http.Server{
 		Addr:           endPoint,
-		ReadTimeout:    time.Duration(this.cfg.ReadTimeout) * time.Second,
-		WriteTimeout:   time.Duration(this.cfg.WriteTimeout) * time.Second,
-		MaxHeaderBytes: this.cfg.MaxHeaderBytes,
+		Handler:        mux,
+		ReadTimeout:    time.Duration(cfg.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(cfg.WriteTimeout) * time.Second,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return this.ctx
+		},
+	}
+	//the signal may come before the server is stored, then Shutdown finds no
+	//server to stop, so the flag is checked after storing it in the lock
+	this.lock.Lock()
+	this.httpServer = ufopServer
+	shuttingDown := this.isShuttingDown()
+	this.lock.Unlock()
+	if shuttingDown {
+		return
 	}
 
 	listenErr := ufopServer.ListenAndServe()
-	if listenErr != nil {
-		log.Println(listenErr)
+	if listenErr != nil && listenErr != http.ErrServerClosed {
+		err = listenErr
 	}
+	return
+}
+
+//stop accepting requests and wait for the running requests and async jobs to
+//finish until the shutdown timeout, the remaining ones are cancelled then, and
+//waited for a while more so that they can remove their temp files
+func (this *UfopServer) Shutdown() {
+	atomic.StoreInt32(&this.shuttingDown, 1)
+	this.jobManager.Close()
+
+	this.lock.RLock()
+	httpServer := this.httpServer
+	timeout := time.Duration(this.cfg.ShutdownTimeout) * time.Second
+	this.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			log.Warn("shutdown http server,", err)
+		}
+	}
+	if !this.waitIdle(ctx) {
+		log.Warnf("%d jobs not finished in %s, cancel them", atomic.LoadInt64(&this.inflight), timeout)
+	}
+
+	this.cancel()
+	cleanupCtx, cleanupCancel := context.WithTimeout(context.Background(), SHUTDOWN_CLEANUP_TIMEOUT)
+	defer cleanupCancel()
+	if !this.waitIdle(cleanupCtx) {
+		log.Warnf("%d jobs not stopped after cancelled", atomic.LoadInt64(&this.inflight))
+	}
+	if httpServer != nil {
+		httpServer.Close()
+	}
+	this.jobManager.RemoveOutputs()
+	this.scratch.RemoveAll()
+	if this.metrics.fetchCache != nil {
+		this.metrics.fetchCache.RemoveAll()
+	}
+}
+
+//wait until no jobs running, false if the context is done first
+func (this *UfopServer) waitIdle(ctx context.Context) bool {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&this.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+func (this *UfopServer) isShuttingDown() bool {
+	return atomic.LoadInt32(&this.shuttingDown) == 1
 }
 
 func (this *UfopServer) serveUfop(w http.ResponseWriter, req *http.Request) {
 	//check method
 	if req.Method != "POST" {
-		writeJsonError(w, 405, "method not allowed")
+		writeUfopError(w, NewUfopError(ERROR_METHOD_NOT_ALLOWED, "method not allowed"))
 		return
 	}
 
 	defer req.Body.Close()
 	var err error
 	var ufopReq UfopRequest
-	var ufopResult interface{}
-	var ufopResultType int
-	var ufopResultContentType string
+	var ufopResult UfopResult
 
 	ufopReqData, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		writeJsonError(w, 500, "read ufop request body error")
+		writeUfopError(w, NewUfopError(ERROR_INTERNAL, "read ufop request body error"))
 		return
 	}
+	caller, authOk := this.authenticate(w, req, ufopReqData)
+	if !authOk {
+		return
+	}
+	//the request id is always created, it is the job id and the scratch dir name
 	reqId := utils.NewRequestId()
-	log.Infof("[%s] %s", reqId, string(ufopReqData))
+	w.Header().Set(REQUEST_ID_HEADER, reqId)
+	logger := NewLogger(reqId)
+	if clientReqId := req.Header.Get(REQUEST_ID_HEADER); requestIdPattern.MatchString(clientReqId) {
+		w.Header().Set(CLIENT_REQUEST_ID_HEADER, clientReqId)
+		logger.clientReqId = clientReqId
+	}
 	err = json.Unmarshal(ufopReqData, &ufopReq)
 	if err != nil {
-		writeJsonError(w, 500, "parse ufop request body error")
+		logger.Warnf("parse ufop request body error, %s", err)
+		writeUfopError(w, NewUfopError(ERROR_BAD_REQUEST, "parse ufop request body error"))
 		return
 	}
 	ufopReq.ReqId = reqId
-	ufopResult, ufopResultType, ufopResultContentType, err = handleJob(ufopReq, this.cfg.UfopPrefix, this.jobHandlers)
-	if err != nil {
-		ufopErr := UfopError{
-			Request: ufopReq,
-			Error:   err.Error(),
+	ufopReq.caller = caller
+	cfg, jobHandlers, _ := this.current()
+	logger.setRequest(ufopReq, cmdBucket(cfg, jobHandlers, ufopReq.Cmd), cfg.LogRedactParams)
+	ufopReq.logger = logger
+	logger.Start()
+
+	fop := this.fopLabel(ufopReq.Cmd)
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		this.metrics.AddResponseBytes(fop, cw.written)
+	}()
+	w = cw
+
+	//async mode, queue the job and return the job id
+	if ufopReq.Async || req.URL.Query().Get("async") == "1" {
+		if fop == METRICS_UNKNOWN_FOP {
+			err = NewUfopError(ERROR_NO_FOP, "no fop available for the request")
+			logger.Done(err)
+			writeUfopError(w, err)
+			return
+		}
+		//the scratch dir is removed by the job manager when the job finishes
+		if !this.attachScratch(w, &ufopReq) {
+			return
 		}
-		logBytes, _ := json.Marshal(&ufopErr)
-		log.Error(reqId, string(logBytes))
-		writeJsonError(w, 400, err.Error())
+		job, submitErr := this.jobManager.Submit(fop, ufopReq)
+		if submitErr != nil {
+			ufopReq.scratch.Remove()
+			logger.Done(submitErr)
+			writeUfopError(w, submitErr)
+			return
+		}
+		logger.Infof("async job queued")
+		writeJsonResult(w, 202, job)
+		return
+	}
+
+	if !this.attachScratch(w, &ufopReq) {
+		return
+	}
+	defer ufopReq.scratch.Remove()
+	ufopResult, err = this.runJob(req.Context(), ufopReq)
+	if err != nil {
+		writeUfopError(w, WrapUfopError(ERROR_FOP_FAILED, err))
 	} else {
-		switch ufopResultType {
+		switch ufopResult.Type {
 		case RESULT_TYPE_JSON:
-			writeJsonResult(w, 200, ufopResult)
+			writeJsonResult(w, 200, ufopResult.Body)
 		case RESULT_TYPE_OCTECT_BYTES:
-			writeOctetResultFromBytes(w, ufopResult, ufopResultContentType)
+			writeOctetResultFromBytes(w, ufopResult)
 		case RESULT_TYPE_OCTECT_FILE:
-			writeOctetResultFromFile(w, ufopResult, ufopResultContentType)
+			writeOctetResultFromFile(w, ufopResult)
 		case RESULT_TYPE_OCTECT_URL:
-			writeOctectResultFromUrl(w, ufopResult)
+			writeOctectResultFromUrl(req.Context(), w, ufopResult)
+		case RESULT_TYPE_OCTECT_STREAM:
+			err = writeOctetResultFromStream(w, ufopResult, logger)
 		}
 	}
+	logger.Done(err)
 }
 
-func handleJob(ufopReq UfopRequest, ufopPrefix string, jobHandlers map[string]UfopJobHandler) (interface{}, int, string, error) {
-	var ufopResult interface{}
-	var resultType int
-	var contentType string
+//the bucket of the first fop for the logs, the saveas bucket if the fop does
+//not use any
+func cmdBucket(cfg *UfopConfig, jobHandlers map[string]UfopJobHandler, cmd string) string {
+	fopCmd, saveasBucket, _, _, _ := parseSaveas(cmd)
+	firstCmd := strings.Split(fopCmd, PIPELINE_SEPARATOR)[0]
+	if bucketUser, ok := jobHandlers[cmdFop(firstCmd)].(UfopBucketUser); ok {
+		read, write, _ := bucketUser.Buckets(strings.TrimPrefix(firstCmd, cfg.UfopPrefix))
+		if len(read) > 0 {
+			return read[0]
+		}
+		if len(write) > 0 {
+			return write[0]
+		}
+	}
+	return saveasBucket
+}
+
+//create the scratch dir of the request, the error is written on failure
+func (this *UfopServer) attachScratch(w http.ResponseWriter, ufopReq *UfopRequest) bool {
+	scratch, scratchErr := this.scratch.New(ufopReq.ReqId)
+	if scratchErr != nil {
+		ufopReq.Logger().Errorf("%s", scratchErr)
+		err := NewUfopError(ERROR_INTERNAL, "create scratch dir error")
+		ufopReq.Logger().Done(err)
+		writeUfopError(w, err)
+		return false
+	}
+	ufopReq.scratch = scratch
+	return true
+}
+
+/*
+GET /jobs/<id>			job state, progress and json result
+GET /jobs/<id>/output	octet result of the finished job
+*/
+func (this *UfopServer) serveJob(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeUfopError(w, NewUfopError(ERROR_METHOD_NOT_ALLOWED, "method not allowed"))
+		return
+	}
+
+	if _, authOk := this.authenticate(w, req, nil); !authOk {
+		return
+	}
+
+	items := strings.Split(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+	if len(items) > 2 || (len(items) == 2 && items[1] != "output") {
+		writeUfopError(w, NewUfopError(ERROR_NOT_FOUND, "not found"))
+		return
+	}
+
+	job, ok := this.jobManager.Get(items[0])
+	if !ok {
+		writeUfopError(w, NewUfopError(ERROR_NOT_FOUND, "no such job"))
+		return
+	}
+
+	if len(items) == 1 {
+		writeJsonResult(w, 200, job)
+		return
+	}
+
+	if job.State != JOB_STATE_DONE || job.Output == "" {
+		writeUfopError(w, NewUfopError(ERROR_NOT_FOUND, "no output available for the job"))
+		return
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	defer func() {
+		this.metrics.AddResponseBytes(job.Fop, cw.written)
+	}()
+	w = cw
+
+	switch job.result.Type {
+	case RESULT_TYPE_OCTECT_BYTES, RESULT_TYPE_OCTECT_FILE, RESULT_TYPE_OCTECT_STREAM:
+		output := job.result
+		output.Body = job.outputPath
+		//the size is taken from the saved file
+		output.Size = 0
+		writeOctetFile(w, output)
+	case RESULT_TYPE_OCTECT_URL:
+		output := job.result
+		output.Body = job.outputUrl
+		writeOctectResultFromUrl(req.Context(), w, output)
+	}
+}
+
+//run the job, each fop of the pipeline is run when the concurrency limits
+//allow, with its own deadline, for stream results the job slot is held until
+//the stream is written
+func (this *UfopServer) runJob(ctx context.Context, ufopReq UfopRequest) (UfopResult, error) {
+	atomic.AddInt64(&this.inflight, 1)
+	cfg, jobHandlers, storage := this.current()
+
+	label := this.fopLabel(ufopReq.Cmd)
+	done := this.metrics.StartJob(label)
+	//checked before waiting for the job slot
+	keys, err := policyKeys(cfg, jobHandlers, ufopReq)
+	if err == nil {
+		err = this.policy.take(keys)
+	}
+	if err != nil {
+		done(WrapUfopError(ERROR_INTERNAL, err).Code)
+		atomic.AddInt64(&this.inflight, -1)
+		return UfopResult{}, err
+	}
+	ctx = utils.WithByteCounter(ctx, func(n int64) {
+		this.metrics.AddDownloadBytes(label, n)
+		this.policy.addBytes(keys, n)
+	})
+	var rejected atomic.Value
+	ctx = utils.WithURLRejectHandler(ctx, func(rErr *utils.URLPolicyError) {
+		rejected.Store(rErr)
+	})
+
+	start := func(ctx context.Context, fop string) (context.Context, func(), error) {
+		return this.startFop(ctx, cfg, fop)
+	}
+
+	finish := func(jobErr error) {
+		if jobErr == nil {
+			done("")
+		} else {
+			done(WrapUfopError(ERROR_FOP_FAILED, jobErr).Code)
+		}
+		atomic.AddInt64(&this.inflight, -1)
+	}
+
+	fopCmd, saveasBucket, saveasKey, saveas, err := parseSaveas(ufopReq.Cmd)
+	if err != nil {
+		finish(err)
+		return UfopResult{}, err
+	}
+	ufopReq.Cmd = fopCmd
+
+	result, err := handleJob(ctx, ufopReq, cfg.UfopPrefix, jobHandlers, start)
+	if err != nil && this.ctx.Err() != nil {
+		err = shutdownUfopError()
+	} else if err != nil && ufopReq.scratch.exceeded() {
+		//the handler error is caused by the scratch quota
+		err = NewUfopError(ERROR_SCRATCH_FULL, "scratch space quota exceeded")
+	} else if rErr, ok := rejected.Load().(*utils.URLPolicyError); ok && err != nil {
+		//the handler error is caused by the url policy
+		err = NewUfopError(ERROR_URL_FORBIDDEN, rErr.Error())
+	}
+	if err == nil && saveas {
+		var saveasResult UfopSaveasResult
+		saveasResult, err = saveResult(ctx, storage, ufopReq.scratch, result, saveasBucket, saveasKey)
+		result = UfopResult{
+			Type:     RESULT_TYPE_JSON,
+			Body:     saveasResult,
+			MimeType: CONTENT_TYPE_JSON,
+		}
+	}
+	if err == nil && result.Type == RESULT_TYPE_OCTECT_STREAM {
+		if stream := toStreamWriter(result.Body); stream != nil {
+			result.Body = UfopStreamWriter(func(w io.Writer) error {
+				streamErr := stream(w)
+				finish(streamErr)
+				return streamErr
+			})
+			return result, err
+		}
+		err = NewUfopError(ERROR_INTERNAL, "invalid stream result")
+	}
+
+	finish(err)
+	return result, err
+}
+
+//wait for the slot of the fop and set its deadline, release when the result
+//of the fop is consumed
+func (this *UfopServer) startFop(ctx context.Context, cfg *UfopConfig, fop string) (fopCtx context.Context, release func(), err error) {
+	cancel := context.CancelFunc(func() {})
+	if handlerCfg, ok := cfg.Handlers[strings.TrimPrefix(fop, cfg.UfopPrefix)]; ok && handlerCfg.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(handlerCfg.Timeout)*time.Second)
+	}
+	releaseSlot, aErr := this.limiter.Acquire(ctx, fop)
+	if aErr != nil {
+		cancel()
+		err = WrapUfopError(ERROR_INTERNAL, aErr)
+		return
+	}
+	fopCtx = ctx
+	release = func() {
+		releaseSlot()
+		cancel()
+	}
+	return
+}
+
+//fop name used as the metrics label, the first fop for the pipelines
+func (this *UfopServer) fopLabel(cmd string) string {
+	fop := cmdFop(cmd)
+	_, jobHandlers, _ := this.current()
+	if _, ok := jobHandlers[fop]; ok {
+		return fop
+	}
+	return METRICS_UNKNOWN_FOP
+}
+
+func (this *UfopServer) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeUfopError(w, NewUfopError(ERROR_METHOD_NOT_ALLOWED, "method not allowed"))
+		return
+	}
+	this.metrics.WriteTo(w)
+}
+
+func handleJob(ctx context.Context, ufopReq UfopRequest, ufopPrefix string, jobHandlers map[string]UfopJobHandler,
+	start fopStarter) (result UfopResult, err error) {
+	if strings.Contains(ufopReq.Cmd, PIPELINE_SEPARATOR) {
+		return handlePipeline(ctx, ufopReq, ufopPrefix, jobHandlers, start)
+	}
+	fopCtx, release, err := start(ctx, cmdFop(ufopReq.Cmd))
+	if err != nil {
+		return
+	}
+	result, err = handleFop(fopCtx, ufopReq, ufopPrefix, jobHandlers)
+	result = releaseAfterWritten(result, err, release)
+	return
+}
+
+func handleFop(ctx context.Context, ufopReq UfopRequest, ufopPrefix string, jobHandlers map[string]UfopJobHandler) (UfopResult, error) {
+	var ufopResult UfopResult
 	var err error
-	cmd := ufopReq.Cmd
 
-	items := strings.SplitN(cmd, "/", 2)
-	fop := items[0]
+	fop := cmdFop(ufopReq.Cmd)
 	if jobHandler, ok := jobHandlers[fop]; ok {
 		ufopReq.Cmd = strings.TrimPrefix(ufopReq.Cmd, ufopPrefix)
-		ufopResult, resultType, contentType, err = jobHandler.Do(ufopReq)
+		if h, ok := jobHandler.(UfopContextJobHandler); ok {
+			ufopResult, err = h.DoContext(ctx, ufopReq)
+		} else {
+			ufopResult, err = jobHandler.Do(ufopReq)
+		}
+		//the handler error is caused by the cancellation
+		if err != nil && ctx.Err() != nil {
+			err = contextUfopError(ctx)
+		}
 	} else {
-		err = errors.New("no fop available for the request")
+		err = NewUfopError(ERROR_NO_FOP, "no fop available for the request")
 	}
-	return ufopResult, resultType, contentType, err
+	return ufopResult, err
 }
 
-func writeJsonError(w http.ResponseWriter, statusCode int, message string) {
+//write the error with its code, errors without code are internal errors
+func writeUfopError(w http.ResponseWriter, err error) {
+	ufopErr := WrapUfopError(ERROR_INTERNAL, err)
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	respErr := struct {
-		Error string `json:"error"`
-	}{
-		Error: message,
+	if ufopErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ufopErr.RetryAfter))
 	}
-	respErrBytes, _ := json.Marshal(&respErr)
-	_, err := w.Write(respErrBytes)
-	if err != nil {
-		log.Error("write error error", err)
+	w.WriteHeader(ufopErr.Status)
+	respErrBytes, _ := json.Marshal(ufopErr)
+	_, wErr := w.Write(respErrBytes)
+	if wErr != nil {
+		log.Error("write error error", wErr)
 	}
 }
 
 func writeJsonResult(w http.ResponseWriter, statusCode int, result interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
 	data, err := json.Marshal(result)
 	if err != nil {
 		log.Error("encode ufop result error,", err)
-		writeJsonError(w, 500, "encode ufop result error")
-	} else {
-		_, err := io.WriteString(w, string(data))
-		if err != nil {
-			log.Error("write json response error", err)
-		}
+		writeUfopError(w, NewUfopError(ERROR_INTERNAL, "encode ufop result error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(statusCode)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Error("write json response error", err)
 	}
 }
 
-func writeOctetResultFromBytes(w http.ResponseWriter, result interface{}, mimeType string) {
-	if mimeType != "" {
-		w.Header().Set("Content-Type", mimeType)
+//content type, length, disposition and the extra headers of the octet result
+func setOctetHeaders(w http.ResponseWriter, result UfopResult) {
+	if result.MimeType != "" {
+		w.Header().Set("Content-Type", result.MimeType)
 	}
-	if respData := result.([]byte); respData != nil {
+	if result.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(result.Size, 10))
+	}
+	if result.Filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+			map[string]string{"filename": result.Filename}))
+	}
+	for key, value := range result.Headers {
+		w.Header().Set(key, value)
+	}
+}
+
+func writeOctetResultFromBytes(w http.ResponseWriter, result UfopResult) {
+	respData, _ := result.Body.([]byte)
+	result.Size = int64(len(respData))
+	setOctetHeaders(w, result)
+	if respData != nil {
 		_, err := w.Write(respData)
 		if err != nil {
 			log.Error("write octect from bytes error", err)
@@ -170,24 +764,34 @@ func writeOctetResultFromBytes(w http.ResponseWriter, result interface{}, mimeTy
 	}
 }
 
-func writeOctetResultFromFile(w http.ResponseWriter, result interface{}, mimeType string) {
+func writeOctetResultFromFile(w http.ResponseWriter, result UfopResult) {
 	//delete the tmp file
 	var filePath string
-	if v, ok := result.(string); ok {
+	if v, ok := result.Body.(string); ok {
 		filePath = v
 	}
 	defer os.Remove(filePath)
-	//set response
-	if mimeType != "" {
-		w.Header().Set("Content-Type", mimeType)
+	writeOctetFile(w, result)
+}
+
+func writeOctetFile(w http.ResponseWriter, result UfopResult) {
+	var filePath string
+	if v, ok := result.Body.(string); ok {
+		filePath = v
 	}
 	//output result
 	resultFp, openErr := os.Open(filePath)
 	if openErr != nil {
 		log.Error("open result local file error", openErr)
+		writeUfopError(w, NewUfopError(ERROR_INTERNAL, "open result local file error"))
 		return
 	}
 	defer resultFp.Close()
+	if stat, statErr := resultFp.Stat(); statErr == nil {
+		result.Size = stat.Size()
+	}
+	//set response
+	setOctetHeaders(w, result)
 	_, cpErr := io.Copy(w, resultFp)
 	if cpErr != nil {
 		log.Error("write octect from local file error", cpErr)
@@ -195,22 +799,41 @@ func writeOctetResultFromFile(w http.ResponseWriter, result interface{}, mimeTyp
 	}
 }
 
-func writeOctectResultFromUrl(w http.ResponseWriter, result interface{}) {
+//the response is sent in chunked encoding as the stream is written, unless the size is known
+func writeOctetResultFromStream(w http.ResponseWriter, result UfopResult, logger *UfopLogger) (err error) {
+	setOctetHeaders(w, result)
+	if stream, ok := result.Body.(UfopStreamWriter); ok {
+		if err = stream(w); err != nil {
+			//too late to change the status, the client gets a truncated body
+			logger.Errorf("write octect from stream error, %s", err)
+		}
+	}
+	return
+}
+
+//the remote resource is downloaded with the context of the request, stopped
+//when the client goes away or the server shuts down
+func writeOctectResultFromUrl(ctx context.Context, w http.ResponseWriter, result UfopResult) {
 	var resUrl string
-	if v, ok := result.(string); ok {
+	if v, ok := result.Body.(string); ok {
 		resUrl = v
 	}
 
-	resp, respErr := http.Get(resUrl)
+	resp, respErr := utils.DefaultFetcher().Open(ctx, resUrl, utils.FetchOptions{})
 	if respErr != nil {
 		log.Error("get remote resource error", respErr)
+		writeUfopError(w, NewUfopError(ERROR_UPSTREAM_FETCH_FAILED, "get remote resource error"))
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.Header.Get("Content-Type") != "" {
-		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	if result.MimeType == "" {
+		result.MimeType = resp.MimeType
+	}
+	if result.Size == 0 && resp.ContentLength > 0 {
+		result.Size = resp.ContentLength
 	}
+	setOctetHeaders(w, result)
 	_, cpErr := io.Copy(w, resp.Body)
 	if cpErr != nil {
 		log.Error("write octect from remote resource error", cpErr)
@@ -0,0 +1,190 @@
+package ufop_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"ufop"
+)
+
+//the handler runs until the delay passes or the job is cancelled, with a temp
+//file removed when it returns
+type slowHandler struct {
+	delay   time.Duration
+	started chan string
+}
+
+func (this *slowHandler) Name() string {
+	return "slow"
+}
+
+func (this *slowHandler) InitConfig(jobConf []byte, storage ufop.UfopStorage) error {
+	return nil
+}
+
+func (this *slowHandler) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *slowHandler) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	tmpFp, err := ioutil.TempFile("", "ufop_slow_")
+	if err != nil {
+		return
+	}
+	tmpFp.Close()
+	defer os.Remove(tmpFp.Name())
+	this.started <- tmpFp.Name()
+
+	select {
+	case <-time.After(this.delay):
+		result = ufop.UfopResult{Type: ufop.RESULT_TYPE_JSON, Body: "done"}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
+
+//listen on a free port, Listen returns to the channel
+func listenTestServer(t *testing.T, env *testEnv) (endPoint string, listenErr chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	env.cfg.ListenHost = "127.0.0.1"
+	env.cfg.ListenPort = port
+	listenErr = make(chan error, 1)
+	go func() {
+		listenErr <- env.serv.Listen()
+	}()
+
+	endPoint = fmt.Sprintf("http://127.0.0.1:%d", port)
+	for index := 0; index < 50; index++ {
+		if resp, getErr := http.Get(endPoint + "/health"); getErr == nil {
+			resp.Body.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("server not started")
+	return
+}
+
+func postUfop(endPoint, cmd string) (resp *http.Response, err error) {
+	reqData, _ := json.Marshal(map[string]interface{}{
+		"cmd": testPrefix + cmd,
+	})
+	return http.Post(endPoint+"/uop", "application/json", bytes.NewReader(reqData))
+}
+
+func TestShutdownDrain(t *testing.T) {
+	env := newTestEnv(t)
+	handler := &slowHandler{delay: 300 * time.Millisecond, started: make(chan string, 1)}
+	env.register(handler, map[string]interface{}{})
+	endPoint, listenErr := listenTestServer(t, env)
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := postUfop(endPoint, "slow")
+		respCh <- resp
+	}()
+	tmpPath := <-handler.started
+
+	//the running request finishes before the server stops
+	env.serv.Shutdown()
+	resp := <-respCh
+	if resp == nil || resp.StatusCode != 200 {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	resp.Body.Close()
+	if err := <-listenErr; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpPath); !os.IsNotExist(err) {
+		t.Fatal("temp file not removed")
+	}
+	if _, err := http.Get(endPoint + "/health"); err == nil {
+		t.Fatal("server still serving")
+	}
+}
+
+func TestShutdownCancel(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.ShutdownTimeout = 1
+	handler := &slowHandler{delay: time.Hour, started: make(chan string, 2)}
+	env.register(handler, map[string]interface{}{})
+	endPoint, listenErr := listenTestServer(t, env)
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, _ := postUfop(endPoint, "slow")
+		respCh <- resp
+	}()
+	tmpPath := <-handler.started
+
+	//async job
+	resp, err := http.Post(endPoint+"/uop?async=1", "application/json",
+		bytes.NewReader([]byte(`{"cmd":"`+testPrefix+`slow"}`)))
+	if err != nil || resp.StatusCode != 202 {
+		t.Fatalf("unexpected response %v %v", resp, err)
+	}
+	resp.Body.Close()
+	jobTmpPath := <-handler.started
+
+	start := time.Now()
+	env.serv.Shutdown()
+	if elapsed := time.Since(start); elapsed < time.Second || elapsed > 5*time.Second {
+		t.Fatalf("unexpected shutdown time %s", elapsed)
+	}
+	if err := <-listenErr; err != nil {
+		t.Fatal(err)
+	}
+
+	//the cancelled request gets the error if the connection is still open
+	if resp := <-respCh; resp != nil {
+		respData, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 503 || !bytes.Contains(respData, []byte(ufop.ERROR_SHUTTING_DOWN)) {
+			t.Fatalf("unexpected response %d %s", resp.StatusCode, respData)
+		}
+	}
+	for _, path := range []string{tmpPath, jobTmpPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("temp file %s not removed", path)
+		}
+	}
+
+	//no more async jobs accepted
+	w := env.doAsync("slow")
+	expectError(t, w, 503, ufop.ERROR_SHUTTING_DOWN, "server is shutting down")
+}
+
+func TestShutdownBeforeListen(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.ListenHost = "127.0.0.1"
+	env.cfg.ListenPort = 0
+	env.serv.Shutdown()
+
+	//the signal came before the server started, it never serves
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- env.serv.Listen()
+	}()
+	select {
+	case err := <-listenErr:
+		if err != nil {
+			t.Fatalf("unexpected listen error %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server started after shutdown")
+	}
+}
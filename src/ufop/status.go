@@ -0,0 +1,112 @@
+package ufop
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+type UfopHandlerFailure struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type UfopHandlerStatus struct {
+	Name           string                 `json:"name"`
+	Limits         map[string]interface{} `json:"limits,omitempty"`
+	MaxConcurrency int                    `json:"max_concurrency,omitempty"`
+	Timeout        int                    `json:"timeout,omitempty"`
+	Binaries       []string               `json:"binaries,omitempty"`
+}
+
+type UfopHandlersStatus struct {
+	Version  string               `json:"version"`
+	Handlers []UfopHandlerStatus  `json:"handlers"`
+	Failed   []UfopHandlerFailure `json:"failed,omitempty"`
+}
+
+//liveness, the process is able to serve http
+func (this *UfopServer) serveHealth(w http.ResponseWriter, req *http.Request) {
+	writeJsonResult(w, 200, map[string]string{
+		"status": "ok",
+	})
+}
+
+//readiness, all the handlers are registered and their programs are found
+func (this *UfopServer) serveReady(w http.ResponseWriter, req *http.Request) {
+	_, jobHandlers, _ := this.current()
+	readyErrors := make([]string, 0)
+	if this.isShuttingDown() {
+		readyErrors = append(readyErrors, "server is shutting down")
+	}
+	for _, failure := range this.failures() {
+		readyErrors = append(readyErrors, failure.Error)
+	}
+
+	for _, fop := range sortedFops(jobHandlers) {
+		if h, ok := jobHandlers[fop].(UfopBinaryDependent); ok {
+			for _, binary := range h.RequiredBinaries() {
+				if _, lookErr := exec.LookPath(binary); lookErr != nil {
+					readyErrors = append(readyErrors, fmt.Sprintf("program '%s' required by '%s' not found", binary, fop))
+				}
+			}
+		}
+	}
+
+	if len(readyErrors) > 0 {
+		writeJsonResult(w, 503, map[string]interface{}{
+			"ready":  false,
+			"errors": readyErrors,
+		})
+		return
+	}
+	writeJsonResult(w, 200, map[string]interface{}{
+		"ready": true,
+	})
+}
+
+//the registered fops with their limits
+func (this *UfopServer) serveHandlers(w http.ResponseWriter, req *http.Request) {
+	cfg, jobHandlers, _ := this.current()
+	status := UfopHandlersStatus{
+		Version:  this.version,
+		Handlers: make([]UfopHandlerStatus, 0, len(jobHandlers)),
+		Failed:   this.failures(),
+	}
+
+	for _, fop := range sortedFops(jobHandlers) {
+		jobHandler := jobHandlers[fop]
+		handlerStatus := UfopHandlerStatus{
+			Name: fop,
+		}
+		if h, ok := jobHandler.(UfopLimitsReporter); ok {
+			handlerStatus.Limits = h.Limits()
+		}
+		if h, ok := jobHandler.(UfopBinaryDependent); ok {
+			handlerStatus.Binaries = h.RequiredBinaries()
+		}
+		if handlerCfg, ok := cfg.Handlers[strings.TrimPrefix(fop, cfg.UfopPrefix)]; ok {
+			handlerStatus.MaxConcurrency = handlerCfg.MaxConcurrency
+			handlerStatus.Timeout = handlerCfg.Timeout
+		}
+		status.Handlers = append(status.Handlers, handlerStatus)
+	}
+
+	writeJsonResult(w, 200, status)
+}
+
+func (this *UfopServer) failures() []UfopHandlerFailure {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.failedHandlers
+}
+
+func sortedFops(jobHandlers map[string]UfopJobHandler) (fops []string) {
+	for fop := range jobHandlers {
+		fops = append(fops, fop)
+	}
+	sort.Strings(fops)
+	return
+}
@@ -0,0 +1,113 @@
+package ufop_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"ufop"
+)
+
+//the handler reports its programs and limits, and fails to init if initErr is set
+type statusHandler struct {
+	name     string
+	binaries []string
+	initErr  error
+}
+
+func (this *statusHandler) Name() string {
+	return this.name
+}
+
+func (this *statusHandler) InitConfig(jobConf []byte, storage ufop.UfopStorage) error {
+	return this.initErr
+}
+
+func (this *statusHandler) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return ufop.UfopResult{Type: ufop.RESULT_TYPE_JSON, Body: "done"}, nil
+}
+
+func (this *statusHandler) RequiredBinaries() []string {
+	return this.binaries
+}
+
+func (this *statusHandler) Limits() map[string]interface{} {
+	return map[string]interface{}{"max_file_size": 1024}
+}
+
+func (this *testEnv) ready() (w *httptest.ResponseRecorder, readyResp map[string]interface{}) {
+	w = httptest.NewRecorder()
+	this.serv.ServeReady(w, httptest.NewRequest("GET", "/ready", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &readyResp); err != nil {
+		this.t.Fatalf("invalid ready body, %s", w.Body.String())
+	}
+	return
+}
+
+func TestReady(t *testing.T) {
+	env := newTestEnv(t)
+	env.registerLimited(&statusHandler{name: "status", binaries: []string{"sh"}}, 0)
+	w, readyResp := env.ready()
+	expectStatus(t, w, 200)
+	if readyResp["ready"] != true {
+		t.Fatalf("expect ready, got %s", w.Body.String())
+	}
+
+	//the program is not in PATH
+	env.registerLimited(&statusHandler{name: "missing", binaries: []string{"qufop-missing-program"}}, 0)
+	w, readyResp = env.ready()
+	expectStatus(t, w, 503)
+	expectErrors := []interface{}{"program 'qufop-missing-program' required by 'qn-missing' not found"}
+	if readyResp["ready"] != false || !reflect.DeepEqual(readyResp["errors"], expectErrors) {
+		t.Fatalf("expect errors %v, got %s", expectErrors, w.Body.String())
+	}
+
+	//the handler failed to init
+	env = newTestEnv(t)
+	env.cfg.Handlers = map[string]ufop.UfopHandlerConfig{"broken": {Settings: []byte("{}")}}
+	if err := env.serv.RegisterJobHandler(&statusHandler{name: "broken", initErr: errors.New("bad settings")}); err == nil {
+		t.Fatal("expect init error")
+	}
+	w, readyResp = env.ready()
+	expectStatus(t, w, 503)
+	expectErrors = []interface{}{"init job handler for cmd 'broken' error, bad settings"}
+	if readyResp["ready"] != false || !reflect.DeepEqual(readyResp["errors"], expectErrors) {
+		t.Fatalf("expect errors %v, got %s", expectErrors, w.Body.String())
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	env := newTestEnv(t)
+	env.serv.SetVersion("1.2.3")
+	env.registerLimited(&statusHandler{name: "status", binaries: []string{"sh"}}, 2)
+	env.registerLimited(newBlockHandler("block"), 0)
+	env.cfg.Handlers["broken"] = ufop.UfopHandlerConfig{Settings: []byte("{}")}
+	env.serv.RegisterJobHandler(&statusHandler{name: "broken", initErr: errors.New("bad settings")})
+
+	w := httptest.NewRecorder()
+	env.serv.ServeHandlers(w, httptest.NewRequest("GET", "/handlers", nil))
+	expectStatus(t, w, 200)
+	var status ufop.UfopHandlersStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("invalid handlers body, %s", w.Body.String())
+	}
+	expectHandlers := ufop.UfopHandlersStatus{
+		Version: "1.2.3",
+		Handlers: []ufop.UfopHandlerStatus{
+			{Name: "qn-block"},
+			{
+				Name:           "qn-status",
+				Limits:         map[string]interface{}{"max_file_size": float64(1024)},
+				MaxConcurrency: 2,
+				Binaries:       []string{"sh"},
+			},
+		},
+		Failed: []ufop.UfopHandlerFailure{
+			{Name: "broken", Error: "init job handler for cmd 'broken' error, bad settings"},
+		},
+	}
+	if !reflect.DeepEqual(status, expectHandlers) {
+		t.Fatalf("expect handlers %+v, got %s", expectHandlers, w.Body.String())
+	}
+}
@@ -0,0 +1,165 @@
+package ufop
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"ufop/utils"
+)
+
+const (
+	STORAGE_TYPE_QINIU = "qiniu"
+	STORAGE_TYPE_LOCAL = "local"
+)
+
+//codes of the batch stat items, same as the qiniu rs api
+const (
+	STORAGE_CODE_OK             = 200
+	STORAGE_CODE_NO_SUCH_FILE   = 612
+	STORAGE_CODE_FILE_EXISTS    = 614
+	STORAGE_CODE_NO_SUCH_BUCKET = 631
+)
+
+type UfopEntry struct {
+	Hash     string `json:"hash"`
+	Fsize    int64  `json:"fsize"`
+	PutTime  int64  `json:"putTime"`
+	MimeType string `json:"mimeType"`
+}
+
+type UfopEntryPath struct {
+	Bucket string
+	Key    string
+}
+
+type UfopStatResult struct {
+	Data  UfopEntry `json:"data"`
+	Error string    `json:"error"`
+	Code  int       `json:"code"`
+}
+
+type UfopPutExtra struct {
+	MimeType string
+	//replace the file if the key exists
+	Overwrite bool
+}
+
+type UfopPutResult struct {
+	Hash string `json:"hash"`
+	Key  string `json:"key"`
+}
+
+//the bucket storage used by the handlers, the errors of the storage service
+//are returned as plain errors with the message of the service
+type UfopStorage interface {
+	Stat(ctx context.Context, bucket, key string) (UfopEntry, error)
+	//the results are in the order of the entries, check the code of each item
+	BatchStat(ctx context.Context, entries []UfopEntryPath) ([]UfopStatResult, error)
+	//read the resource by its url, the caller closes the body
+	Get(ctx context.Context, resUrl string) (body io.ReadCloser, mimeType string, err error)
+	Put(ctx context.Context, bucket, key string, data io.Reader, extra *UfopPutExtra) (UfopPutResult, error)
+	//upload large files in blocks
+	PutResumable(ctx context.Context, bucket, key string, data io.ReaderAt, fsize int64, extra *UfopPutExtra) (UfopPutResult, error)
+	//the storage accessed by the keys, the keys of the handler config take
+	//precedence over the ones of the ufop config, empty keys return the storage itself
+	WithCredentials(accessKey, secretKey string) UfopStorage
+}
+
+//create the storage by the ufop config
+func NewStorage(cfg *UfopConfig) (storage UfopStorage, err error) {
+	switch cfg.StorageType {
+	case "", STORAGE_TYPE_QINIU:
+		storage = NewQiniuStorage(cfg.AccessKey, cfg.SecretKey)
+	case STORAGE_TYPE_LOCAL:
+		storage, err = NewLocalStorage(cfg.StorageDir)
+	default:
+		err = errors.New(fmt.Sprintf("unknown storage type '%s'", cfg.StorageType))
+	}
+	return
+}
+
+//create the storage without touching the disk, used to check the config only
+func newCheckStorage(cfg *UfopConfig) (storage UfopStorage, err error) {
+	if cfg.StorageType != STORAGE_TYPE_LOCAL {
+		return NewStorage(cfg)
+	}
+	if cfg.StorageDir == "" {
+		err = errors.New("no storage dir configured for the local storage")
+		return
+	}
+	storage = &LocalStorage{rootDir: cfg.StorageDir}
+	return
+}
+
+//read the resource by the fetcher, the status other than 200 is an error, the
+//fetch options are taken from the context
+func httpGet(ctx context.Context, resUrl string) (body io.ReadCloser, mimeType string, err error) {
+	resp, fetchErr := utils.DefaultFetcher().Open(ctx, resUrl, utils.FetchOptionsFrom(ctx))
+	if fetchErr != nil {
+		err = fetchErr
+		return
+	}
+
+	body = resp.Body
+	mimeType = resp.MimeType
+	return
+}
+
+//save the resource to the local file
+func StorageDownload(ctx context.Context, storage UfopStorage, resUrl, localPath string) (mimeType string, err error) {
+	localFp, openErr := os.Create(localPath)
+	if openErr != nil {
+		err = errors.New(fmt.Sprintf("open file by local path failed, %s", openErr.Error()))
+		return
+	}
+	defer localFp.Close()
+
+	return StorageDownloadTo(ctx, storage, resUrl, localFp)
+}
+
+//save the resource to the writer, like the file of the scratch dir
+func StorageDownloadTo(ctx context.Context, storage UfopStorage, resUrl string, w io.Writer) (mimeType string, err error) {
+	body, mimeType, getErr := storage.Get(ctx, resUrl)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	defer body.Close()
+
+	if _, cpErr := io.Copy(w, body); cpErr != nil {
+		if cpErr == utils.ErrFetchTooLarge {
+			//kept for the callers to tell the oversized resource
+			err = cpErr
+			return
+		}
+		err = errors.New(fmt.Sprintf("save remote file to local failed, %s", cpErr.Error()))
+		return
+	}
+	return
+}
+
+//upload the local file, the resumable put is used for large files
+func StoragePutFile(ctx context.Context, storage UfopStorage, bucket, key, localPath string,
+	resumableThreshold int64, extra *UfopPutExtra) (putRet UfopPutResult, err error) {
+	localFp, openErr := os.Open(localPath)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	defer localFp.Close()
+
+	stat, statErr := localFp.Stat()
+	if statErr != nil {
+		err = statErr
+		return
+	}
+
+	if stat.Size() <= resumableThreshold {
+		putRet, err = storage.Put(ctx, bucket, key, localFp, extra)
+	} else {
+		putRet, err = storage.PutResumable(ctx, bucket, key, localFp, stat.Size(), extra)
+	}
+	return
+}
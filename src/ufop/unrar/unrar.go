@@ -2,3 +2,547 @@ package unrar
 
 //THIS unrar RELYS ON THE unrar PROGRAM ON UBUNTU
 //USE sudo apt-get install -y unrar TO INSTALL IT
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"ufop"
+	"ufop/utils"
+)
+
+const (
+	UNRAR_MAX_RAR_FILE_LENGTH uint64 = 1 * 1024 * 1024 * 1024
+	UNRAR_MAX_FILE_LENGTH     uint64 = 100 * 1024 * 1024 //100MB
+	UNRAR_MAX_FILE_COUNT      int    = 10                //10
+)
+
+const (
+	RESUMABLE_PUT_THRESHOLD = 20 * 1024 * 1024
+)
+
+//local name of the first volume, the other volumes are named after it
+const (
+	UNRAR_VOLUME_NAME_PREFIX = "archive"
+)
+
+//how often the output is measured while extracting
+const (
+	UNRAR_OUTPUT_CHECK_INTERVAL = 100 * time.Millisecond
+)
+
+type UnrarResult struct {
+	Files []UnrarFile `json:"files"`
+}
+
+type UnrarFile struct {
+	Key   string `json:"key"`
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type Unrarer struct {
+	storage          ufop.UfopStorage
+	maxRarFileLength uint64
+	maxFileLength    uint64
+	maxFileCount     int
+}
+
+type UnrarerConfig struct {
+	//ak & sk
+	ufop.UfopCredentials
+
+	UnrarMaxRarFileLength uint64 `json:"unrar_max_rar_file_length,omitempty"`
+	UnrarMaxFileLength    uint64 `json:"unrar_max_file_length,omitempty"`
+	UnrarMaxFileCount     int    `json:"unrar_max_file_count,omitempty"`
+}
+
+type rarEntry struct {
+	name  string
+	size  uint64
+	isDir bool
+}
+
+func (this *Unrarer) Name() string {
+	return "unrar"
+}
+
+func (this *Unrarer) RequiredBinaries() []string {
+	return []string{"unrar"}
+}
+
+func (this *Unrarer) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"unrar_max_rar_file_length": this.maxRarFileLength,
+		"unrar_max_file_length":     this.maxFileLength,
+		"unrar_max_file_count":      this.maxFileCount,
+	}
+}
+
+func (this *Unrarer) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
+	config := UnrarerConfig{}
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
+	if decodeErr != nil {
+		err = errors.New(fmt.Sprintf("Parse unrar config failed, %s", decodeErr.Error()))
+		return
+	}
+
+	if config.UnrarMaxFileCount <= 0 {
+		this.maxFileCount = UNRAR_MAX_FILE_COUNT
+	} else {
+		this.maxFileCount = config.UnrarMaxFileCount
+	}
+
+	if config.UnrarMaxFileLength <= 0 {
+		this.maxFileLength = UNRAR_MAX_FILE_LENGTH
+	} else {
+		this.maxFileLength = config.UnrarMaxFileLength
+	}
+
+	if config.UnrarMaxRarFileLength <= 0 {
+		this.maxRarFileLength = UNRAR_MAX_RAR_FILE_LENGTH
+	} else {
+		this.maxRarFileLength = config.UnrarMaxRarFileLength
+	}
+
+	if credErr := config.LoadCredentials(); credErr != nil {
+		err = errors.New(fmt.Sprintf("Load unrar credentials failed, %s", credErr.Error()))
+		return
+	}
+	this.storage = storage.WithCredentials(config.AccessKey, config.SecretKey)
+
+	return
+}
+
+/*
+
+unrar/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>
+/volume/<encoded url>/volume/<encoded url>
+
+the src file is the first volume, the following volumes of a multi-volume
+archive are given in order by the optional volume parameters
+
+*/
+var unrarParser = utils.NewCommandParser("unrar",
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "prefix", Type: utils.PARAM_TYPE_BASE64},
+	utils.ParamSpec{Name: "overwrite", Type: utils.PARAM_TYPE_BOOL, Default: false},
+	utils.ParamSpec{Name: "volume", Type: utils.PARAM_TYPE_BASE64, Repeatable: true},
+)
+
+//the volumes are read from the bucket, and the unrared files are saved to it
+func (this *Unrarer) Buckets(cmd string) (read []string, write []string, err error) {
+	bucket, _, _, volumes, err := this.parse(cmd)
+	if err == nil {
+		if len(volumes) > 0 {
+			read = []string{bucket}
+		}
+		write = []string{bucket}
+	}
+	return
+}
+
+func (this *Unrarer) parse(cmd string) (bucket string, prefix string, overwrite bool, volumes []string, err error) {
+	params, pErr := unrarParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
+		return
+	}
+
+	bucket = params.String("bucket")
+	prefix = params.String("prefix")
+	overwrite = params.Bool("overwrite")
+	volumes = params.Strings("volume")
+	return
+}
+
+func (this *Unrarer) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *Unrarer) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
+	//parse command
+	bucket, prefix, overwrite, volumes, pErr := this.parse(req.Cmd)
+	if pErr != nil {
+		err = pErr
+		return
+	}
+
+	//check mimetype
+	if !(req.Src.MimeType == "application/x-rar-compressed" || req.Src.MimeType == "application/x-rar" ||
+		req.Src.MimeType == "application/vnd.rar") {
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported mimetype to unrar")
+		return
+	}
+	//check rar file length
+	if req.Src.Fsize > this.maxRarFileLength {
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src rar file length exceeds the limit")
+		return
+	}
+
+	//check the volumes, all should in bucket
+	rarFileLength := req.Src.Fsize
+	volumeHashes := make([]string, 0, len(volumes))
+	if len(volumes) > 0 {
+		statItems := make([]ufop.UfopEntryPath, 0, len(volumes))
+		for _, volume := range volumes {
+			volumeUri, parseErr := url.Parse(volume)
+			if parseErr != nil {
+				err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, "unrar parameter 'volume' format error")
+				return
+			}
+			statItems = append(statItems, ufop.UfopEntryPath{
+				Bucket: bucket,
+				Key:    strings.TrimPrefix(volumeUri.Path, "/"),
+			})
+		}
+
+		statRet, statErr := this.storage.BatchStat(ctx, statItems)
+		if statErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat error, %s", statErr.Error()))
+			return
+		}
+
+		for index := 0; index < len(statRet); index++ {
+			ret := statRet[index]
+			if ret.Code != ufop.STORAGE_CODE_OK {
+				if ret.Code == ufop.STORAGE_CODE_NO_SUCH_FILE {
+					err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such file or directory", volumes[index]))
+				} else if ret.Code == ufop.STORAGE_CODE_NO_SUCH_BUCKET {
+					err = ufop.NewUfopError(ufop.ERROR_RESOURCE_NOT_FOUND, fmt.Sprintf("batch stat '%s' error, no such bucket", volumes[index]))
+				} else {
+					err = ufop.NewUfopError(ufop.ERROR_STORAGE_FAILED, fmt.Sprintf("batch stat '%s' error, %d", volumes[index], ret.Code))
+				}
+				return
+			}
+			rarFileLength += uint64(ret.Data.Fsize)
+			volumeHashes = append(volumeHashes, ret.Data.Hash)
+		}
+
+		if rarFileLength > this.maxRarFileLength {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src rar file length exceeds the limit")
+			return
+		}
+	}
+
+	//prepare the working dir, volumes are saved as archive.part<N>.rar, and the
+	//old style names archive.part1.r<NN> are linked to them too, so that unrar
+	//can find the next volume whatever numbering the archive uses
+	scratch := req.Scratch()
+	workDir, tErr := scratch.TempDir("unrar")
+	if tErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create unrar work dir failed, %s", tErr.Error()))
+		return
+	}
+
+	req.Logger().Infof("downloading %d volume(s)", len(volumes)+1)
+	volumeUrls := append([]string{req.Src.Url}, volumes...)
+	var firstVolumePath string
+	//the total length of the volumes is limited while downloading, the fsize
+	//of the request is not trusted
+	var downloaded int64
+	for index, volumeUrl := range volumeUrls {
+		volumePath := filepath.Join(workDir, fmt.Sprintf("%s.part%d.rar", UNRAR_VOLUME_NAME_PREFIX, index+1))
+		if downloaded >= int64(this.maxRarFileLength) {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src rar file length exceeds the limit")
+			return
+		}
+		fetchOpts := utils.FetchOptions{MaxBytes: int64(this.maxRarFileLength) - downloaded}
+		if index > 0 {
+			fetchOpts.Hash = utils.StatHash(volumeUrl, volumeHashes[index-1])
+		}
+		size, dErr := this.download(utils.WithFetchOptions(ctx, fetchOpts), scratch, volumeUrl, volumePath)
+		if dErr == utils.ErrFetchTooLarge {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src rar file length exceeds the limit")
+			return
+		}
+		if dErr != nil {
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("get resource by url '%s' failed, %s", volumeUrl, dErr.Error()))
+			return
+		}
+		downloaded += size
+
+		if index == 0 {
+			firstVolumePath = volumePath
+		} else {
+			oldStylePath := filepath.Join(workDir, fmt.Sprintf("%s.part1.r%02d", UNRAR_VOLUME_NAME_PREFIX, index-1))
+			if lErr := os.Symlink(volumePath, oldStylePath); lErr != nil {
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("link rar volume failed, %s", lErr.Error()))
+				return
+			}
+		}
+	}
+
+	//list and check the entries before extracting anything
+	req.Logger().Infof("check and start to unrar")
+	listOutput, lErr := runUnrar(ctx, scratch, "lt", "-v", "-p-", "-c-", firstVolumePath)
+	if lErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("invalid rar file, %s", lErr.Error()))
+		return
+	}
+
+	rarEntries := parseTechnicalList(listOutput)
+	rarFileCount := 0
+	var rarFilesLength uint64
+	for _, rarEntry := range rarEntries {
+		//the names are paths in the output dir, none should escape it
+		if !filepath.IsLocal(filepath.FromSlash(rarEntry.name)) {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("invalid rar entry name '%s'", rarEntry.name))
+			return
+		}
+		if rarEntry.isDir {
+			continue
+		}
+		rarFileCount += 1
+		if rarEntry.size > this.maxFileLength {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "rar file length exceeds the limit")
+			return
+		}
+		rarFilesLength += rarEntry.size
+	}
+	if rarFileCount > this.maxFileCount {
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, "rar files count exceeds the limit")
+		return
+	}
+
+	outputDir := filepath.Join(workDir, "output")
+	if mErr := os.Mkdir(outputDir, 0755); mErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("create unrar output dir failed, %s", mErr.Error()))
+		return
+	}
+	//the headers can lie about the sizes, so the output is limited to the
+	//listed length while extracting
+	if xErr := extractRar(ctx, scratch, firstVolumePath, outputDir, rarFilesLength); xErr != nil {
+		err = xErr
+		return
+	}
+	//the files to upload are the regular files found in the output dir, the
+	//symbolic links are not followed
+	extractedFiles, wErr := listOutputFiles(outputDir)
+	if wErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("list unrar output failed, %s", wErr.Error()))
+		return
+	}
+
+	req.Logger().Infof("start to upload files")
+	putExtra := ufop.UfopPutExtra{
+		Overwrite: overwrite,
+	}
+
+	var unrarResult UnrarResult
+	unrarResult.Files = make([]UnrarFile, 0, rarFileCount)
+
+	for rarIndex, rarEntry := range rarEntries {
+		req.ReportProgress(rarIndex * 100 / len(rarEntries))
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			return
+		}
+
+		if rarEntry.isDir {
+			continue
+		}
+
+		var unrarFile UnrarFile
+
+		//save file to bucket
+		fileKey := prefix + rarEntry.name
+		unrarFile.Key = fileKey
+
+		localName := filepath.Clean(filepath.FromSlash(rarEntry.name))
+		localSize, extracted := extractedFiles[localName]
+		if !extracted {
+			unrarFile.Error = "file not extracted from the rar file"
+			unrarResult.Files = append(unrarResult.Files, unrarFile)
+			continue
+		}
+		localPath := filepath.Join(outputDir, localName)
+		//the headers can lie about the size
+		if uint64(localSize) > this.maxFileLength {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "rar file length exceeds the limit")
+			return
+		}
+
+		req.Logger().Infof("start to put file %s", rarEntry.name)
+		putRet, putErr := ufop.StoragePutFile(ctx, this.storage, bucket, fileKey, localPath,
+			RESUMABLE_PUT_THRESHOLD, &putExtra)
+		if putErr != nil {
+			unrarFile.Error = fmt.Sprintf("save unrar file to bucket error, %s", putErr.Error())
+		} else {
+			unrarFile.Hash = putRet.Hash
+		}
+		req.Logger().Infof("end put file %s", rarEntry.name)
+
+		unrarResult.Files = append(unrarResult.Files, unrarFile)
+	}
+
+	req.Logger().Infof("upload files done")
+	//write result
+	result.Type = ufop.RESULT_TYPE_JSON
+	result.Body = unrarResult
+	result.MimeType = ufop.CONTENT_TYPE_JSON
+
+	return
+}
+
+//save the volume in the work dir, the size is the length of the volume
+func (this *Unrarer) download(ctx context.Context, scratch *ufop.UfopScratch, volumeUrl, volumePath string) (size int64, err error) {
+	volumeFp, openErr := scratch.Create(volumePath)
+	if openErr != nil {
+		err = errors.New(fmt.Sprintf("open file by local path failed, %s", openErr.Error()))
+		return
+	}
+	defer volumeFp.Close()
+
+	if _, err = ufop.StorageDownloadTo(ctx, this.storage, volumeUrl, volumeFp); err != nil {
+		return
+	}
+	size, err = volumeFp.Seek(0, io.SeekCurrent)
+	return
+}
+
+//extract the rar file to the output dir, unrar is killed once the output
+//exceeds the max length or the scratch quota
+func extractRar(ctx context.Context, scratch *ufop.UfopScratch, rarPath, outputDir string, maxLength uint64) (err error) {
+	extractCtx, cancelExtract := context.WithCancel(ctx)
+	defer cancelExtract()
+
+	var limitErr error
+	extractDone := make(chan struct{})
+	checkDone := make(chan struct{})
+	go func() {
+		defer close(checkDone)
+		ticker := time.NewTicker(UNRAR_OUTPUT_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-extractDone:
+				return
+			case <-ticker.C:
+			}
+			if limitErr = checkOutput(scratch, outputDir, maxLength); limitErr != nil {
+				cancelExtract()
+				return
+			}
+		}
+	}()
+
+	_, xErr := runUnrar(extractCtx, scratch, "x", "-y", "-o+", "-p-", "-c-", rarPath, outputDir+string(filepath.Separator))
+	close(extractDone)
+	<-checkDone
+	if limitErr == nil {
+		limitErr = checkOutput(scratch, outputDir, maxLength)
+	}
+	if limitErr != nil {
+		err = limitErr
+		return
+	}
+	if xErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("extract rar file failed, %s", xErr.Error()))
+	}
+	return
+}
+
+//the error if the output exceeds the max length or the scratch quota
+func checkOutput(scratch *ufop.UfopScratch, outputDir string, maxLength uint64) (err error) {
+	var length uint64
+	filepath.Walk(outputDir, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr == nil && info.Mode().IsRegular() {
+			length += uint64(info.Size())
+		}
+		return nil
+	})
+	if length > maxLength {
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "rar file length exceeds the limit")
+		return
+	}
+	err = scratch.UpdateUsage()
+	return
+}
+
+//the sizes of the regular files in the output dir by their relative paths
+func listOutputFiles(outputDir string) (files map[string]int64, err error) {
+	files = make(map[string]int64)
+	err = filepath.Walk(outputDir, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, relErr := filepath.Rel(outputDir, path)
+		if relErr != nil {
+			return relErr
+		}
+		files[relPath] = info.Size()
+		return nil
+	})
+	return
+}
+
+func runUnrar(ctx context.Context, scratch *ufop.UfopScratch, args ...string) (output []byte, err error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	unrarCmd := scratch.CommandContext(ctx, "unrar", args...)
+	unrarCmd.Stdout = &stdout
+	unrarCmd.Stderr = &stderr
+
+	if runErr := unrarCmd.Run(); runErr != nil {
+		if errMsg := strings.TrimSpace(stderr.String()); errMsg != "" {
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("%s, %s", runErr.Error(), errMsg))
+		} else {
+			err = ufop.WrapUfopError(ufop.ERROR_PROCESS_FAILED, runErr)
+		}
+		return
+	}
+
+	output = stdout.Bytes()
+	return
+}
+
+//parse the output of `unrar lt`, which lists each entry as lines of
+//`Name: <name>`, `Type: <File|Directory>` and `Size: <size>`, the entries
+//split across volumes are listed once for each volume
+func parseTechnicalList(output []byte) (entries []rarEntry) {
+	entryIndexes := make(map[string]int)
+	current := -1
+	for _, line := range strings.Split(string(output), "\n") {
+		items := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(items) != 2 {
+			continue
+		}
+
+		key := items[0]
+		value := strings.TrimRight(items[1], "\r")
+		switch key {
+		case "Name":
+			if index, ok := entryIndexes[value]; ok {
+				current = index
+			} else {
+				entries = append(entries, rarEntry{name: value})
+				current = len(entries) - 1
+				entryIndexes[value] = current
+			}
+		case "Type":
+			if current >= 0 {
+				entries[current].isDir = (value == "Directory")
+			}
+		case "Size":
+			if current >= 0 {
+				if size, pErr := strconv.ParseUint(value, 10, 64); pErr == nil && size > entries[current].size {
+					entries[current].size = size
+				}
+			}
+		}
+	}
+	return
+}
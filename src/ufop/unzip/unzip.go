@@ -3,24 +3,12 @@ package unzip
 import (
 	"archive/zip"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/qiniu/api.v6/auth/digest"
-	"github.com/qiniu/api.v6/conf"
-	fio "github.com/qiniu/api.v6/io"
-	rio "github.com/qiniu/api.v6/resumable/io"
-	"github.com/qiniu/api.v6/rs"
-	"github.com/qiniu/log"
-	"github.com/qiniu/rpc"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
-	"strconv"
-	"time"
 	"ufop"
 	"ufop/utils"
 	"unicode/utf8"
@@ -52,7 +40,7 @@ type UnzipFile struct {
 }
 
 type Unzipper struct {
-	mac              *digest.Mac
+	storage          ufop.UfopStorage
 	maxZipFileLength uint64
 	maxFileLength    uint64
 	maxFileCount     int
@@ -60,8 +48,7 @@ type Unzipper struct {
 
 type UnzipperConfig struct {
 	//ak & sk
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
+	ufop.UfopCredentials
 
 	UnzipMaxZipFileLength uint64 `json:"unzip_max_zip_file_length,omitempty"`
 	UnzipMaxFileLength    uint64 `json:"unzip_max_file_length,omitempty"`
@@ -72,16 +59,17 @@ func (this *Unzipper) Name() string {
 	return "unzip"
 }
 
-func (this *Unzipper) InitConfig(jobConf string) (err error) {
-	confFp, openErr := os.Open(jobConf)
-	if openErr != nil {
-		err = errors.New(fmt.Sprintf("Open unzip config failed, %s", openErr.Error()))
-		return
+func (this *Unzipper) Limits() map[string]interface{} {
+	return map[string]interface{}{
+		"unzip_max_zip_file_length": this.maxZipFileLength,
+		"unzip_max_file_length":     this.maxFileLength,
+		"unzip_max_file_count":      this.maxFileCount,
 	}
+}
 
+func (this *Unzipper) InitConfig(jobConf []byte, storage ufop.UfopStorage) (err error) {
 	config := UnzipperConfig{}
-	decoder := json.NewDecoder(confFp)
-	decodeErr := decoder.Decode(&config)
+	decodeErr := ufop.DecodeJobConfig(jobConf, &config)
 	if decodeErr != nil {
 		err = errors.New(fmt.Sprintf("Parse unzip config failed, %s", decodeErr.Error()))
 		return
@@ -105,7 +93,11 @@ func (this *Unzipper) InitConfig(jobConf string) (err error) {
 		this.maxZipFileLength = config.UnzipMaxZipFileLength
 	}
 
-	this.mac = &digest.Mac{config.AccessKey, []byte(config.SecretKey)}
+	if credErr := config.LoadCredentials(); credErr != nil {
+		err = errors.New(fmt.Sprintf("Load unzip credentials failed, %s", credErr.Error()))
+		return
+	}
+	this.storage = storage.WithCredentials(config.AccessKey, config.SecretKey)
 
 	return
 }
@@ -115,40 +107,39 @@ func (this *Unzipper) InitConfig(jobConf string) (err error) {
 unzip/bucket/<encoded bucket>/prefix/<encoded prefix>/overwrite/<[0|1]>
 
 */
-func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite bool, err error) {
-	pattern := "^unzip/bucket/[0-9a-zA-Z-_=]+(/prefix/[0-9a-zA-Z-_=]+){0,1}(/overwrite/(0|1)){0,1}$"
-	matched, _ := regexp.MatchString(pattern, cmd)
-	if !matched {
-		err = errors.New("invalid unzip command format")
-		return
-	}
+var unzipParser = utils.NewCommandParser("unzip",
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "prefix", Type: utils.PARAM_TYPE_BASE64},
+	utils.ParamSpec{Name: "overwrite", Type: utils.PARAM_TYPE_BOOL, Default: false},
+)
 
-	var decodeErr error
-	bucket, decodeErr = utils.GetParamDecoded(cmd, "bucket/[0-9a-zA-Z-_=]+", "bucket")
-	if decodeErr != nil {
-		err = errors.New("invalid unzip parameter 'bucket'")
-		return
+//the unzipped files are saved to the bucket
+func (this *Unzipper) Buckets(cmd string) (read []string, write []string, err error) {
+	bucket, _, _, err := this.parse(cmd)
+	if err == nil {
+		write = []string{bucket}
 	}
-	prefix, decodeErr = utils.GetParamDecoded(cmd, "prefix/[0-9a-zA-Z-_=]+", "prefix")
-	if decodeErr != nil {
-		err = errors.New("invalid unzip parameter 'prefix'")
+	return
+}
+
+func (this *Unzipper) parse(cmd string) (bucket string, prefix string, overwrite bool, err error) {
+	params, pErr := unzipParser.Parse(cmd)
+	if pErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_BAD_COMMAND, pErr.Error())
 		return
 	}
-	overwriteStr := utils.GetParam(cmd, "overwrite/(0|1)", "overwrite")
-	if overwriteStr != "" {
-		overwriteVal, paramErr := strconv.ParseInt(overwriteStr, 10, 64)
-		if paramErr != nil {
-			err = errors.New("invalid unzip parameter 'overwrite'")
-			return
-		}
-		if overwriteVal == 1 {
-			overwrite = true
-		}
-	}
+
+	bucket = params.String("bucket")
+	prefix = params.String("prefix")
+	overwrite = params.Bool("overwrite")
 	return
 }
 
-func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType int, contentType string, err error) {
+func (this *Unzipper) Do(req ufop.UfopRequest) (ufop.UfopResult, error) {
+	return this.DoContext(context.Background(), req)
+}
+
+func (this *Unzipper) DoContext(ctx context.Context, req ufop.UfopRequest) (result ufop.UfopResult, err error) {
 	//parse command
 	bucket, prefix, overwrite, pErr := this.parse(req.Cmd)
 	if pErr != nil {
@@ -158,75 +149,81 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 
 	//check mimetype
 	if !(req.Src.MimeType == "application/zip" || req.Src.MimeType == "application/x-zip-compressed") {
-		err = errors.New("unsupported mimetype to unzip")
+		err = ufop.NewUfopError(ufop.ERROR_UNSUPPORTED_MIMETYPE, "unsupported mimetype to unzip")
 		return
 	}
 	//check zip file length
 	if req.Src.Fsize > this.maxZipFileLength {
-		err = errors.New("src zip file length exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
 		return
 	}
 
-	log.Infof("[%s] downloading file", req.ReqId)
+	req.Logger().Infof("downloading file")
 	//get resource
 	resUrl := req.Src.Url
-	resResp, respErr := http.Get(resUrl)
-	if respErr != nil || resResp.StatusCode != 200 {
-		if respErr != nil {
-			err = fmt.Errorf("retrieve resource data failed, %s", respErr.Error())
-		} else {
-			err = fmt.Errorf("retrieve resource data failed, %s", resResp.Status)
-			if resResp.Body != nil {
-				resResp.Body.Close()
-			}
-		}
+	//the fsize of the request is not trusted, the limit is checked while reading
+	fetchCtx := utils.WithFetchOptions(ctx, utils.FetchOptions{MaxBytes: int64(this.maxZipFileLength)})
+	resBody, _, getErr := this.storage.Get(fetchCtx, resUrl)
+	if getErr == utils.ErrFetchTooLarge {
+		err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
+		return
+	}
+	if getErr != nil {
+		err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("retrieve resource data failed, %s", getErr.Error()))
 		return
 	}
-	defer resResp.Body.Close()
+	defer resBody.Close()
 
 	//zip
 	var zipReader *zip.Reader
 	var zipErr error
 	//check the size of the src size file, when exceeds the threshold, use disk cache
 	if req.Src.Fsize > UNZIP_CACHE_ZIP_FILE_THRESHOLD {
-		log.Infof("[%s] trying to read zip into disk", req.ReqId)
-
-		zipFileCacheFname := utils.Md5Hex(fmt.Sprintf("%s:%d", req.Src.Url, time.Now().Unix()))
-		zipFileCacheFpath := filepath.Join(os.TempDir(), zipFileCacheFname)
-		zipFileCacheFh, openErr := os.Create(zipFileCacheFpath)
-		defer os.Remove(zipFileCacheFpath)
+		req.Logger().Infof("trying to read zip into disk")
 
+		//the cache file is in the scratch dir, removed with it
+		zipFileCacheFp, openErr := req.Scratch().CreateTemp("unzip_")
 		if openErr != nil {
-			err = fmt.Errorf("open local zip cache file failed, %s", openErr.Error())
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open local zip cache file failed, %s", openErr.Error()))
+			return
+		}
+		zipFileCacheFpath := zipFileCacheFp.Name()
+		_, cpErr := io.Copy(zipFileCacheFp, resBody)
+		zipFileCacheFp.Close()
+		if cpErr == utils.ErrFetchTooLarge {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
 			return
 		}
-		_, cpErr := io.Copy(zipFileCacheFh, resResp.Body)
 		if cpErr != nil {
-			err = fmt.Errorf("write local zip cache file failed, %s", cpErr.Error())
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("write local zip cache file failed, %s", cpErr.Error()))
 			return
 		}
-		zipFileCacheFh.Close()
 
-		zipFileCacheFh, openErr = os.Open(zipFileCacheFpath)
+		zipFileCacheFh, openErr := os.Open(zipFileCacheFpath)
 		if openErr != nil {
-			err = fmt.Errorf("reopen local zip cache file failed, %s", openErr.Error())
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("reopen local zip cache file failed, %s", openErr.Error()))
 			return
 		}
+		defer zipFileCacheFh.Close()
 		zipFileCacheStat, statErr := zipFileCacheFh.Stat()
 		if statErr != nil {
-			err = fmt.Errorf("reopen local zip cache file size error, %s", statErr.Error())
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("reopen local zip cache file size error, %s", statErr.Error()))
 			return
 		}
 		zipReader, zipErr = zip.NewReader(zipFileCacheFh, zipFileCacheStat.Size())
 		if zipErr != nil {
-			err = errors.New(fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
 			return
 		}
 	} else {
-		log.Infof("[%s] trying to read zip into memory", req.ReqId)
-		respData, readErr := ioutil.ReadAll(resResp.Body)
+		req.Logger().Infof("trying to read zip into memory")
+		respData, readErr := ioutil.ReadAll(resBody)
+		if readErr == utils.ErrFetchTooLarge {
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "src zip file length exceeds the limit")
+			return
+		}
 		if readErr != nil {
-			err = errors.New(fmt.Sprintf("read resource data failed, %s", readErr.Error()))
+			err = ufop.NewUfopError(ufop.ERROR_UPSTREAM_FETCH_FAILED, fmt.Sprintf("read resource data failed, %s", readErr.Error()))
 			return
 		}
 
@@ -234,18 +231,18 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 		respReader := bytes.NewReader(respData)
 		zipReader, zipErr = zip.NewReader(respReader, int64(respReader.Len()))
 		if zipErr != nil {
-			err = errors.New(fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("invalid zip file, %s", zipErr.Error()))
 			return
 		}
 	}
 
-	log.Infof("[%s] check and start to unzip", req.ReqId)
+	req.Logger().Infof("check and start to unzip")
 	//iter zip files
 	zipFiles := zipReader.File
 	//check file count
 	zipFileCount := len(zipFiles)
 	if zipFileCount > this.maxFileCount {
-		err = errors.New("zip files count exceeds the limit")
+		err = ufop.NewUfopError(ufop.ERROR_LIMIT_EXCEEDED, "zip files count exceeds the limit")
 		return
 	}
 	//check file size
@@ -253,30 +250,28 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 		fileSize := zipFile.UncompressedSize64
 		//check file size
 		if fileSize > this.maxFileLength {
-			err = errors.New("zip file length exceeds the limit")
+			err = ufop.NewUfopError(ufop.ERROR_SRC_TOO_LARGE, "zip file length exceeds the limit")
 			return
 		}
 	}
 
-	log.Infof("[%s] start to upload files", req.ReqId)
-	//set up host
-	conf.UP_HOST = "http://up.qiniu.com"
-	rputSettings := rio.Settings{
-		ChunkSize: 4 * 1024 * 1024,
-		Workers:   8,
+	req.Logger().Infof("start to upload files")
+	putExtra := ufop.UfopPutExtra{
+		Overwrite: overwrite,
 	}
-	rio.SetSettings(&rputSettings)
-	policy := rs.PutPolicy{
-		Scope: bucket,
-	}
-	policy.Expires = 24 * 3600 //24 hours
 
 	var unzipResult UnzipResult
 	unzipResult.Files = make([]UnzipFile, 0, 100)
 	var tErr error
 	//iterate the zip file
 
-	for _, zipFile := range zipFiles {
+	for zipIndex, zipFile := range zipFiles {
+		req.ReportProgress(zipIndex * 100 / zipFileCount)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			return
+		}
+
 		fileInfo := zipFile.FileHeader.FileInfo()
 		fileName := zipFile.FileHeader.Name
 		fileSize := zipFile.UncompressedSize64
@@ -284,7 +279,7 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 		if !utf8.Valid([]byte(fileName)) {
 			fileName, tErr = utils.Gbk2Utf8(fileName)
 			if tErr != nil {
-				err = errors.New(fmt.Sprintf("unsupported file name encoding, %s", tErr.Error()))
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("unsupported file name encoding, %s", tErr.Error()))
 				return
 			}
 		}
@@ -299,117 +294,80 @@ func (this *Unzipper) Do(req ufop.UfopRequest) (result interface{}, resultType i
 		fileKey := prefix + fileName
 		unzipFile.Key = fileKey
 
-		if overwrite {
-			policy.Scope = bucket + ":" + fileKey
-		}
-
-		uptoken := policy.Token(this.mac)
-
 		zipFileReader, zipErr := zipFile.Open()
 		if zipErr != nil {
-			err = errors.New(fmt.Sprintf("open zip file content failed, %s", zipErr.Error()))
+			err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open zip file content failed, %s", zipErr.Error()))
 			return
 		}
 
 		if fileSize > UNZIP_CACHE_FILE_ITEM_THRESHOLD {
-			zipFileItemCacheFname := utils.Md5Hex(fmt.Sprintf("%s:%s:%d", req.Src.Url, fileName, time.Now().Unix()))
-			zipFileItemCacheFpath := filepath.Join(os.TempDir(), zipFileItemCacheFname)
-			zipFileItemCacheFh, openErr := os.Create(zipFileItemCacheFpath)
-			defer os.Remove(zipFileItemCacheFpath)
-
+			zipFileItemCacheFh, openErr := req.Scratch().CreateTemp("unzip_item_")
 			if openErr != nil {
-				err = fmt.Errorf("open local cache file item failed, %s", openErr.Error())
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("open local cache file item failed, %s", openErr.Error()))
+				zipFileReader.Close()
 				return
 			}
+			zipFileItemCacheFpath := zipFileItemCacheFh.Name()
 
 			_, cpErr := io.Copy(zipFileItemCacheFh, zipFileReader)
 			if cpErr != nil {
-				err = fmt.Errorf("write local cache file item failed, %s", cpErr.Error())
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("write local cache file item failed, %s", cpErr.Error()))
 				zipFileItemCacheFh.Close()
+				zipFileReader.Close()
 				return
 			}
 			zipFileItemCacheFh.Close()
 			zipFileReader.Close()
 
-			if fileSize <= RESUMABLE_PUT_THRESHOLD {
-				log.Infof("[%s] start to fput file %s", req.ReqId, fileName)
-				var fputRet fio.PutRet
-				fErr := fio.PutFile(nil, &fputRet, uptoken, fileKey, zipFileItemCacheFpath, nil)
-				if fErr != nil {
-					if v, ok := fErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", fErr.Error())
-					}
-				} else {
-					unzipFile.Hash = fputRet.Hash
-				}
-				log.Infof("[%s] end fput file %s", req.ReqId, fileName)
+			req.Logger().Infof("start to put file %s", fileName)
+			putRet, putErr := ufop.StoragePutFile(ctx, this.storage, bucket, fileKey, zipFileItemCacheFpath,
+				RESUMABLE_PUT_THRESHOLD, &putExtra)
+			if putErr != nil {
+				unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", putErr.Error())
 			} else {
-				log.Infof("[%s] start to rput file %s", req.ReqId, fileName)
-				var rputRet rio.PutRet
-				rErr := rio.PutFile(nil, &rputRet, uptoken, fileKey, zipFileItemCacheFpath, nil)
-				if rErr != nil {
-					if v, ok := rErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", rErr.Error())
-					}
-				} else {
-					unzipFile.Hash = rputRet.Hash
-				}
-				log.Infof("[%s] end rput file %s", req.ReqId, fileName)
+				unzipFile.Hash = putRet.Hash
 			}
-
+			req.Logger().Infof("end put file %s", fileName)
+			//the item is uploaded, no need to keep it until the scratch dir is removed,
+			//and its quota is released for the next items
+			os.Remove(zipFileItemCacheFpath)
+			req.Scratch().UpdateUsage()
 		} else {
 			unzipData, unzipErr := ioutil.ReadAll(zipFileReader)
 			if unzipErr != nil {
-				err = errors.New(fmt.Sprintf("unzip the file content failed, %s", unzipErr.Error()))
+				err = ufop.NewUfopError(ufop.ERROR_PROCESS_FAILED, fmt.Sprintf("unzip the file content failed, %s", unzipErr.Error()))
 				zipFileReader.Close()
 				return
 			}
 			zipFileReader.Close()
 			unzipReader := bytes.NewReader(unzipData)
 
+			var putRet ufop.UfopPutResult
+			var putErr error
 			if fileSize <= RESUMABLE_PUT_THRESHOLD {
-				log.Infof("[%s] start to fput bytes %s", req.ReqId, fileName)
-				var fputRet fio.PutRet
-				fErr := fio.Put(nil, &fputRet, uptoken, fileKey, unzipReader, nil)
-				if fErr != nil {
-					if v, ok := fErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", fErr.Error())
-					}
-				} else {
-					unzipFile.Hash = fputRet.Hash
-				}
-				log.Infof("[%s] end fput bytes %s", req.ReqId, fileName)
+				req.Logger().Infof("start to fput bytes %s", fileName)
+				putRet, putErr = this.storage.Put(ctx, bucket, fileKey, unzipReader, &putExtra)
+				req.Logger().Infof("end fput bytes %s", fileName)
+			} else {
+				req.Logger().Infof("start to rput bytes %s", fileName)
+				putRet, putErr = this.storage.PutResumable(ctx, bucket, fileKey, unzipReader, int64(fileSize), &putExtra)
+				req.Logger().Infof("end rput bytes %s", fileName)
+			}
+			if putErr != nil {
+				unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", putErr.Error())
 			} else {
-				log.Infof("[%s] start to rput bytes %s", req.ReqId, fileName)
-				var rputRet rio.PutRet
-				rErr := rio.Put(nil, &rputRet, uptoken, fileKey, unzipReader, int64(fileSize), nil)
-				if rErr != nil {
-					if v, ok := rErr.(*rpc.ErrorInfo); ok {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", v.Err)
-					} else {
-						unzipFile.Error = fmt.Sprintf("save unzip file to bucket error, %s", rErr.Error())
-					}
-				} else {
-					unzipFile.Hash = rputRet.Hash
-				}
-				log.Infof("[%s] end rput bytes %s", req.ReqId, fileName)
+				unzipFile.Hash = putRet.Hash
 			}
 		}
 
 		unzipResult.Files = append(unzipResult.Files, unzipFile)
 	}
 
-	log.Infof("[%s] upload files done", req.ReqId)
+	req.Logger().Infof("upload files done")
 	//write result
-	result = unzipResult
-	resultType = ufop.RESULT_TYPE_JSON
-	contentType = ufop.CONTENT_TYPE_JSON
+	result.Type = ufop.RESULT_TYPE_JSON
+	result.Body = unzipResult
+	result.MimeType = ufop.CONTENT_TYPE_JSON
 
 	return
 }
@@ -0,0 +1,30 @@
+package ufop_test
+
+import (
+	"image/color"
+	"testing"
+	"ufop"
+	"ufop/html2pdf"
+	"ufop/imagecomp"
+)
+
+func TestHandlerPolicy(t *testing.T) {
+	env := newTestEnv(t)
+	env.cfg.UrlAllowPrivate = false
+	env.serv = ufop.NewServer(env.cfg)
+	env.register(&imagecomp.ImageComposer{}, map[string]interface{}{})
+	env.register(&html2pdf.Html2Pdfer{}, map[string]interface{}{})
+
+	imgUrl := env.fake.PutFile(testBucket, "red.png", makePng(t, 10, 10, color.RGBA{0xFF, 0, 0, 0xFF}), "image/png")
+	w := env.do("imagecomp/bucket/"+encode(testBucket)+"/url/"+encode(imgUrl), ufop.UfopRequestSrc{})
+	expectError(t, w, 403, ufop.ERROR_URL_FORBIDDEN,
+		"url '"+imgUrl+"' not allowed, address '127.0.0.1' is internal")
+
+	//checked before handed to the converter
+	page := ufop.UfopRequestSrc{Url: "http://www.qiniu.com/page.html", MimeType: "text/html", Fsize: 10}
+	w = env.do("html2pdf/url/"+encode("file:///etc/passwd"), page)
+	expectError(t, w, 403, ufop.ERROR_URL_FORBIDDEN, "url 'file:///etc/passwd' not allowed, scheme 'file' not allowed")
+	w = env.do("html2pdf/url/"+encode("http://169.254.169.254/latest/meta-data"), page)
+	expectError(t, w, 403, ufop.ERROR_URL_FORBIDDEN,
+		"url 'http://169.254.169.254/latest/meta-data' not allowed, address '169.254.169.254' is internal")
+}
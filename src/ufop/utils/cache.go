@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//the lru cache of the fetched resources on disk, the resources are keyed by
+//the qiniu hash when known, otherwise by the url and revalidated by the etag,
+//the least recently used ones are removed when the size exceeds the budget
+type FetchCache struct {
+	dir    string
+	budget int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	//the front is the most recently used
+	lru    *list.List
+	size   int64
+	hits   int64
+	misses int64
+}
+
+type fetchCacheEntry struct {
+	key      string
+	path     string
+	size     int64
+	mimeType string
+	etag     string
+}
+
+type FetchCacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int64 `json:"entries"`
+	Size    int64 `json:"size"`
+	Budget  int64 `json:"budget"`
+}
+
+//create the cache dir, whatever left in it is removed, so the dir must be
+//owned by the cache, the budget is the total bytes of the cached files
+func NewFetchCache(dir string, budget int64) (cache *FetchCache, err error) {
+	if dir == "" || budget <= 0 {
+		err = errors.New("cache dir or size not set")
+		return
+	}
+	if mErr := os.MkdirAll(dir, 0755); mErr != nil {
+		err = errors.New(fmt.Sprintf("create cache dir failed, %s", mErr.Error()))
+		return
+	}
+	cache = &FetchCache{
+		dir:     dir,
+		budget:  budget,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	cache.RemoveAll()
+	return
+}
+
+func (this *FetchCache) Stats() FetchCacheStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return FetchCacheStats{
+		Hits:    this.hits,
+		Misses:  this.misses,
+		Entries: int64(len(this.entries)),
+		Size:    this.size,
+		Budget:  this.budget,
+	}
+}
+
+//remove all the cached files, the files being read are still readable
+func (this *FetchCache) RemoveAll() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.entries = make(map[string]*list.Element)
+	this.lru.Init()
+	this.size = 0
+
+	fileInfos, _ := ioutil.ReadDir(this.dir)
+	for _, fileInfo := range fileInfos {
+		os.RemoveAll(filepath.Join(this.dir, fileInfo.Name()))
+	}
+}
+
+//the etag of the cached resource of the url, sent by If-None-Match
+func (this *FetchCache) etag(key string) string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if elem, ok := this.entries[key]; ok {
+		return elem.Value.(*fetchCacheEntry).etag
+	}
+	return ""
+}
+
+//open the cached file, opened in the lock so it is not removed before that
+func (this *FetchCache) open(key string) (fp *os.File, entry fetchCacheEntry, ok bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	elem, found := this.entries[key]
+	if !found {
+		return
+	}
+	cached := elem.Value.(*fetchCacheEntry)
+	fp, openErr := os.Open(cached.path)
+	if openErr != nil {
+		this.removeElement(elem)
+		return
+	}
+	this.lru.MoveToFront(elem)
+	entry = *cached
+	ok = true
+	return
+}
+
+func (this *FetchCache) hit() {
+	this.lock.Lock()
+	this.hits += 1
+	this.lock.Unlock()
+}
+
+func (this *FetchCache) miss() {
+	this.lock.Lock()
+	this.misses += 1
+	this.lock.Unlock()
+}
+
+//the writer of a new cached file, the file is added by commit after the
+//resource is read to the end
+func (this *FetchCache) newWriter(key, mimeType, etag string) *fetchCacheWriter {
+	fp, err := ioutil.TempFile(this.dir, "cache_")
+	if err != nil {
+		return nil
+	}
+	return &fetchCacheWriter{
+		cache: this,
+		fp:    fp,
+		entry: fetchCacheEntry{
+			key:      key,
+			path:     fp.Name(),
+			mimeType: mimeType,
+			etag:     etag,
+		},
+	}
+}
+
+//add the entry, replace the old one of the same key, and remove the least
+//recently used ones over the budget
+func (this *FetchCache) add(entry fetchCacheEntry) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if elem, ok := this.entries[entry.key]; ok {
+		this.removeElement(elem)
+	}
+	this.entries[entry.key] = this.lru.PushFront(&entry)
+	this.size += entry.size
+	for this.size > this.budget {
+		this.removeElement(this.lru.Back())
+	}
+}
+
+func (this *FetchCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*fetchCacheEntry)
+	this.lru.Remove(elem)
+	delete(this.entries, entry.key)
+	this.size -= entry.size
+	os.Remove(entry.path)
+}
+
+//the data written is dropped when it exceeds the budget or the write fails,
+//the fetch goes on anyway
+type fetchCacheWriter struct {
+	cache  *FetchCache
+	fp     *os.File
+	entry  fetchCacheEntry
+	failed bool
+}
+
+func (this *fetchCacheWriter) Write(p []byte) {
+	if this.failed {
+		return
+	}
+	if this.entry.size+int64(len(p)) > this.cache.budget {
+		this.failed = true
+		return
+	}
+	n, err := this.fp.Write(p)
+	this.entry.size += int64(n)
+	if err != nil {
+		this.failed = true
+	}
+}
+
+func (this *fetchCacheWriter) commit() {
+	cErr := this.fp.Close()
+	if this.failed || cErr != nil {
+		os.Remove(this.entry.path)
+		return
+	}
+	this.cache.add(this.entry)
+}
+
+func (this *fetchCacheWriter) abort() {
+	this.fp.Close()
+	os.Remove(this.entry.path)
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"io"
+)
+
+const ETAG_BLOCK_SIZE = 4 * 1024 * 1024
+
+//the qiniu hash of the data, the sha1 of the 4MB blocks, and the sha1 of
+//the block hashes if there are more than one block
+func Etag(data io.Reader) (etag string, err error) {
+	hasher := NewEtagHasher()
+	if _, err = io.Copy(hasher, data); err != nil {
+		return
+	}
+	etag = hasher.Sum()
+	return
+}
+
+//the qiniu hash computed as the data is written
+type EtagHasher struct {
+	block       hash.Hash
+	blockSize   int64
+	blockHashes [][]byte
+}
+
+func NewEtagHasher() *EtagHasher {
+	return &EtagHasher{
+		block: sha1.New(),
+	}
+}
+
+func (this *EtagHasher) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if left := ETAG_BLOCK_SIZE - this.blockSize; int64(size) > left {
+			size = int(left)
+		}
+		this.block.Write(p[:size])
+		this.blockSize += int64(size)
+		n += size
+		p = p[size:]
+
+		if this.blockSize == ETAG_BLOCK_SIZE {
+			this.blockHashes = append(this.blockHashes, this.block.Sum(nil))
+			this.block = sha1.New()
+			this.blockSize = 0
+		}
+	}
+	return
+}
+
+//the hash of the data written so far
+func (this *EtagHasher) Sum() string {
+	blockHashes := this.blockHashes
+	if this.blockSize > 0 || len(blockHashes) == 0 {
+		blockHashes = append(blockHashes[:len(blockHashes):len(blockHashes)], this.block.Sum(nil))
+	}
+
+	var sum []byte
+	if len(blockHashes) == 1 {
+		sum = append([]byte{0x16}, blockHashes[0]...)
+	} else {
+		h := sha1.New()
+		h.Write(bytes.Join(blockHashes, nil))
+		sum = append([]byte{0x96}, h.Sum(nil)...)
+	}
+	return base64.URLEncoding.EncodeToString(sum)
+}
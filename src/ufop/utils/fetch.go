@@ -0,0 +1,543 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	FETCH_CONNECT_TIMEOUT = 10 * time.Second
+	FETCH_READ_TIMEOUT    = 60 * time.Second
+	FETCH_MAX_RETRIES     = 3
+	FETCH_RETRY_INTERVAL  = 500 * time.Millisecond
+	FETCH_MAX_REDIRECTS   = 10
+)
+
+var ErrFetchTooLarge = errors.New("resource length exceeds the limit")
+
+var errNotModified = errors.New("not modified")
+
+//limits of one fetch
+type FetchOptions struct {
+	//the fetch fails once more bytes are read, <= 0 means no limit
+	MaxBytes int64
+	//the qiniu hash of the resource, checked when the body is read to the end
+	Hash string
+}
+
+//the stat hash of the resource to check the fetch by, empty if the url has a
+//fop query like '?imageView2/1/w/100', the processed bytes never match the hash,
+//the other queries like the token of the private url are kept checked
+func StatHash(remoteUrl, hash string) string {
+	parsedUrl, err := url.Parse(remoteUrl)
+	if err != nil {
+		return ""
+	}
+	if fop := strings.SplitN(parsedUrl.RawQuery, "&", 2)[0]; fop != "" && !strings.Contains(fop, "=") {
+		return ""
+	}
+	return hash
+}
+
+//the http client of the resources, the failed requests and the broken bodies
+//are retried, the bodies are resumed by range requests from where they broke
+type Fetcher struct {
+	client        *http.Client
+	dialer        *net.Dialer
+	readTimeout   time.Duration
+	maxRetries    int
+	retryInterval time.Duration
+	cache         *FetchCache
+
+	policyLock sync.RWMutex
+	policy     *URLPolicy
+}
+
+//the response of the fetch, the content length is -1 if unknown
+type FetchResponse struct {
+	Body          io.ReadCloser
+	MimeType      string
+	ContentLength int64
+}
+
+//the connect timeout is for the tcp connection, and the read timeout is for
+//the response header and each read of the body, <= 0 means no timeout, the
+//retry interval doubles after each retry
+func NewFetcher(connectTimeout, readTimeout time.Duration, maxRetries int, retryInterval time.Duration) *Fetcher {
+	fetcher := &Fetcher{
+		readTimeout:   readTimeout,
+		maxRetries:    maxRetries,
+		retryInterval: retryInterval,
+	}
+
+	//the addresses are checked after the host is resolved, and the redirect
+	//urls are checked before followed
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+		ControlContext: func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if policy := fetcher.Policy(); policy != nil {
+				host, _ := ctx.Value(dialHostKey{}).(string)
+				return policy.checkAddr(host, address)
+			}
+			return nil
+		},
+	}
+	fetcher.dialer = dialer
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = fetcher.dialContext
+	transport.ResponseHeaderTimeout = readTimeout
+	transport.RegisterProtocol(PIPE_URL_SCHEME, pipeTransport{})
+	fetcher.client = &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= FETCH_MAX_REDIRECTS {
+				return errors.New(fmt.Sprintf("stopped after %d redirects", FETCH_MAX_REDIRECTS))
+			}
+			if policy := fetcher.Policy(); policy != nil {
+				return policy.CheckURL(req.URL.String())
+			}
+			return nil
+		},
+	}
+	return fetcher
+}
+
+type dialHostKey struct{}
+
+//dial the address with its host name in the context, so that the address is
+//checked for the host it is resolved from
+func (this *Fetcher) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		ctx = context.WithValue(ctx, dialHostKey{}, strings.ToLower(host))
+	}
+	return this.dialer.DialContext(ctx, network, address)
+}
+
+//the urls fetched are checked by the policy, nil means no check, safe to call
+//when the fetcher is in use
+func (this *Fetcher) SetPolicy(policy *URLPolicy) {
+	this.policyLock.Lock()
+	defer this.policyLock.Unlock()
+	this.policy = policy
+}
+
+func (this *Fetcher) Policy() *URLPolicy {
+	this.policyLock.RLock()
+	defer this.policyLock.RUnlock()
+	return this.policy
+}
+
+//check the url before it is fetched, the local pipe files are always allowed
+func (this *Fetcher) CheckURL(ctx context.Context, remoteUrl string) (err error) {
+	policy := this.Policy()
+	if policy == nil || strings.HasPrefix(remoteUrl, PIPE_URL_SCHEME+"://") {
+		return
+	}
+	err = policy.CheckURL(remoteUrl)
+	reportURLRejected(ctx, err)
+	return
+}
+
+//check the url and the addresses of its host, for the urls handed to the
+//external programs
+func (this *Fetcher) CheckURLAddrs(ctx context.Context, remoteUrl string) (err error) {
+	policy := this.Policy()
+	if policy == nil {
+		return
+	}
+	err = policy.CheckURLAddrs(ctx, remoteUrl)
+	reportURLRejected(ctx, err)
+	return
+}
+
+//cache the http resources, call it before the fetcher is used
+func (this *Fetcher) SetCache(cache *FetchCache) {
+	this.cache = cache
+}
+
+//nil if no cache
+func (this *Fetcher) Cache() *FetchCache {
+	return this.cache
+}
+
+var defaultFetcher = struct {
+	sync.RWMutex
+	fetcher *Fetcher
+}{fetcher: NewFetcher(FETCH_CONNECT_TIMEOUT, FETCH_READ_TIMEOUT, FETCH_MAX_RETRIES, FETCH_RETRY_INTERVAL)}
+
+//the fetcher used by GetContext, Download and the storages
+func DefaultFetcher() *Fetcher {
+	defaultFetcher.RLock()
+	defer defaultFetcher.RUnlock()
+	return defaultFetcher.fetcher
+}
+
+func SetDefaultFetcher(fetcher *Fetcher) {
+	defaultFetcher.Lock()
+	defer defaultFetcher.Unlock()
+	defaultFetcher.fetcher = fetcher
+}
+
+type fetchOptionsKey struct{}
+
+type urlRejectedKey struct{}
+
+//the urls rejected by the policy in the fetches with the context are reported
+//to the handler, so the caller can tell the errors wrapped by others
+func WithURLRejectHandler(ctx context.Context, handler func(err *URLPolicyError)) context.Context {
+	return context.WithValue(ctx, urlRejectedKey{}, handler)
+}
+
+func reportURLRejected(ctx context.Context, err error) {
+	if policyErr, ok := err.(*URLPolicyError); ok {
+		if handler, ok := ctx.Value(urlRejectedKey{}).(func(err *URLPolicyError)); ok {
+			handler(policyErr)
+		}
+	}
+}
+
+//the options of the fetches made by the storages with the context, which take
+//no options themselves
+func WithFetchOptions(ctx context.Context, opts FetchOptions) context.Context {
+	return context.WithValue(ctx, fetchOptionsKey{}, opts)
+}
+
+func FetchOptionsFrom(ctx context.Context) FetchOptions {
+	opts, _ := ctx.Value(fetchOptionsKey{}).(FetchOptions)
+	return opts
+}
+
+//get the resource, the status other than 200 is an error, the caller closes the body
+func (this *Fetcher) Open(ctx context.Context, remoteUrl string, opts FetchOptions) (resp *FetchResponse, err error) {
+	if err = this.CheckURL(ctx, remoteUrl); err != nil {
+		return
+	}
+
+	body := &fetchBody{
+		fetcher: this,
+		ctx:     ctx,
+		url:     remoteUrl,
+		opts:    opts,
+	}
+	if opts.Hash != "" {
+		body.hasher = NewEtagHasher()
+	}
+
+	//the cached resource of the same hash is used without any request, and
+	//the one of the same url is used if the etag is not modified
+	cacheable := this.cache != nil && (strings.HasPrefix(remoteUrl, "http://") || strings.HasPrefix(remoteUrl, "https://"))
+	if cacheable {
+		if opts.Hash != "" {
+			body.cacheKey = "hash:" + opts.Hash
+			if resp, err = this.openCached(body.cacheKey, opts); resp != nil || err != nil {
+				return
+			}
+		} else {
+			body.cacheKey = "url:" + remoteUrl
+			body.ifNoneMatch = this.cache.etag(body.cacheKey)
+		}
+	}
+
+	httpResp, err := body.connect()
+	if err == errNotModified {
+		if resp, err = this.openCached(body.cacheKey, opts); resp != nil || err != nil {
+			return
+		}
+		//removed after the request was sent
+		body.ifNoneMatch = ""
+		httpResp, err = body.connect()
+	}
+	if cacheable {
+		this.cache.miss()
+	}
+	if err != nil {
+		return
+	}
+	if opts.MaxBytes > 0 && httpResp.ContentLength > opts.MaxBytes {
+		body.Close()
+		err = ErrFetchTooLarge
+		return
+	}
+	//the response is compared with the first one when resumed
+	etag := httpResp.Header.Get("Etag")
+	body.validator = etag
+	if body.validator == "" {
+		body.validator = httpResp.Header.Get("Last-Modified")
+	}
+	if cacheable && (opts.Hash != "" || etag != "") && httpResp.ContentLength <= this.cache.budget {
+		body.cacheWriter = this.cache.newWriter(body.cacheKey, httpResp.Header.Get("Content-Type"), etag)
+	}
+
+	resp = &FetchResponse{
+		Body:          body,
+		MimeType:      httpResp.Header.Get("Content-Type"),
+		ContentLength: httpResp.ContentLength,
+	}
+	if counter, ok := ctx.Value(byteCounterKey{}).(func(n int64)); ok {
+		resp.Body = &countingReadCloser{resp.Body, counter}
+	}
+	return
+}
+
+//the cached resource, nil if not cached, the bytes read from the cache are not
+//reported to the byte counter
+func (this *Fetcher) openCached(key string, opts FetchOptions) (resp *FetchResponse, err error) {
+	fp, entry, ok := this.cache.open(key)
+	if !ok {
+		return
+	}
+	this.cache.hit()
+	if opts.MaxBytes > 0 && entry.size > opts.MaxBytes {
+		fp.Close()
+		err = ErrFetchTooLarge
+		return
+	}
+	resp = &FetchResponse{
+		Body:          fp,
+		MimeType:      entry.mimeType,
+		ContentLength: entry.size,
+	}
+	return
+}
+
+//save the resource to the writer
+func (this *Fetcher) Fetch(ctx context.Context, remoteUrl string, w io.Writer, opts FetchOptions) (mimeType string, err error) {
+	resp, err := this.Open(ctx, remoteUrl, opts)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	mimeType = resp.MimeType
+	_, err = io.Copy(w, resp.Body)
+	return
+}
+
+type fetchBody struct {
+	fetcher *Fetcher
+	ctx     context.Context
+	url     string
+	opts    FetchOptions
+	//etag or last modified of the first response, sent by If-Range
+	validator string
+	hasher    *EtagHasher
+	//the etag of the cached resource, sent by If-None-Match
+	ifNoneMatch string
+	cacheKey    string
+	cacheWriter *fetchCacheWriter
+
+	resp    *http.Response
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	read    int64
+	retries int
+	err     error
+}
+
+//connect with retries, and resume from the bytes read
+func (this *fetchBody) connect() (resp *http.Response, err error) {
+	for {
+		var retry bool
+		resp, retry, err = this.request()
+		if err == nil || !retry {
+			return
+		}
+		if waitErr := this.wait(); waitErr != nil {
+			if ctxErr := this.ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			return
+		}
+	}
+}
+
+//wait before the next retry, the error is returned when no retries left
+func (this *fetchBody) wait() (err error) {
+	if this.retries >= this.fetcher.maxRetries {
+		err = errors.New("no retries left")
+		return
+	}
+	interval := this.fetcher.retryInterval << uint(this.retries)
+	this.retries += 1
+
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-this.ctx.Done():
+		err = this.ctx.Err()
+	case <-timer.C:
+	}
+	return
+}
+
+//one request from the bytes read, retry is true for the network errors and
+//the server errors
+func (this *fetchBody) request() (resp *http.Response, retry bool, err error) {
+	req, reqErr := http.NewRequest("GET", this.url, nil)
+	if reqErr != nil {
+		err = reqErr
+		return
+	}
+	if this.read > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", this.read))
+		if this.validator != "" {
+			req.Header.Set("If-Range", this.validator)
+		}
+	} else if this.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", this.ifNoneMatch)
+	}
+
+	//the body is aborted when no data read in the read timeout
+	attemptCtx, cancel := context.WithCancel(this.ctx)
+	resp, err = this.fetcher.client.Do(req.WithContext(attemptCtx))
+	if err != nil {
+		cancel()
+		//rejected when connecting or redirected
+		var policyErr *URLPolicyError
+		if errors.As(err, &policyErr) {
+			err = policyErr
+			reportURLRejected(this.ctx, err)
+			return
+		}
+		retry = this.ctx.Err() == nil
+		return
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		//the range is ignored, skip the bytes read
+		if this.read > 0 {
+			if _, skipErr := io.CopyN(ioutil.Discard, resp.Body, this.read); skipErr != nil {
+				err = skipErr
+				retry = this.ctx.Err() == nil
+			}
+		}
+	case resp.StatusCode == http.StatusNotModified && this.read == 0 && this.ifNoneMatch != "":
+		err = errNotModified
+	case resp.StatusCode == http.StatusPartialContent && this.read > 0:
+		contentRange := resp.Header.Get("Content-Range")
+		if !strings.HasPrefix(contentRange, fmt.Sprintf("bytes %d-", this.read)) {
+			err = errors.New(fmt.Sprintf("unexpected content range '%s'", contentRange))
+		}
+	case resp.StatusCode >= 500:
+		err = errors.New(resp.Status)
+		retry = true
+	default:
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		resp.Body.Close()
+		cancel()
+		resp = nil
+		return
+	}
+
+	this.resp = resp
+	this.cancel = cancel
+	if this.fetcher.readTimeout > 0 {
+		this.timer = time.AfterFunc(this.fetcher.readTimeout, cancel)
+	}
+	return
+}
+
+func (this *fetchBody) Read(p []byte) (n int, err error) {
+	if this.err != nil {
+		err = this.err
+		return
+	}
+
+	for {
+		if this.resp == nil {
+			if _, err = this.connect(); err != nil {
+				this.err = err
+				return
+			}
+		}
+
+		if this.timer != nil {
+			this.timer.Reset(this.fetcher.readTimeout)
+		}
+		n, err = this.resp.Body.Read(p)
+		if n > 0 {
+			if this.opts.MaxBytes > 0 && this.read+int64(n) > this.opts.MaxBytes {
+				n = 0
+				err = ErrFetchTooLarge
+				this.err = err
+				return
+			}
+			this.read += int64(n)
+			if this.hasher != nil {
+				this.hasher.Write(p[:n])
+			}
+			if this.cacheWriter != nil {
+				this.cacheWriter.Write(p[:n])
+			}
+		}
+
+		if err == io.EOF {
+			if this.hasher != nil && this.hasher.Sum() != this.opts.Hash {
+				err = errors.New(fmt.Sprintf("hash mismatch, expect '%s', got '%s'", this.opts.Hash, this.hasher.Sum()))
+			}
+			if err == io.EOF && this.cacheWriter != nil {
+				this.cacheWriter.commit()
+				this.cacheWriter = nil
+			}
+			this.err = err
+			return
+		}
+		if err == nil {
+			return
+		}
+
+		//broken body, resume it by the next read
+		this.closeResp()
+		if this.ctx.Err() != nil {
+			this.err = this.ctx.Err()
+			err = this.err
+			return
+		}
+		if n > 0 {
+			err = nil
+			return
+		}
+		if waitErr := this.wait(); waitErr != nil {
+			this.err = err
+			return
+		}
+	}
+}
+
+func (this *fetchBody) closeResp() {
+	if this.resp != nil {
+		if this.timer != nil {
+			this.timer.Stop()
+			this.timer = nil
+		}
+		this.resp.Body.Close()
+		this.cancel()
+		this.resp = nil
+	}
+}
+
+func (this *fetchBody) Close() error {
+	this.closeResp()
+	if this.cacheWriter != nil {
+		this.cacheWriter.abort()
+		this.cacheWriter = nil
+	}
+	if this.err == nil {
+		this.err = errors.New("body closed")
+	}
+	return nil
+}
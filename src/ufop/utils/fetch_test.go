@@ -0,0 +1,253 @@
+package utils_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"ufop/utils"
+)
+
+func newTestFetcher() *utils.Fetcher {
+	return utils.NewFetcher(time.Second, time.Second, 2, 10*time.Millisecond)
+}
+
+func fetch(t *testing.T, fetcher *utils.Fetcher, remoteUrl string, opts utils.FetchOptions) ([]byte, error) {
+	t.Helper()
+	var buffer bytes.Buffer
+	_, err := fetcher.Fetch(context.Background(), remoteUrl, &buffer, opts)
+	return buffer.Bytes(), err
+}
+
+func TestFetchRetry(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	data, err := fetch(t, newTestFetcher(), server.URL, utils.FetchOptions{})
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected fetch result %q %v", data, err)
+	}
+
+	//no more retries
+	atomic.StoreInt32(&requests, -10)
+	if _, err = fetch(t, newTestFetcher(), server.URL, utils.FetchOptions{}); err == nil {
+		t.Fatal("expect fetch error")
+	}
+	if n := atomic.LoadInt32(&requests); n != -7 {
+		t.Fatalf("unexpected request count %d", n+10)
+	}
+
+	//client errors are not retried
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	if _, err = fetch(t, newTestFetcher(), notFound.URL, utils.FetchOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v1"`)
+		rangeHeader := r.Header.Get("Range")
+		ranges = append(ranges, rangeHeader)
+		if rangeHeader == "" {
+			//break the body in the middle
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write(content[:3000])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if r.Header.Get("If-Range") != `"v1"` {
+			t.Errorf("unexpected if range %q", r.Header.Get("If-Range"))
+		}
+		var start int
+		fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[start:])
+	}))
+	defer server.Close()
+
+	etag, _ := utils.Etag(bytes.NewReader(content))
+	data, err := fetch(t, newTestFetcher(), server.URL, utils.FetchOptions{Hash: etag})
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("unexpected fetch result %d %v", len(data), err)
+	}
+	if len(ranges) != 2 || ranges[1] != "bytes=3000-" {
+		t.Fatalf("unexpected ranges %v", ranges)
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunked") != "" {
+			//no content length
+			w.(http.Flusher).Flush()
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	for _, remoteUrl := range []string{server.URL, server.URL + "?chunked=1"} {
+		if _, err := fetch(t, newTestFetcher(), remoteUrl, utils.FetchOptions{MaxBytes: 999}); err != utils.ErrFetchTooLarge {
+			t.Fatalf("unexpected fetch error of %s, %v", remoteUrl, err)
+		}
+		if _, err := fetch(t, newTestFetcher(), remoteUrl, utils.FetchOptions{MaxBytes: 1000}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	etag, _ := utils.Etag(bytes.NewReader(content))
+	if _, err := fetch(t, newTestFetcher(), server.URL, utils.FetchOptions{Hash: etag}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(t, newTestFetcher(), server.URL, utils.FetchOptions{Hash: "FhASH"}); err == nil ||
+		!strings.Contains(err.Error(), "hash mismatch") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+}
+
+func TestFetchReadTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	fetcher := utils.NewFetcher(time.Second, 100*time.Millisecond, 1, 10*time.Millisecond)
+	start := time.Now()
+	if _, err := fetch(t, fetcher, server.URL, utils.FetchOptions{}); err == nil {
+		t.Fatal("expect fetch error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("unexpected fetch time %s", elapsed)
+	}
+}
+
+func TestFetchCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", etag)
+		w.Write(bytes.Repeat([]byte(r.URL.Path[1:]), 1000))
+	}))
+	defer server.Close()
+
+	cache, err := utils.NewFetchCache(t.TempDir(), 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher := newTestFetcher()
+	fetcher.SetCache(cache)
+	expectFetch := func(path string, opts utils.FetchOptions, expectRequests int32) {
+		t.Helper()
+		atomic.StoreInt32(&requests, 0)
+		data, err := fetch(t, fetcher, server.URL+path, opts)
+		if err != nil || !bytes.Equal(data, bytes.Repeat([]byte(path[1:]), 1000)) {
+			t.Fatalf("unexpected fetch result of %s, %d %v", path, len(data), err)
+		}
+		if n := atomic.LoadInt32(&requests); n != expectRequests {
+			t.Fatalf("unexpected request count of %s, %d", path, n)
+		}
+	}
+
+	//revalidated by the etag
+	expectFetch("/a", utils.FetchOptions{}, 1)
+	expectFetch("/a", utils.FetchOptions{}, 1)
+
+	//no request for the known hash
+	hashB, _ := utils.Etag(bytes.NewReader(bytes.Repeat([]byte("b"), 1000)))
+	expectFetch("/b", utils.FetchOptions{Hash: hashB}, 1)
+	expectFetch("/b", utils.FetchOptions{Hash: hashB}, 0)
+	if _, err = fetch(t, fetcher, server.URL+"/b", utils.FetchOptions{Hash: hashB, MaxBytes: 999}); err != utils.ErrFetchTooLarge {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 3 || stats.Misses != 2 || stats.Entries != 2 || stats.Size != 2000 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+
+	//the least recently used is removed
+	expectFetch("/c", utils.FetchOptions{}, 1)
+	expectFetch("/b", utils.FetchOptions{Hash: hashB}, 0)
+	expectFetch("/a", utils.FetchOptions{}, 1)
+	if stats = cache.Stats(); stats.Entries != 2 || stats.Size != 2000 {
+		t.Fatalf("unexpected cache stats %+v", stats)
+	}
+
+	//the broken resource is not cached
+	hashD, _ := utils.Etag(bytes.NewReader(bytes.Repeat([]byte("d"), 1000)))
+	if _, err = fetch(t, fetcher, server.URL+"/x", utils.FetchOptions{Hash: hashD}); err == nil {
+		t.Fatal("expect hash mismatch")
+	}
+	expectFetch("/d", utils.FetchOptions{Hash: hashD}, 1)
+}
+
+func TestFetchCacheSweep(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "qufop_cache_9100")
+	cachedPath := filepath.Join(cacheDir, "cached")
+	os.MkdirAll(cacheDir, 0755)
+	ioutil.WriteFile(cachedPath, []byte("hello"), 0644)
+	//the files of others next to the cache dir are kept
+	otherPath := filepath.Join(dir, "other.txt")
+	ioutil.WriteFile(otherPath, []byte("hello"), 0644)
+
+	if _, err := utils.NewFetchCache(cacheDir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cachedPath); !os.IsNotExist(err) {
+		t.Fatalf("cached file not removed, %v", err)
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Fatalf("file out of the cache dir removed, %s", err)
+	}
+}
+
+func TestStatHash(t *testing.T) {
+	cases := map[string]string{
+		"http://a.com/a.png":                                "Fhash",
+		"http://a.com/a.png?e=1451491200&token=ak:sign":     "Fhash",
+		"http://a.com/a.png?imageView2/1/w/100":             "",
+		"http://a.com/a.png?imageView2/1/w/100&e=1&token=t": "",
+		"http://a.com/a.png?avinfo":                         "",
+	}
+	for remoteUrl, expectHash := range cases {
+		if hash := utils.StatHash(remoteUrl, "Fhash"); hash != expectHash {
+			t.Fatalf("unexpected hash of %s, %q", remoteUrl, hash)
+		}
+	}
+}
@@ -2,24 +2,240 @@ package utils
 
 import (
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-func GetParam(fromStr, pattern, key string) (value string) {
-	keyRegx := regexp.MustCompile(pattern)
-	matchStr := keyRegx.FindString(fromStr)
-	value = strings.Replace(matchStr, key+"/", "", -1)
-	return
+const (
+	PARAM_TYPE_STRING = iota
+	PARAM_TYPE_INT
+	PARAM_TYPE_BOOL
+	PARAM_TYPE_ENUM
+	PARAM_TYPE_BASE64
+)
+
+//schema of one command parameter, the command is in format
+//<name>/<param>/<value>/<param>/<value>...
+type ParamSpec struct {
+	Name string
+	Type int
+	//the command is invalid without the parameter
+	Required bool
+	//the parameter can appear more than once
+	Repeatable bool
+	//the value when the parameter is not given
+	Default interface{}
+	//allowed values of PARAM_TYPE_ENUM
+	Values []string
+	//the value of PARAM_TYPE_STRING must match the pattern
+	Pattern string
+	//range of PARAM_TYPE_INT, int values are never negative, Max takes effect only when larger than 0
+	Min int
+	Max int
+	//the parameter appears right after the repeatable parameter and belongs to it,
+	//its values are aligned with the values of that parameter
+	Follows string
+}
+
+//the typed values of the parsed command
+type CommandParams struct {
+	values map[string][]interface{}
+	specs  map[string]ParamSpec
+}
+
+type CommandParser struct {
+	name  string
+	specs []ParamSpec
+	index map[string]ParamSpec
+}
+
+func NewCommandParser(name string, specs ...ParamSpec) *CommandParser {
+	parser := CommandParser{
+		name:  name,
+		specs: specs,
+		index: make(map[string]ParamSpec),
+	}
+	for _, spec := range specs {
+		parser.index[spec.Name] = spec
+	}
+	return &parser
 }
 
-func GetParamDecoded(fromStr, pattern, key string) (value string, err error) {
-	strToDecode := GetParam(fromStr, pattern, key)
-	decodedBytes, decodeErr := base64.URLEncoding.DecodeString(strToDecode)
-	if decodeErr != nil {
-		err = decodeErr
+//parse the command, the error names the bad parameter
+func (this *CommandParser) Parse(cmd string) (params *CommandParams, err error) {
+	if cmd != this.name && !strings.HasPrefix(cmd, this.name+"/") {
+		err = errors.New(fmt.Sprintf("invalid %s command format", this.name))
+		return
+	}
+
+	params = &CommandParams{
+		values: make(map[string][]interface{}),
+		specs:  this.index,
+	}
+
+	items := make([]string, 0)
+	if cmdParams := strings.TrimPrefix(cmd, this.name+"/"); cmdParams != cmd {
+		items = strings.Split(cmdParams, "/")
+	}
+	if len(items)%2 != 0 {
+		err = errors.New(fmt.Sprintf("invalid %s command format, no value for parameter '%s'",
+			this.name, items[len(items)-1]))
 		return
 	}
-	value = string(decodedBytes)
+
+	var lastParam string
+	for index := 0; index < len(items); index += 2 {
+		key := items[index]
+		spec, ok := this.index[key]
+		if !ok {
+			err = errors.New(fmt.Sprintf("invalid %s command format, unknown parameter '%s'", this.name, key))
+			return
+		}
+
+		if spec.Follows != "" {
+			if lastParam != spec.Follows {
+				err = errors.New(fmt.Sprintf("invalid %s parameter '%s', should follow '%s'", this.name, key, spec.Follows))
+				return
+			}
+		} else if !spec.Repeatable && len(params.values[key]) > 0 {
+			err = errors.New(fmt.Sprintf("invalid %s parameter '%s', duplicate parameter", this.name, key))
+			return
+		}
+
+		if items[index+1] == "" {
+			err = errors.New(fmt.Sprintf("invalid %s parameter '%s', empty value", this.name, key))
+			return
+		}
+
+		value, vErr := this.parseValue(spec, items[index+1])
+		if vErr != nil {
+			err = errors.New(fmt.Sprintf("invalid %s parameter '%s', %s", this.name, key, vErr.Error()))
+			return
+		}
+
+		if spec.Follows != "" {
+			//fill the followers of the previous values
+			for len(params.values[key]) < len(params.values[spec.Follows])-1 {
+				params.values[key] = append(params.values[key], spec.Default)
+			}
+		}
+		params.values[key] = append(params.values[key], value)
+		lastParam = key
+	}
+
+	for _, spec := range this.specs {
+		if spec.Required && len(params.values[spec.Name]) == 0 {
+			err = errors.New(fmt.Sprintf("invalid %s command format, missing parameter '%s'", this.name, spec.Name))
+			return
+		}
+		if spec.Follows != "" {
+			for len(params.values[spec.Name]) < len(params.values[spec.Follows]) {
+				params.values[spec.Name] = append(params.values[spec.Name], spec.Default)
+			}
+		}
+	}
+	return
+}
+
+func (this *CommandParser) parseValue(spec ParamSpec, valueStr string) (value interface{}, err error) {
+	switch spec.Type {
+	case PARAM_TYPE_INT:
+		intVal, pErr := strconv.Atoi(valueStr)
+		if pErr != nil || intVal < 0 {
+			err = errors.New("should be a non-negative integer")
+			return
+		}
+		if intVal < spec.Min || (spec.Max > 0 && intVal > spec.Max) {
+			if spec.Max > 0 {
+				err = errors.New(fmt.Sprintf("should between [%d,%d]", spec.Min, spec.Max))
+			} else {
+				err = errors.New(fmt.Sprintf("should not be less than %d", spec.Min))
+			}
+			return
+		}
+		value = intVal
+	case PARAM_TYPE_BOOL:
+		if valueStr != "0" && valueStr != "1" {
+			err = errors.New("should be 0 or 1")
+			return
+		}
+		value = valueStr == "1"
+	case PARAM_TYPE_ENUM:
+		for _, v := range spec.Values {
+			if v == valueStr {
+				value = valueStr
+				return
+			}
+		}
+		err = errors.New(fmt.Sprintf("should be one of '%s'", strings.Join(spec.Values, "|")))
+	case PARAM_TYPE_BASE64:
+		decodedBytes, decodeErr := base64.URLEncoding.DecodeString(valueStr)
+		if decodeErr != nil {
+			//padding is optional
+			decodedBytes, decodeErr = base64.RawURLEncoding.DecodeString(strings.TrimRight(valueStr, "="))
+		}
+		if decodeErr != nil {
+			err = errors.New("should be url safe base64 encoded")
+			return
+		}
+		value = string(decodedBytes)
+	default:
+		if spec.Pattern != "" {
+			if matched, _ := regexp.MatchString(spec.Pattern, valueStr); !matched {
+				err = errors.New(fmt.Sprintf("should match '%s'", spec.Pattern))
+				return
+			}
+		}
+		value = valueStr
+	}
+	return
+}
+
+//whether the parameter is given in the command
+func (this *CommandParams) Has(name string) bool {
+	spec := this.specs[name]
+	if spec.Follows != "" {
+		for _, v := range this.values[name] {
+			if v != spec.Default {
+				return true
+			}
+		}
+		return false
+	}
+	return len(this.values[name]) > 0
+}
+
+func (this *CommandParams) value(name string) interface{} {
+	if values := this.values[name]; len(values) > 0 {
+		return values[0]
+	}
+	return this.specs[name].Default
+}
+
+func (this *CommandParams) String(name string) (value string) {
+	value, _ = this.value(name).(string)
+	return
+}
+
+func (this *CommandParams) Int(name string) (value int) {
+	value, _ = this.value(name).(int)
+	return
+}
+
+func (this *CommandParams) Bool(name string) (value bool) {
+	value, _ = this.value(name).(bool)
+	return
+}
+
+//all the values of the repeatable parameter or its follower
+func (this *CommandParams) Strings(name string) (values []string) {
+	values = make([]string, 0, len(this.values[name]))
+	for _, v := range this.values[name] {
+		strVal, _ := v.(string)
+		values = append(values, strVal)
+	}
 	return
 }
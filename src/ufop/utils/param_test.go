@@ -0,0 +1,84 @@
+package utils_test
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+	"ufop/utils"
+)
+
+var testParser = utils.NewCommandParser("test",
+	utils.ParamSpec{Name: "bucket", Type: utils.PARAM_TYPE_BASE64, Required: true},
+	utils.ParamSpec{Name: "format", Type: utils.PARAM_TYPE_ENUM, Default: "jpg", Values: []string{"png", "jpg"}},
+	utils.ParamSpec{Name: "name", Type: utils.PARAM_TYPE_STRING, Pattern: "^[a-z]+$"},
+	utils.ParamSpec{Name: "quality", Type: utils.PARAM_TYPE_INT, Min: 1, Max: 100},
+	utils.ParamSpec{Name: "rows", Type: utils.PARAM_TYPE_INT, Min: 1},
+	utils.ParamSpec{Name: "force", Type: utils.PARAM_TYPE_BOOL, Default: false},
+	utils.ParamSpec{Name: "url", Type: utils.PARAM_TYPE_BASE64, Repeatable: true},
+	utils.ParamSpec{Name: "alias", Type: utils.PARAM_TYPE_BASE64, Follows: "url", Default: ""},
+)
+
+func encode(str string) string {
+	return base64.URLEncoding.EncodeToString([]byte(str))
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	bucket := "test/bucket/" + encode("a")
+	twoAliases := bucket + "/url/" + encode("u") + "/alias/" + encode("x") + "/alias/" + encode("y")
+	cases := map[string]string{
+		"other/bucket/" + encode("a"):     "invalid test command format",
+		"test":                            "invalid test command format, missing parameter 'bucket'",
+		"test/format/png":                 "invalid test command format, missing parameter 'bucket'",
+		"test/bucket":                     "invalid test command format, no value for parameter 'bucket'",
+		bucket + "/size/1":                "invalid test command format, unknown parameter 'size'",
+		bucket + "/bucket/" + encode("b"): "invalid test parameter 'bucket', duplicate parameter",
+		"test/bucket/":                    "invalid test parameter 'bucket', empty value",
+		"test/bucket/!!":                  "invalid test parameter 'bucket', should be url safe base64 encoded",
+		bucket + "/format/gif":            "invalid test parameter 'format', should be one of 'png|jpg'",
+		bucket + "/name/ABC":              "invalid test parameter 'name', should match '^[a-z]+$'",
+		bucket + "/quality/0":             "invalid test parameter 'quality', should between [1,100]",
+		bucket + "/quality/101":           "invalid test parameter 'quality', should between [1,100]",
+		bucket + "/quality/-1":            "invalid test parameter 'quality', should be a non-negative integer",
+		bucket + "/quality/high":          "invalid test parameter 'quality', should be a non-negative integer",
+		bucket + "/rows/0":                "invalid test parameter 'rows', should not be less than 1",
+		bucket + "/force/2":               "invalid test parameter 'force', should be 0 or 1",
+		bucket + "/alias/" + encode("x"):  "invalid test parameter 'alias', should follow 'url'",
+		twoAliases:                        "invalid test parameter 'alias', should follow 'url'",
+	}
+	for cmd, message := range cases {
+		_, err := testParser.Parse(cmd)
+		if err == nil || err.Error() != message {
+			t.Errorf("parse %s, expect error '%s', got %v", cmd, message, err)
+		}
+	}
+}
+
+func TestParseCommandValues(t *testing.T) {
+	//the optional params take the defaults
+	params, err := testParser.Parse("test/bucket/" + encode("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.String("bucket") != "a" || params.String("format") != "jpg" || params.Int("quality") != 0 ||
+		params.Bool("force") || params.Has("format") || len(params.Strings("url")) != 0 || params.Has("alias") {
+		t.Fatalf("unexpected default values %+v", params)
+	}
+
+	//the padding of base64 is optional, the followers are aligned with the
+	//values of the repeatable param
+	params, err = testParser.Parse("test/bucket/YQ/format/png/name/abc/quality/100/rows/3/force/1" +
+		"/url/" + encode("u1") + "/url/" + encode("u2") + "/alias/" + encode("a2") + "/url/" + encode("u3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.String("bucket") != "a" || params.String("format") != "png" || params.String("name") != "abc" ||
+		params.Int("quality") != 100 || params.Int("rows") != 3 || !params.Bool("force") || !params.Has("format") {
+		t.Fatalf("unexpected values %+v", params)
+	}
+	if urls := params.Strings("url"); !reflect.DeepEqual(urls, []string{"u1", "u2", "u3"}) {
+		t.Fatalf("unexpected urls %v", urls)
+	}
+	if aliases := params.Strings("alias"); !reflect.DeepEqual(aliases, []string{"", "a2", ""}) || !params.Has("alias") {
+		t.Fatalf("unexpected aliases %v", aliases)
+	}
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//scheme of the urls of the intermediate pipeline results, only the files
+//registered by RegisterPipeFile can be read by such urls
+const PIPE_URL_SCHEME = "ufop-pipe"
+
+type pipeFile struct {
+	path     string
+	mimeType string
+}
+
+var pipeFiles = struct {
+	sync.RWMutex
+	files map[string]pipeFile
+}{files: make(map[string]pipeFile)}
+
+//make the local file readable by the fetcher, call unregister when the file is not needed
+func RegisterPipeFile(path, mimeType string) (pipeUrl string, unregister func()) {
+	idBytes := make([]byte, 16)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+
+	pipeFiles.Lock()
+	pipeFiles.files[id] = pipeFile{path, mimeType}
+	pipeFiles.Unlock()
+
+	pipeUrl = fmt.Sprintf("%s://%s", PIPE_URL_SCHEME, id)
+	unregister = func() {
+		pipeFiles.Lock()
+		delete(pipeFiles.files, id)
+		pipeFiles.Unlock()
+	}
+	return
+}
+
+type pipeTransport struct{}
+
+func (this pipeTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	resp = &http.Response{
+		Proto:      "HTTP/1.0",
+		ProtoMajor: 1,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	pipeFiles.RLock()
+	file, ok := pipeFiles.files[req.URL.Host]
+	pipeFiles.RUnlock()
+	if !ok {
+		resp.StatusCode = http.StatusNotFound
+		resp.Status = "404 Not Found"
+		resp.Body = ioutil.NopCloser(strings.NewReader(""))
+		return
+	}
+
+	fp, openErr := os.Open(file.path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	stat, statErr := fp.Stat()
+	if statErr != nil {
+		fp.Close()
+		return nil, statErr
+	}
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.ContentLength = stat.Size()
+	resp.Header.Set("Content-Length", strconv.FormatInt(stat.Size(), 10))
+	if file.mimeType != "" {
+		resp.Header.Set("Content-Type", file.mimeType)
+	}
+	resp.Body = fp
+	return
+}
@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	FETCH_PROXY_HEADER_TIMEOUT = 10 * time.Second
+)
+
+//the headers of the connection between the client and the proxy, not forwarded
+var fetchProxyHopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+//the local http proxy of the external programs which fetch the pages by
+//themselves, like wkhtmltopdf, the urls requested through it are checked by
+//the policy of the fetcher, and the addresses are checked when connecting, so
+//the redirects and the sub resources of the pages are checked too
+type FetchProxy struct {
+	fetcher  *Fetcher
+	ctx      context.Context
+	listener net.Listener
+	server   *http.Server
+
+	lock sync.Mutex
+	//the connections of the https tunnels, closed with the proxy
+	tunnels  map[net.Conn]bool
+	closed   bool
+	rejected *URLPolicyError
+}
+
+//start the proxy on the loopback address, the requests are made with the
+//context, the caller closes the proxy after the program exits
+func (this *Fetcher) StartProxy(ctx context.Context) (proxy *FetchProxy, err error) {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		err = errors.New(fmt.Sprintf("listen fetch proxy failed, %s", listenErr.Error()))
+		return
+	}
+	proxy = &FetchProxy{
+		fetcher:  this,
+		ctx:      ctx,
+		listener: listener,
+		tunnels:  make(map[net.Conn]bool),
+	}
+	proxy.server = &http.Server{
+		Handler:           proxy,
+		ReadHeaderTimeout: FETCH_PROXY_HEADER_TIMEOUT,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	go proxy.server.Serve(listener)
+	return
+}
+
+//the proxy url passed to the program
+func (this *FetchProxy) URL() string {
+	return "http://" + this.listener.Addr().String()
+}
+
+//the first url rejected by the policy, nil if none
+func (this *FetchProxy) Rejected() *URLPolicyError {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.rejected
+}
+
+//stop the proxy and close the tunnels
+func (this *FetchProxy) Close() {
+	this.server.Close()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	for conn := range this.tunnels {
+		conn.Close()
+	}
+	this.tunnels = make(map[net.Conn]bool)
+}
+
+func (this *FetchProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		this.tunnel(w, req)
+		return
+	}
+
+	//the https urls are tunneled, the local pipe files are never proxied
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		http.Error(w, fmt.Sprintf("url '%s' not proxied", req.URL), http.StatusBadRequest)
+		return
+	}
+	if err := this.check(req.URL.String()); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.RequestURI = ""
+	for _, header := range fetchProxyHopHeaders {
+		outReq.Header.Del(header)
+	}
+	//the redirects are returned to the program, and checked when requested
+	resp, rtErr := this.fetcher.client.Transport.RoundTrip(outReq)
+	if rtErr != nil {
+		if this.reject(rtErr) {
+			http.Error(w, rtErr.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, rtErr.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, header := range fetchProxyHopHeaders {
+		resp.Header.Del(header)
+	}
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+//tunnel the https connection to the host, the address is checked when connecting
+func (this *FetchProxy) tunnel(w http.ResponseWriter, req *http.Request) {
+	if err := this.check(fmt.Sprintf("https://%s/", req.Host)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnel not supported", http.StatusInternalServerError)
+		return
+	}
+
+	serverConn, dialErr := this.fetcher.dialContext(req.Context(), "tcp", req.Host)
+	if dialErr != nil {
+		if this.reject(dialErr) {
+			http.Error(w, dialErr.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, dialErr.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+	clientConn, clientBuf, hijackErr := hijacker.Hijack()
+	if hijackErr != nil {
+		serverConn.Close()
+		return
+	}
+	if !this.track(clientConn, serverConn) {
+		clientConn.Close()
+		serverConn.Close()
+		return
+	}
+	defer this.untrack(clientConn, serverConn)
+
+	if _, wErr := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); wErr != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(serverConn, clientBuf)
+		serverConn.Close()
+		close(done)
+	}()
+	io.Copy(clientConn, serverConn)
+	clientConn.Close()
+	<-done
+}
+
+func (this *FetchProxy) track(conns ...net.Conn) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.closed {
+		return false
+	}
+	for _, conn := range conns {
+		this.tunnels[conn] = true
+	}
+	return true
+}
+
+func (this *FetchProxy) untrack(conns ...net.Conn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+		delete(this.tunnels, conn)
+	}
+}
+
+//check the url by the policy of the fetcher
+func (this *FetchProxy) check(rawUrl string) (err error) {
+	policy := this.fetcher.Policy()
+	if policy == nil {
+		return
+	}
+	err = policy.CheckURL(rawUrl)
+	this.reject(err)
+	return
+}
+
+//keep the first url rejected by the policy, false if the error is not a rejection
+func (this *FetchProxy) reject(err error) bool {
+	var policyErr *URLPolicyError
+	if !errors.As(err, &policyErr) {
+		return false
+	}
+	this.lock.Lock()
+	if this.rejected == nil {
+		this.rejected = policyErr
+	}
+	this.lock.Unlock()
+	reportURLRejected(this.ctx, policyErr)
+	return true
+}
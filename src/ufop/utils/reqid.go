@@ -1,24 +1,99 @@
 package utils
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"hash/fnv"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
+//the request id is the url safe base64 of
+//
+//version 0, 12 bytes: pid(4) unix nano(8)
+//version 1, 21 bytes: pid(4) unix nano(8) instance(4) counter(4) version(1)
+//
+//all little endian, the instance tells the hosts or the containers apart, the
+//counter tells apart the ids created in the same nanosecond
+const (
+	REQUEST_ID_V0_LENGTH = 12
+	REQUEST_ID_V1_LENGTH = 21
+	REQUEST_ID_VERSION   = 1
+)
+
 var pid = uint32(os.Getpid())
 
+var instanceId = newInstanceId()
+
+var requestCounter uint32
+
+//the decoded request id
+type RequestIdInfo struct {
+	Version  int
+	Pid      uint
+	UnixNano int64
+	//0 for version 0
+	Instance uint32
+	Counter  uint32
+}
+
+//the hash of the host name, which is the container id or the pod name in the
+//containers, random if the host name is unknown
+func newInstanceId() uint32 {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		var b [4]byte
+		rand.Read(b[:])
+		return binary.LittleEndian.Uint32(b[:])
+	}
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return h.Sum32()
+}
+
+//the instance id of this process, in the request ids it creates
+func InstanceId() uint32 {
+	return instanceId
+}
+
 func NewRequestId() string {
-	var b [12]byte
+	var b [REQUEST_ID_V1_LENGTH]byte
 	binary.LittleEndian.PutUint32(b[:], pid)
 	binary.LittleEndian.PutUint64(b[4:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint32(b[12:], instanceId)
+	binary.LittleEndian.PutUint32(b[16:], atomic.AddUint32(&requestCounter, 1))
+	b[20] = REQUEST_ID_VERSION
 	return base64.URLEncoding.EncodeToString(b[:])
 }
 
+//decode the ids of both versions, false if the id is not created by qufop
+func ParseRequestId(reqId string) (info RequestIdInfo, ok bool) {
+	b, err := base64.URLEncoding.DecodeString(reqId)
+	if err != nil {
+		return
+	}
+	switch {
+	case len(b) == REQUEST_ID_V0_LENGTH:
+	case len(b) == REQUEST_ID_V1_LENGTH && b[20] == REQUEST_ID_VERSION:
+		info.Version = REQUEST_ID_VERSION
+		info.Instance = binary.LittleEndian.Uint32(b[12:])
+		info.Counter = binary.LittleEndian.Uint32(b[16:])
+	default:
+		return
+	}
+	info.Pid = uint(binary.LittleEndian.Uint32(b[:4]))
+	info.UnixNano = int64(binary.LittleEndian.Uint64(b[4:]))
+	ok = true
+	return
+}
+
+//the pid and the unix nano of the id, zeros if invalid, the first 12 bytes
+//are the same in all the versions
 func DecodeRequestId(reqId string) (uint, int64) {
 	b, err := base64.URLEncoding.DecodeString(reqId)
-	if err != nil || len(b) < 12 {
+	if err != nil || len(b) < REQUEST_ID_V0_LENGTH {
 		return 0, 0
 	}
 	pid := binary.LittleEndian.Uint32(b[:4])
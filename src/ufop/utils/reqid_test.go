@@ -0,0 +1,48 @@
+package utils_test
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+	"ufop/utils"
+)
+
+func TestRequestId(t *testing.T) {
+	before := time.Now().UnixNano()
+	idA, idB := utils.NewRequestId(), utils.NewRequestId()
+	if idA == idB {
+		t.Fatalf("duplicate request id %s", idA)
+	}
+	infoA, okA := utils.ParseRequestId(idA)
+	infoB, okB := utils.ParseRequestId(idB)
+	if !okA || !okB {
+		t.Fatalf("invalid request ids %s %s", idA, idB)
+	}
+	if infoA.Version != 1 || infoA.Pid != uint(os.Getpid()) || infoA.Instance != utils.InstanceId() ||
+		infoA.UnixNano < before || infoB.Counter != infoA.Counter+1 {
+		t.Fatalf("unexpected request id info %+v %+v", infoA, infoB)
+	}
+	if pid, unixNano := utils.DecodeRequestId(idA); pid != infoA.Pid || unixNano != infoA.UnixNano {
+		t.Fatalf("unexpected decoded request id %d %d", pid, unixNano)
+	}
+
+	//the ids of the old version
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[:], 1)
+	binary.LittleEndian.PutUint64(b[4:], uint64(before))
+	oldId := base64.URLEncoding.EncodeToString(b[:])
+	if info, ok := utils.ParseRequestId(oldId); !ok || info.Version != 0 || info.Pid != 1 || info.UnixNano != before {
+		t.Fatalf("unexpected request id info %+v", info)
+	}
+	if pid, unixNano := utils.DecodeRequestId(oldId); pid != 1 || unixNano != before {
+		t.Fatalf("unexpected decoded request id %d %d", pid, unixNano)
+	}
+
+	for _, invalid := range []string{"", "dora-req-1", "!!", base64.URLEncoding.EncodeToString(make([]byte, 21))} {
+		if _, ok := utils.ParseRequestId(invalid); ok {
+			t.Fatalf("invalid request id %q parsed", invalid)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"errors"
@@ -16,38 +17,60 @@ func Md5Hex(str string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func Download(remoteUrl, localPath string) (contentType string, err error) {
-	resp, respErr := http.Get(remoteUrl)
-	if respErr != nil || resp.StatusCode != http.StatusOK {
-		if respErr != nil {
-			err = errors.New(fmt.Sprintf("get resource by url '%s' failed, %s", remoteUrl, respErr.Error()))
-		} else {
-			err = errors.New(fmt.Sprintf("get resource by url '%s' faild, %s", remoteUrl, resp.Status))
-			if resp.Body != nil {
-				resp.Body.Close()
-			}
-		}
+type byteCounterKey struct{}
+
+//the bytes read from the response bodies of GetContext and the fetcher are reported to the counter
+func WithByteCounter(ctx context.Context, counter func(n int64)) context.Context {
+	return context.WithValue(ctx, byteCounterKey{}, counter)
+}
+
+type countingReadCloser struct {
+	io.ReadCloser
+	counter func(n int64)
+}
+
+func (this *countingReadCloser) Read(p []byte) (n int, err error) {
+	n, err = this.ReadCloser.Read(p)
+	if n > 0 {
+		this.counter(int64(n))
+	}
+	return
+}
+
+//http get which is aborted when the context is done, one request only
+func GetContext(ctx context.Context, remoteUrl string) (resp *http.Response, err error) {
+	req, reqErr := http.NewRequest("GET", remoteUrl, nil)
+	if reqErr != nil {
+		err = reqErr
 		return
 	}
+	resp, err = DefaultFetcher().client.Do(req.WithContext(ctx))
+	if err == nil {
+		if counter, ok := ctx.Value(byteCounterKey{}).(func(n int64)); ok {
+			resp.Body = &countingReadCloser{resp.Body, counter}
+		}
+	}
+	return
+}
 
-	defer resp.Body.Close()
+func Download(remoteUrl, localPath string) (contentType string, err error) {
+	return DownloadContext(context.Background(), remoteUrl, localPath)
+}
 
-	contentType = resp.Header.Get("Content-Type")
+//save the resource by the default fetcher, with the fetch options of the context
+func DownloadContext(ctx context.Context, remoteUrl, localPath string) (contentType string, err error) {
 	localFp, openErr := os.Create(localPath)
 	if openErr != nil {
 		err = errors.New(fmt.Sprintf("open file by local path failed, %s", openErr.Error()))
 		return
 	}
-
 	defer localFp.Close()
 
-	_, cpErr := io.Copy(localFp, resp.Body)
-
-	if cpErr != nil {
-		err = errors.New(fmt.Sprintf("save remote file to local failed, %s", cpErr.Error()))
+	contentType, fetchErr := DefaultFetcher().Fetch(ctx, remoteUrl, localFp, FetchOptionsFrom(ctx))
+	if fetchErr != nil {
+		err = errors.New(fmt.Sprintf("get resource by url '%s' failed, %s", remoteUrl, fetchErr.Error()))
 		return
 	}
-
 	return
 }
 
@@ -0,0 +1,255 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+//the schemes allowed when none is configured
+var URL_POLICY_DEFAULT_SCHEMES = []string{"http", "https"}
+
+//the address ranges not in the private, loopback or link local ones of the net
+//package but not reachable from the internet either
+var urlPolicyReservedNets = mustParseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24",
+	"198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96")
+
+//the url is rejected by the policy
+type URLPolicyError struct {
+	Url    string
+	Reason string
+}
+
+func (this *URLPolicyError) Error() string {
+	return fmt.Sprintf("url '%s' not allowed, %s", this.Url, this.Reason)
+}
+
+//the urls allowed to fetch, the schemes and the hosts are checked before the
+//request, and the addresses are checked when connecting, so the hosts resolved
+//to the internal addresses are rejected too, the host patterns are the exact
+//host names, the domain suffixes starting with a dot, or the ips and cidrs,
+//the exact host names and the ips and cidrs in the allowed hosts may be internal
+type URLPolicy struct {
+	schemes    []string
+	allowHosts []string
+	allowNets  []*net.IPNet
+	denyHosts  []string
+	denyNets   []*net.IPNet
+	//the private, loopback and link local addresses are allowed
+	allowPrivate bool
+}
+
+func NewURLPolicy(schemes, allowHosts, denyHosts []string, allowPrivate bool) (policy *URLPolicy, err error) {
+	policy = &URLPolicy{
+		schemes:      URL_POLICY_DEFAULT_SCHEMES,
+		allowPrivate: allowPrivate,
+	}
+	if len(schemes) > 0 {
+		policy.schemes = make([]string, 0, len(schemes))
+		for _, scheme := range schemes {
+			policy.schemes = append(policy.schemes, strings.ToLower(scheme))
+		}
+	}
+
+	for _, host := range allowHosts {
+		if host == "" {
+			err = errors.New("empty host in the allowed hosts")
+			return
+		}
+		policy.allowHosts = append(policy.allowHosts, strings.ToLower(host))
+		if ipNet := parseIPNet(host); ipNet != nil {
+			policy.allowNets = append(policy.allowNets, ipNet)
+		}
+	}
+	for _, host := range denyHosts {
+		if host == "" {
+			err = errors.New("empty host in the denied hosts")
+			return
+		}
+		policy.denyHosts = append(policy.denyHosts, strings.ToLower(host))
+		if ipNet := parseIPNet(host); ipNet != nil {
+			policy.denyNets = append(policy.denyNets, ipNet)
+		}
+	}
+	return
+}
+
+//check the scheme and the host of the url, the addresses of the host names
+//are checked when connecting
+func (this *URLPolicy) CheckURL(rawUrl string) (err error) {
+	reqUrl, pErr := url.Parse(rawUrl)
+	if pErr != nil {
+		err = &URLPolicyError{rawUrl, "invalid url"}
+		return
+	}
+
+	scheme := strings.ToLower(reqUrl.Scheme)
+	schemeAllowed := false
+	for _, allowed := range this.schemes {
+		if scheme == allowed {
+			schemeAllowed = true
+			break
+		}
+	}
+	if !schemeAllowed {
+		err = &URLPolicyError{rawUrl, fmt.Sprintf("scheme '%s' not allowed", reqUrl.Scheme)}
+		return
+	}
+
+	host := strings.ToLower(reqUrl.Hostname())
+	if host == "" {
+		err = &URLPolicyError{rawUrl, "no host"}
+		return
+	}
+	if matchHosts(host, this.denyHosts) {
+		err = &URLPolicyError{rawUrl, fmt.Sprintf("host '%s' denied", host)}
+		return
+	}
+	if len(this.allowHosts) > 0 && !matchHosts(host, this.allowHosts) {
+		err = &URLPolicyError{rawUrl, fmt.Sprintf("host '%s' not in the allowed hosts", host)}
+		return
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if reason := this.checkIP(host, ip); reason != "" {
+			err = &URLPolicyError{rawUrl, reason}
+		}
+	}
+	return
+}
+
+//check the url and all the addresses of its host, for the urls fetched by the
+//external programs, which connect by themselves
+func (this *URLPolicy) CheckURLAddrs(ctx context.Context, rawUrl string) (err error) {
+	if err = this.CheckURL(rawUrl); err != nil {
+		return
+	}
+	reqUrl, _ := url.Parse(rawUrl)
+	host := reqUrl.Hostname()
+	if net.ParseIP(host) != nil {
+		return
+	}
+	addrs, lookupErr := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if lookupErr != nil {
+		err = errors.New(fmt.Sprintf("lookup host '%s' failed, %s", host, lookupErr.Error()))
+		return
+	}
+	for _, addr := range addrs {
+		if reason := this.checkIP(strings.ToLower(host), addr.IP); reason != "" {
+			err = &URLPolicyError{rawUrl, reason}
+			return
+		}
+	}
+	return
+}
+
+//check the address of the host to connect, the reason is empty if allowed
+func (this *URLPolicy) checkIP(host string, ip net.IP) (reason string) {
+	for _, ipNet := range this.denyNets {
+		if ipNet.Contains(ip) {
+			reason = fmt.Sprintf("address '%s' denied", ip)
+			return
+		}
+	}
+	if this.allowPrivate || this.allowInternal(host, ip) {
+		return
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		reason = fmt.Sprintf("address '%s' is internal", ip)
+		return
+	}
+	for _, ipNet := range urlPolicyReservedNets {
+		if ipNet.Contains(ip) {
+			reason = fmt.Sprintf("address '%s' is internal", ip)
+			return
+		}
+	}
+	return
+}
+
+//the internal address is allowed only for the exact host name, or the ip and
+//cidr in the allowed hosts, not for the domain suffixes, whose sub domains may
+//be resolved to any address
+func (this *URLPolicy) allowInternal(host string, ip net.IP) bool {
+	for _, ipNet := range this.allowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return false
+	}
+	for _, pattern := range this.allowHosts {
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+//the dialer control to check the address after the host is resolved, the host
+//is the one dialed, empty if unknown
+func (this *URLPolicy) checkAddr(host, address string) (err error) {
+	addrHost, _, splitErr := net.SplitHostPort(address)
+	if splitErr != nil {
+		err = splitErr
+		return
+	}
+	ip := net.ParseIP(addrHost)
+	if ip == nil {
+		err = &URLPolicyError{address, "invalid address"}
+		return
+	}
+	if reason := this.checkIP(host, ip); reason != "" {
+		err = &URLPolicyError{address, reason}
+	}
+	return
+}
+
+func matchHosts(host string, patterns []string) bool {
+	ip := net.ParseIP(host)
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if strings.HasSuffix(host, pattern) || host == pattern[1:] {
+				return true
+			}
+		} else if ipNet := parseIPNet(pattern); ipNet != nil {
+			if ip != nil && ipNet.Contains(ip) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+//the ip or the cidr, nil for the host names
+func parseIPNet(pattern string) *net.IPNet {
+	if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+		return ipNet
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) (ipNets []*net.IPNet) {
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return
+}
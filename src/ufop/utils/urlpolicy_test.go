@@ -0,0 +1,220 @@
+package utils_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"ufop/utils"
+)
+
+func TestURLPolicy(t *testing.T) {
+	cases := []struct {
+		schemes      []string
+		allowHosts   []string
+		denyHosts    []string
+		allowPrivate bool
+		url          string
+		reason       string
+	}{
+		{url: "http://www.qiniu.com/a.png"},
+		{url: "HTTPS://WWW.QINIU.COM/a.png"},
+		{url: "file:///etc/passwd", reason: "scheme 'file' not allowed"},
+		{url: "ftp://www.qiniu.com/a.png", reason: "scheme 'ftp' not allowed"},
+		{schemes: []string{"ftp"}, url: "ftp://www.qiniu.com/a.png"},
+		{url: "http:///a.png", reason: "no host"},
+		{url: "http://127.0.0.1:9100/a.png", reason: "address '127.0.0.1' is internal"},
+		{url: "http://10.1.2.3/a.png", reason: "address '10.1.2.3' is internal"},
+		{url: "http://169.254.169.254/latest/meta-data", reason: "address '169.254.169.254' is internal"},
+		{url: "http://[::1]/a.png", reason: "address '::1' is internal"},
+		{url: "http://[fd00::1]/a.png", reason: "address 'fd00::1' is internal"},
+		{url: "http://100.64.0.1/a.png", reason: "address '100.64.0.1' is internal"},
+		{allowPrivate: true, url: "http://127.0.0.1:9100/a.png"},
+		{allowPrivate: true, denyHosts: []string{"10.0.0.0/8"}, url: "http://10.1.2.3/a.png", reason: "host '10.1.2.3' denied"},
+		{denyHosts: []string{".internal.com"}, url: "http://db.internal.com/", reason: "host 'db.internal.com' denied"},
+		{denyHosts: []string{".internal.com"}, url: "http://internal.com/", reason: "host 'internal.com' denied"},
+		{denyHosts: []string{".internal.com"}, url: "http://notinternal.com/"},
+		{allowHosts: []string{"www.qiniu.com", ".qiniudn.com"}, url: "http://a.qiniudn.com/a.png"},
+		{allowHosts: []string{"www.qiniu.com", ".qiniudn.com"}, url: "http://www.example.com/a.png",
+			reason: "host 'www.example.com' not in the allowed hosts"},
+		{allowHosts: []string{"10.1.2.3", "www.qiniu.com"}, url: "http://10.1.2.3/a.png"},
+		{allowHosts: []string{"10.0.0.0/8"}, url: "http://10.1.2.3/a.png"},
+		{allowHosts: []string{"10.0.0.0/8"}, url: "http://192.168.1.1/a.png", reason: "host '192.168.1.1' not in the allowed hosts"},
+		{allowHosts: []string{"10.0.0.0/8"}, denyHosts: []string{"10.1.0.0/16"}, url: "http://10.1.2.3/a.png",
+			reason: "host '10.1.2.3' denied"},
+	}
+	for _, c := range cases {
+		policy, err := utils.NewURLPolicy(c.schemes, c.allowHosts, c.denyHosts, c.allowPrivate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = policy.CheckURL(c.url)
+		if c.reason == "" && err != nil {
+			t.Fatalf("unexpected error of %s, %v", c.url, err)
+		}
+		if c.reason != "" && (err == nil || err.(*utils.URLPolicyError).Reason != c.reason) {
+			t.Fatalf("unexpected error of %s, %v", c.url, err)
+		}
+	}
+}
+
+func TestFetchPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://denied.example.com/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	//the host name resolved to the loopback address is rejected when connecting
+	fetcher := newTestFetcher()
+	policy, _ := utils.NewURLPolicy(nil, nil, []string{"denied.example.com"}, false)
+	fetcher.SetPolicy(policy)
+	localUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	var rejected *utils.URLPolicyError
+	ctx := utils.WithURLRejectHandler(context.Background(), func(err *utils.URLPolicyError) {
+		rejected = err
+	})
+	if _, err := fetcher.Open(ctx, localUrl, utils.FetchOptions{}); err == nil || rejected == nil ||
+		!strings.Contains(err.Error(), "is internal") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+
+	//every redirect is checked
+	policy, _ = utils.NewURLPolicy(nil, nil, []string{"denied.example.com"}, true)
+	fetcher.SetPolicy(policy)
+	if _, err := fetch(t, fetcher, server.URL, utils.FetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetch(t, fetcher, server.URL+"/redirect", utils.FetchOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "host 'denied.example.com' denied") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+}
+
+func TestFetchAllowInternal(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://"+r.Host+"/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	localUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	//the internal host given by the exact name is allowed
+	fetcher := newTestFetcher()
+	policy, _ := utils.NewURLPolicy(nil, []string{"localhost", ".qiniudn.com"}, nil, false)
+	fetcher.SetPolicy(policy)
+	if data, err := fetch(t, fetcher, localUrl+"/redirect", utils.FetchOptions{}); err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected fetch result %q %v", data, err)
+	}
+	if err := policy.CheckURLAddrs(context.Background(), localUrl); err != nil {
+		t.Fatal(err)
+	}
+
+	//the other internal addresses are still rejected
+	if _, err := fetch(t, fetcher, server.URL, utils.FetchOptions{}); err == nil ||
+		!strings.Contains(err.Error(), "host '127.0.0.1' not in the allowed hosts") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+
+	//the domain suffix may be resolved to any address, not allowed to be internal,
+	//a new fetcher is used to dial again
+	fetcher = newTestFetcher()
+	policy, _ = utils.NewURLPolicy(nil, []string{".localhost"}, nil, false)
+	fetcher.SetPolicy(policy)
+	if _, err := fetch(t, fetcher, localUrl, utils.FetchOptions{}); err == nil || !strings.Contains(err.Error(), "is internal") {
+		t.Fatalf("unexpected fetch error %v", err)
+	}
+	if err := policy.CheckURLAddrs(context.Background(), localUrl); err == nil || !strings.Contains(err.Error(), "is internal") {
+		t.Fatalf("unexpected check error %v", err)
+	}
+
+	//the allowed cidr
+	fetcher = newTestFetcher()
+	policy, _ = utils.NewURLPolicy(nil, []string{"127.0.0.0/8"}, nil, false)
+	fetcher.SetPolicy(policy)
+	if data, err := fetch(t, fetcher, server.URL, utils.FetchOptions{}); err != nil || string(data) != "hello" {
+		t.Fatalf("unexpected fetch result %q %v", data, err)
+	}
+}
+
+func TestFetchProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://denied.example.com/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello tls"))
+	}))
+	defer tlsServer.Close()
+
+	fetcher := newTestFetcher()
+	policy, _ := utils.NewURLPolicy(nil, nil, []string{"denied.example.com"}, true)
+	fetcher.SetPolicy(policy)
+	startProxy := func() (*utils.FetchProxy, *http.Client) {
+		proxy, err := fetcher.StartProxy(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyUrl, _ := url.Parse(proxy.URL())
+		client := tlsServer.Client()
+		client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyUrl)
+		return proxy, client
+	}
+	get := func(client *http.Client, remoteUrl string) (string, error) {
+		resp, err := client.Get(remoteUrl)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Sprintf("%d %s", resp.StatusCode, data), nil
+	}
+
+	//the http requests are forwarded and the https ones are tunneled
+	proxy, client := startProxy()
+	if result, err := get(client, server.URL); err != nil || result != "200 hello" {
+		t.Fatalf("unexpected proxy result %s %v", result, err)
+	}
+	if result, err := get(client, tlsServer.URL); err != nil || result != "200 hello tls" {
+		t.Fatalf("unexpected proxy result %s %v", result, err)
+	}
+	if proxy.Rejected() != nil {
+		t.Fatalf("unexpected rejected url %v", proxy.Rejected())
+	}
+
+	//the redirects are checked when requested through the proxy
+	if result, _ := get(client, server.URL+"/redirect"); !strings.HasPrefix(result, "403 ") ||
+		proxy.Rejected() == nil || proxy.Rejected().Reason != "host 'denied.example.com' denied" {
+		t.Fatalf("unexpected proxy result %s %v", result, proxy.Rejected())
+	}
+	proxy.Close()
+
+	//the host names resolved to the internal addresses are rejected when connecting
+	policy, _ = utils.NewURLPolicy(nil, nil, nil, false)
+	fetcher.SetPolicy(policy)
+	proxy, client = startProxy()
+	defer proxy.Close()
+	localUrl := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if result, _ := get(client, localUrl); !strings.HasPrefix(result, "403 ") ||
+		proxy.Rejected() == nil || !strings.Contains(proxy.Rejected().Reason, "is internal") {
+		t.Fatalf("unexpected proxy result %s %v", result, proxy.Rejected())
+	}
+	localTlsUrl := strings.Replace(tlsServer.URL, "127.0.0.1", "localhost", 1)
+	if _, err := get(client, localTlsUrl); err == nil {
+		t.Fatal("internal address tunneled")
+	}
+}